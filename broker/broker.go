@@ -70,6 +70,13 @@ type Broker struct {
 	shutdownCh   chan struct{}
 	shutdown     bool
 	shutdownLock sync.Mutex
+
+	// offlineLogDirs are the log dirs that have failed and why.
+	offlineLogDirs map[string]error
+	logDirsLock    sync.RWMutex
+	// dirLocks are held on the data dir and log dirs while the broker's
+	// running, so another broker can't use them.
+	dirLocks []*commitlog.FileLock
 }
 
 // New is used to instantiate a new broker.
@@ -90,6 +97,15 @@ func New(config *config.Config, logger log.Logger) (*Broker, error) {
 
 	b.logger.Info("hello")
 
+	if err := b.lockDirs(); err != nil {
+		return nil, err
+	}
+
+	if err := b.quarantineLogDirs(); err != nil {
+		b.unlockDirs()
+		return nil, err
+	}
+
 	if err := b.setupRaft(); err != nil {
 		b.Shutdown()
 		return nil, fmt.Errorf("failed to start raft: %v", err)
@@ -105,6 +121,8 @@ func New(config *config.Config, logger log.Logger) (*Broker, error) {
 
 	go b.monitorLeadership()
 
+	go b.loadReplicas()
+
 	return b, nil
 }
 
@@ -112,43 +130,92 @@ func New(config *config.Config, logger log.Logger) (*Broker, error) {
 
 // Run starts a loop to handle requests send back responses.
 func (b *Broker) Run(ctx context.Context, requestc <-chan jocko.Request, responsec chan<- jocko.Response) {
-	var conn io.ReadWriter
-	var header *protocol.RequestHeader
-	var resp protocol.ResponseBody
+	// a fetch that can wait for messages to be appended is handled in its
+	// own goroutine so it doesn't hold up other requests. Its connection's
+	// later requests are held until it's responded to, so the connection's
+	// responses are in the order of its requests.
+	held := make(map[io.ReadWriter][]jocko.Request)
+	fetchedc := make(chan jocko.Response)
+
+	handle := func(request jocko.Request) {
+		if requests, ok := held[request.Conn]; ok {
+			held[request.Conn] = append(requests, request)
+			return
+		}
+		req, ok := request.Request.(*protocol.FetchRequest)
+		if ok && req.MinBytes > 0 && req.MaxWaitTime > 0 && protocol.SupportsVersion(req, request.Header.APIVersion) {
+			held[request.Conn] = nil
+			go func() {
+				resp := newResponse(request, b.handleFetch(request.Header, req))
+				select {
+				case fetchedc <- resp:
+				case <-ctx.Done():
+				}
+			}()
+			return
+		}
+		responsec <- newResponse(request, b.handle(request))
+	}
 
 	for {
 		select {
 		case request := <-requestc:
-			conn = request.Conn
-			header = request.Header
-
-			switch req := request.Request.(type) {
-			case *protocol.APIVersionsRequest:
-				resp = b.handleAPIVersions(header, req)
-			case *protocol.ProduceRequest:
-				resp = b.handleProduce(header, req)
-			case *protocol.FetchRequest:
-				resp = b.handleFetch(header, req)
-			case *protocol.OffsetsRequest:
-				resp = b.handleOffsets(header, req)
-			case *protocol.MetadataRequest:
-				resp = b.handleMetadata(header, req)
-			case *protocol.CreateTopicRequests:
-				resp = b.handleCreateTopic(header, req)
-			case *protocol.DeleteTopicsRequest:
-				resp = b.handleDeleteTopics(header, req)
-			case *protocol.LeaderAndISRRequest:
-				resp = b.handleLeaderAndISR(header, req)
+			handle(request)
+		case resp := <-fetchedc:
+			responsec <- resp
+			requests := held[resp.Conn]
+			delete(held, resp.Conn)
+			for _, request := range requests {
+				handle(request)
 			}
 		case <-ctx.Done():
 			return
 		}
+	}
+}
 
-		responsec <- jocko.Response{Conn: conn, Header: header, Response: &protocol.Response{
-			CorrelationID: header.CorrelationID,
-			Body:          resp,
-		}}
+// handle returns the response to the request.
+func (b *Broker) handle(request jocko.Request) protocol.ResponseBody {
+	header := request.Header
+	if req, ok := request.Request.(protocol.Versioned); ok && !protocol.SupportsVersion(req, header.APIVersion) {
+		return b.handleUnsupportedVersion(header, req)
 	}
+
+	switch req := request.Request.(type) {
+	case *protocol.APIVersionsRequest:
+		return b.handleAPIVersions(header, req)
+	case *protocol.ProduceRequest:
+		return b.handleProduce(header, req)
+	case *protocol.FetchRequest:
+		return b.handleFetch(header, req)
+	case *protocol.OffsetsRequest:
+		return b.handleOffsets(header, req)
+	case *protocol.MetadataRequest:
+		return b.handleMetadata(header, req)
+	case *protocol.CreateTopicRequests:
+		return b.handleCreateTopic(header, req)
+	case *protocol.DeleteTopicsRequest:
+		return b.handleDeleteTopics(header, req)
+	case *protocol.LeaderAndISRRequest:
+		return b.handleLeaderAndISR(header, req)
+	case *protocol.GroupCoordinatorRequest:
+		return b.handleGroupCoordinator(header, req)
+	case *protocol.OffsetCommitRequest:
+		return b.handleOffsetCommit(header, req)
+	case *protocol.OffsetFetchRequest:
+		return b.handleOffsetFetch(header, req)
+	default:
+		// the request's API key is unknown or one the broker doesn't
+		// handle
+		return &protocol.ErrorResponse{ErrorCode: protocol.ErrUnsupportedVersion.Code()}
+	}
+}
+
+func newResponse(request jocko.Request, body protocol.ResponseBody) jocko.Response {
+	return jocko.Response{Conn: request.Conn, Header: request.Header, Response: &protocol.Response{
+		CorrelationID: request.Header.CorrelationID,
+		Body:          body,
+	}}
 }
 
 // Join is used to have the broker join the gossip ring.
@@ -162,35 +229,48 @@ func (b *Broker) JoinLAN(addrs ...string) protocol.Error {
 
 // Request handling.
 
-var (
-	APIVersions = &protocol.APIVersionsResponse{
-		APIVersions: []protocol.APIVersion{
-			{APIKey: protocol.ProduceKey, MinVersion: 2, MaxVersion: 2},
-			{APIKey: protocol.FetchKey},
-			{APIKey: protocol.OffsetsKey},
-			{APIKey: protocol.MetadataKey},
-			{APIKey: protocol.LeaderAndISRKey},
-			{APIKey: protocol.StopReplicaKey},
-			{APIKey: protocol.GroupCoordinatorKey},
-			{APIKey: protocol.JoinGroupKey},
-			{APIKey: protocol.HeartbeatKey},
-			{APIKey: protocol.LeaveGroupKey},
-			{APIKey: protocol.SyncGroupKey},
-			{APIKey: protocol.DescribeGroupsKey},
-			{APIKey: protocol.ListGroupsKey},
-			{APIKey: protocol.APIVersionsKey},
-			{APIKey: protocol.CreateTopicsKey},
-			{APIKey: protocol.DeleteTopicsKey},
-		},
-	}
+// APIVersions are the versions of the APIs the broker supports, from the
+// versions its requests declare.
+var APIVersions = protocol.APIVersionsOf(
+	&protocol.ProduceRequest{},
+	&protocol.FetchRequest{},
+	&protocol.OffsetsRequest{},
+	&protocol.MetadataRequest{},
+	&protocol.LeaderAndISRRequest{},
+	&protocol.APIVersionsRequest{},
+	&protocol.CreateTopicRequests{},
+	&protocol.DeleteTopicsRequest{},
+	&protocol.GroupCoordinatorRequest{},
+	&protocol.OffsetCommitRequest{},
+	&protocol.OffsetFetchRequest{},
 )
 
+// maxOffsetMetadataSize is the most metadata that can be committed with an
+// offset.
+const maxOffsetMetadataSize = 4096
+
 func (b *Broker) handleAPIVersions(header *protocol.RequestHeader, req *protocol.APIVersionsRequest) *protocol.APIVersionsResponse {
-	return APIVersions
+	return &protocol.APIVersionsResponse{
+		APIVersion:  req.APIVersion,
+		APIVersions: APIVersions,
+	}
+}
+
+// handleUnsupportedVersion responds to a request whose version isn't
+// supported. An ApiVersions request gets the supported versions in a version
+// 0 response so the client can pick one, others get just the error.
+func (b *Broker) handleUnsupportedVersion(header *protocol.RequestHeader, req protocol.Versioned) protocol.ResponseBody {
+	if _, ok := req.(*protocol.APIVersionsRequest); ok {
+		return &protocol.APIVersionsResponse{
+			ErrorCode:   protocol.ErrUnsupportedVersion.Code(),
+			APIVersions: APIVersions,
+		}
+	}
+	return &protocol.ErrorResponse{ErrorCode: protocol.ErrUnsupportedVersion.Code()}
 }
 
 func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, reqs *protocol.CreateTopicRequests) *protocol.CreateTopicsResponse {
-	resp := new(protocol.CreateTopicsResponse)
+	resp := &protocol.CreateTopicsResponse{APIVersion: reqs.APIVersion}
 	resp.TopicErrorCodes = make([]*protocol.TopicErrorCode, len(reqs.Requests))
 	isController := b.isController()
 	for i, req := range reqs.Requests {
@@ -201,6 +281,13 @@ func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, reqs *protoco
 			}
 			continue
 		}
+		if !validTopicName(req.Topic) {
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:     req.Topic,
+				ErrorCode: protocol.ErrInvalidTopicException.Code(),
+			}
+			continue
+		}
 		if req.ReplicationFactor > int16(len(b.LANMembers())) {
 			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
 				Topic:     req.Topic,
@@ -208,6 +295,20 @@ func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, reqs *protoco
 			}
 			continue
 		}
+		if err := validateTopicConfig(req.Configs); err != nil {
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:     req.Topic,
+				ErrorCode: protocol.ErrInvalidConfig.Code(),
+			}
+			continue
+		}
+		if reqs.ValidateOnly {
+			resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
+				Topic:     req.Topic,
+				ErrorCode: protocol.ErrNone.Code(),
+			}
+			continue
+		}
 		if b.config.DevMode {
 			partitions := b.buildPartitions(req.Topic, req.NumPartitions, req.ReplicationFactor)
 			err := protocol.ErrNone
@@ -224,7 +325,7 @@ func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, reqs *protoco
 			}
 			continue
 		}
-		err := b.createTopic(req.Topic, req.NumPartitions, req.ReplicationFactor)
+		err := b.createTopic(req.Topic, req.NumPartitions, req.ReplicationFactor, req.Configs)
 		resp.TopicErrorCodes[i] = &protocol.TopicErrorCode{
 			Topic:     req.Topic,
 			ErrorCode: err.Code(),
@@ -234,7 +335,7 @@ func (b *Broker) handleCreateTopic(header *protocol.RequestHeader, reqs *protoco
 }
 
 func (b *Broker) handleDeleteTopics(header *protocol.RequestHeader, reqs *protocol.DeleteTopicsRequest) *protocol.DeleteTopicsResponse {
-	resp := new(protocol.DeleteTopicsResponse)
+	resp := &protocol.DeleteTopicsResponse{APIVersion: reqs.APIVersion}
 	resp.TopicErrorCodes = make([]*protocol.TopicErrorCode, len(reqs.Topics))
 	isController := b.isController()
 	for i, topic := range reqs.Topics {
@@ -320,7 +421,7 @@ func (b *Broker) handleLeaderAndISR(header *protocol.RequestHeader, req *protoco
 }
 
 func (b *Broker) handleOffsets(header *protocol.RequestHeader, req *protocol.OffsetsRequest) *protocol.OffsetsResponse {
-	oResp := new(protocol.OffsetsResponse)
+	oResp := &protocol.OffsetsResponse{APIVersion: req.APIVersion}
 	oResp.Responses = make([]*protocol.OffsetResponse, len(req.Topics))
 	for i, t := range req.Topics {
 		oResp.Responses[i] = new(protocol.OffsetResponse)
@@ -335,13 +436,30 @@ func (b *Broker) handleOffsets(header *protocol.RequestHeader, req *protocol.Off
 				pResp.ErrorCode = protocol.ErrUnknown.Code()
 				continue
 			}
+			if b.isLogDirOffline(replica.LogDir) {
+				pResp.ErrorCode = protocol.ErrKafkaStorageError.Code()
+				oResp.Responses[i].PartitionResponses = append(oResp.Responses[i].PartitionResponses, pResp)
+				continue
+			}
 			var offset int64
-			if p.Timestamp == -2 {
+			timestamp := int64(-1)
+			switch p.Timestamp {
+			case -2:
 				offset = replica.Log.OldestOffset()
-			} else {
+			case -1:
 				offset = replica.Log.NewestOffset()
+			default:
+				offset, timestamp, err = replica.Log.OffsetForTime(p.Timestamp)
+				if err != nil {
+					pResp.ErrorCode = b.logErr(replica, err).Code()
+				}
+			}
+			if req.APIVersion == 0 {
+				pResp.Offsets = []int64{offset}
+			} else {
+				pResp.Timestamp = timestamp
+				pResp.Offset = offset
 			}
-			pResp.Offsets = []int64{offset}
 			oResp.Responses[i].PartitionResponses = append(oResp.Responses[i].PartitionResponses, pResp)
 		}
 	}
@@ -349,12 +467,14 @@ func (b *Broker) handleOffsets(header *protocol.RequestHeader, req *protocol.Off
 }
 
 func (b *Broker) handleProduce(header *protocol.RequestHeader, req *protocol.ProduceRequest) *protocol.ProduceResponses {
-	resp := new(protocol.ProduceResponses)
+	resp := &protocol.ProduceResponses{APIVersion: req.APIVersion}
 	resp.Responses = make([]*protocol.ProduceResponse, len(req.TopicData))
 	for i, td := range req.TopicData {
 		presps := make([]*protocol.ProducePartitionResponse, len(td.Data))
 		for j, p := range td.Data {
-			presp := &protocol.ProducePartitionResponse{}
+			// the topics' messages keep the timestamps they're produced
+			// with, so there's no log append time to respond with
+			presp := &protocol.ProducePartitionResponse{Timestamp: -1}
 			state := b.fsm.State()
 			_, t, err := state.GetTopic(td.Topic)
 			if err != nil {
@@ -375,16 +495,39 @@ func (b *Broker) handleProduce(header *protocol.RequestHeader, req *protocol.Pro
 				presps[j] = presp
 				continue
 			}
-			offset, appendErr := replica.Log.Append(p.RecordSet)
+			if b.isLogDirOffline(replica.LogDir) {
+				presp.Partition = p.Partition
+				presp.ErrorCode = protocol.ErrKafkaStorageError.Code()
+				presps[j] = presp
+				continue
+			}
+			if !hasMessageFormat(p.RecordSet, req.APIVersion) {
+				presp.Partition = p.Partition
+				presp.ErrorCode = protocol.ErrUnsupportedForMessageFormat.Code()
+				presps[j] = presp
+				continue
+			}
+			recordSet := p.RecordSet
+			if codec, ok, _ := compressionType(t.Config); ok {
+				var err error
+				if recordSet, err = recompress(recordSet, codec); err != nil {
+					b.logger.Error("recompress failed", log.Error("error", err))
+					presp.Partition = p.Partition
+					presp.ErrorCode = protocol.ErrCorruptMessage.WithErr(err).Code()
+					presps[j] = presp
+					continue
+				}
+			}
+			offset, appendErr := replica.Log.Append(recordSet)
 			if appendErr != nil {
-				b.logger.Error("commitlog/append failed", log.Error("error", err))
-				presp.ErrorCode = protocol.ErrUnknown.Code()
+				b.logger.Error("commitlog/append failed", log.Error("error", appendErr))
+				presp.Partition = p.Partition
+				presp.ErrorCode = b.logErr(replica, appendErr).Code()
 				presps[j] = presp
 				continue
 			}
 			presp.Partition = p.Partition
 			presp.BaseOffset = offset
-			presp.Timestamp = time.Now().Unix()
 			presps[j] = presp
 		}
 		resp.Responses[i] = &protocol.ProduceResponse{
@@ -450,7 +593,7 @@ func (b *Broker) handleMetadata(header *protocol.RequestHeader, req *protocol.Me
 			PartitionMetadata: partitionMetadata,
 		}
 	}
-	if len(req.Topics) == 0 {
+	if req.AllTopics() {
 		// Respond with metadata for all topics
 		// how to handle err here?
 		_, topics, _ := state.GetTopics()
@@ -472,17 +615,246 @@ func (b *Broker) handleMetadata(header *protocol.RequestHeader, req *protocol.Me
 		}
 	}
 	resp := &protocol.MetadataResponse{
+		APIVersion:    req.APIVersion,
 		Brokers:       brokers,
+		ControllerID:  b.controllerID(),
 		TopicMetadata: topicMetadata,
 	}
 	return resp
 }
 
+// handleGroupCoordinator responds with the controller, groups' offsets are
+// committed to and fetched from it.
+func (b *Broker) handleGroupCoordinator(header *protocol.RequestHeader, req *protocol.GroupCoordinatorRequest) *protocol.GroupCoordinatorResponse {
+	controller := b.controller()
+	if controller == nil {
+		return &protocol.GroupCoordinatorResponse{
+			ErrorCode:   protocol.ErrCoordinatorNotAvailable.Code(),
+			Coordinator: &protocol.Coordinator{NodeID: -1},
+		}
+	}
+	host, portStr, err := net.SplitHostPort(controller.BrokerAddr)
+	if err != nil {
+		return &protocol.GroupCoordinatorResponse{
+			ErrorCode:   protocol.ErrUnknown.Code(),
+			Coordinator: &protocol.Coordinator{NodeID: -1},
+		}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return &protocol.GroupCoordinatorResponse{
+			ErrorCode:   protocol.ErrUnknown.Code(),
+			Coordinator: &protocol.Coordinator{NodeID: -1},
+		}
+	}
+	return &protocol.GroupCoordinatorResponse{
+		ErrorCode: protocol.ErrNone.Code(),
+		Coordinator: &protocol.Coordinator{
+			NodeID: controller.ID,
+			Host:   host,
+			Port:   int32(port),
+		},
+	}
+}
+
+// handleOffsetCommit commits groups' offsets through raft, so they're kept
+// across restarts and controller changes until they expire. Groups aren't
+// managed by the broker, so their generations and members aren't checked.
+func (b *Broker) handleOffsetCommit(header *protocol.RequestHeader, req *protocol.OffsetCommitRequest) *protocol.OffsetCommitResponse {
+	resp := &protocol.OffsetCommitResponse{
+		APIVersion: req.APIVersion,
+		Responses:  make([]*protocol.OffsetCommitTopicResponse, len(req.Topics)),
+	}
+	groupErr := protocol.ErrNone
+	if !b.isController() {
+		groupErr = protocol.ErrNotCoordinator
+	} else if req.GroupID == "" {
+		groupErr = protocol.ErrInvalidGroupId
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	retention := int64(b.config.OffsetsRetention / time.Millisecond)
+	if req.APIVersion >= 2 && req.RetentionTime >= 0 {
+		retention = req.RetentionTime
+	}
+	state := b.fsm.State()
+	var offsets []structs.Offset
+	for i, t := range req.Topics {
+		tResp := &protocol.OffsetCommitTopicResponse{
+			Topic:      t.Topic,
+			Partitions: make([]*protocol.OffsetCommitPartitionResponse, len(t.Partitions)),
+		}
+		for j, p := range t.Partitions {
+			err := groupErr
+			if err == protocol.ErrNone {
+				err = b.validateOffsetCommit(state, t.Topic, p)
+			}
+			tResp.Partitions[j] = &protocol.OffsetCommitPartitionResponse{
+				Partition: p.Partition,
+				ErrorCode: err.Code(),
+			}
+			if err != protocol.ErrNone {
+				continue
+			}
+			offset := structs.Offset{
+				Group:           req.GroupID,
+				Topic:           t.Topic,
+				Partition:       p.Partition,
+				Offset:          p.Offset,
+				CommitTimestamp: now,
+			}
+			if p.Metadata != nil {
+				offset.Metadata = *p.Metadata
+			}
+			if req.APIVersion == 1 && p.Timestamp >= 0 {
+				offset.CommitTimestamp = p.Timestamp
+			}
+			offset.ExpireTimestamp = offset.CommitTimestamp + retention
+			offsets = append(offsets, offset)
+		}
+		resp.Responses[i] = tResp
+	}
+	if len(offsets) == 0 {
+		return resp
+	}
+	if err := b.commitOffsets(offsets); err != nil {
+		b.logger.Error("failed to commit offsets", log.String("group", req.GroupID), log.Error("error", err))
+		commitErr := protocol.ErrUnknown
+		if err == raft.ErrNotLeader || err == raft.ErrLeadershipLost {
+			commitErr = protocol.ErrNotCoordinator
+		}
+		for _, t := range resp.Responses {
+			for _, p := range t.Partitions {
+				if p.ErrorCode == protocol.ErrNone.Code() {
+					p.ErrorCode = commitErr.Code()
+				}
+			}
+		}
+	}
+	return resp
+}
+
+// validateOffsetCommit returns the error committing an offset for the
+// partition should get, if any.
+func (b *Broker) validateOffsetCommit(state *fsm.Store, topic string, p *protocol.OffsetCommitPartition) protocol.Error {
+	if p.Metadata != nil && len(*p.Metadata) > maxOffsetMetadataSize {
+		return protocol.ErrOffsetMetadataTooLarge
+	}
+	_, t, err := state.GetTopic(topic)
+	if err != nil {
+		return protocol.ErrUnknown.WithErr(err)
+	}
+	if t == nil {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	if _, ok := t.Partitions[p.Partition]; !ok {
+		return protocol.ErrUnknownTopicOrPartition
+	}
+	return protocol.ErrNone
+}
+
+// commitOffsets commits the offsets through raft.
+func (b *Broker) commitOffsets(offsets []structs.Offset) error {
+	resp, err := b.raftApply(structs.CommitOffsetsRequestType, structs.CommitOffsetsRequest{Offsets: offsets})
+	if err != nil {
+		return err
+	}
+	if err, ok := resp.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// handleOffsetFetch responds with groups' committed offsets, a partition the
+// group hasn't committed an offset for or whose offset's expired has an
+// offset of -1.
+func (b *Broker) handleOffsetFetch(header *protocol.RequestHeader, req *protocol.OffsetFetchRequest) *protocol.OffsetFetchResponse {
+	resp := &protocol.OffsetFetchResponse{APIVersion: req.APIVersion}
+	groupErr := protocol.ErrNone
+	if !b.isController() {
+		groupErr = protocol.ErrNotCoordinator
+	} else if req.GroupID == "" {
+		groupErr = protocol.ErrInvalidGroupId
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	state := b.fsm.State()
+	partitionResp := func(partition int32, offset *structs.Offset, err protocol.Error) *protocol.OffsetFetchPartitionResponse {
+		pResp := &protocol.OffsetFetchPartitionResponse{
+			Partition: partition,
+			Offset:    -1,
+			Metadata:  new(string),
+			ErrorCode: err.Code(),
+		}
+		if offset != nil && offset.ExpireTimestamp > now {
+			pResp.Offset = offset.Offset
+			*pResp.Metadata = offset.Metadata
+		}
+		return pResp
+	}
+	if req.AllTopics() {
+		resp.ErrorCode = groupErr.Code()
+		if groupErr != protocol.ErrNone {
+			return resp
+		}
+		_, offsets, err := state.GetGroupOffsets(req.GroupID)
+		if err != nil {
+			resp.ErrorCode = protocol.ErrUnknown.Code()
+			return resp
+		}
+		// the group's offsets are ordered by topic
+		var tResp *protocol.OffsetFetchTopicResponse
+		for _, offset := range offsets {
+			if offset.ExpireTimestamp <= now {
+				continue
+			}
+			if tResp == nil || tResp.Topic != offset.Topic {
+				tResp = &protocol.OffsetFetchTopicResponse{Topic: offset.Topic}
+				resp.Responses = append(resp.Responses, tResp)
+			}
+			tResp.Partitions = append(tResp.Partitions, partitionResp(offset.Partition, offset, protocol.ErrNone))
+		}
+		return resp
+	}
+	if req.APIVersion >= 2 {
+		resp.ErrorCode = groupErr.Code()
+	}
+	resp.Responses = make([]*protocol.OffsetFetchTopicResponse, len(req.Topics))
+	for i, t := range req.Topics {
+		tResp := &protocol.OffsetFetchTopicResponse{
+			Topic:      t.Topic,
+			Partitions: make([]*protocol.OffsetFetchPartitionResponse, len(t.Partitions)),
+		}
+		for j, partition := range t.Partitions {
+			if groupErr != protocol.ErrNone {
+				tResp.Partitions[j] = partitionResp(partition, nil, groupErr)
+				continue
+			}
+			_, offset, err := state.GetOffset(req.GroupID, t.Topic, partition)
+			if err != nil {
+				tResp.Partitions[j] = partitionResp(partition, nil, protocol.ErrUnknown.WithErr(err))
+				continue
+			}
+			tResp.Partitions[j] = partitionResp(partition, offset, protocol.ErrNone)
+		}
+		resp.Responses[i] = tResp
+	}
+	return resp
+}
+
+// fileRegionReader is implemented by log readers that can read their entries
+// as regions of the log's files.
+type fileRegionReader interface {
+	FileRegions() ([]protocol.FileRegion, error)
+}
+
 func (b *Broker) handleFetch(header *protocol.RequestHeader, r *protocol.FetchRequest) *protocol.FetchResponses {
 	fresp := &protocol.FetchResponses{
-		Responses: make([]*protocol.FetchResponse, len(r.Topics)),
+		APIVersion: r.APIVersion,
+		Responses:  make([]*protocol.FetchResponse, len(r.Topics)),
 	}
 	received := time.Now()
+	// from version 3 the request's max bytes is across all its partitions,
+	// total is how much of it's been used
+	var total int32
 	for i, topic := range r.Topics {
 		fr := &protocol.FetchResponse{
 			Topic:              topic.Topic,
@@ -504,41 +876,98 @@ func (b *Broker) handleFetch(header *protocol.RequestHeader, r *protocol.FetchRe
 				}
 				continue
 			}
-			rdr, rdrErr := replica.Log.NewReader(p.FetchOffset, p.MaxBytes)
+			if b.isLogDirOffline(replica.LogDir) {
+				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
+					Partition: p.Partition,
+					ErrorCode: protocol.ErrKafkaStorageError.Code(),
+				}
+				continue
+			}
+			maxBytes := p.MaxBytes
+			if r.APIVersion >= 3 && r.MaxBytes-total < maxBytes {
+				maxBytes = r.MaxBytes - total
+			}
+			rdr, rdrErr := replica.Log.NewReader(p.FetchOffset, maxBytes)
 			if rdrErr != nil {
 				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
 					Partition: p.Partition,
-					ErrorCode: protocol.ErrUnknown.Code(),
+					ErrorCode: b.logErr(replica, rdrErr).Code(),
 				}
 				continue
 			}
-			b := new(bytes.Buffer)
+			buf := new(bytes.Buffer)
+			var regions []protocol.FileRegion
 			var n int32
-			for n < r.MinBytes {
-				if r.MaxWaitTime != 0 && int32(time.Since(received).Nanoseconds()/1e6) > r.MaxWaitTime {
-					break
+			var readErr error
+			deadline := received.Add(time.Duration(r.MaxWaitTime) * time.Millisecond)
+			for {
+				newest := replica.Log.NewestOffset()
+				var nn int64
+				var err error
+				if rr, ok := rdr.(fileRegionReader); ok {
+					// the record set's sent from the segment files rather
+					// than copied into the response
+					var rs []protocol.FileRegion
+					rs, err = rr.FileRegions()
+					for _, region := range rs {
+						nn += region.Length
+					}
+					regions = append(regions, rs...)
+				} else {
+					// TODO: copy these bytes to outer bytes
+					nn, err = io.Copy(buf, rdr)
 				}
-				// TODO: copy these bytes to outer bytes
-				nn, err := io.Copy(b, rdr)
 				if err != nil && err != io.EOF {
-					fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
-						Partition: p.Partition,
-						ErrorCode: protocol.ErrUnknown.Code(),
-					}
+					readErr = err
 					break
 				}
 				n += int32(nn)
-				if err == io.EOF {
+				// wait for the rest of min bytes to be appended, until the
+				// request's max wait time
+				if n >= r.MinBytes || !waitAppended(replica.Log, newest, deadline) {
 					break
 				}
 			}
+			if readErr != nil {
+				fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
+					Partition: p.Partition,
+					ErrorCode: b.logErr(replica, readErr).Code(),
+				}
+				continue
+			}
+			// an entry bigger than max bytes is only returned if it's the
+			// first of the response, so the fetcher can make progress
+			if total > 0 && n > maxBytes {
+				buf.Reset()
+				regions = nil
+				n = 0
+			}
+			total += n
+			recordSet := buf.Bytes()
+			if r.APIVersion < 4 {
+				// the fetcher's too old to read record batches
+				if recordSet, regions, readErr = downConvert(recordSet, regions); readErr != nil {
+					b.logger.Error("down convert failed", log.Error("error", readErr))
+					fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
+						Partition: p.Partition,
+						ErrorCode: protocol.ErrUnsupportedForMessageFormat.WithErr(readErr).Code(),
+					}
+					continue
+				}
+			}
 
-			fr.PartitionResponses[j] = &protocol.FetchPartitionResponse{
-				Partition:     p.Partition,
-				ErrorCode:     protocol.ErrNone.Code(),
-				HighWatermark: replica.Log.NewestOffset(),
-				RecordSet:     b.Bytes(),
+			presp := &protocol.FetchPartitionResponse{
+				Partition:        p.Partition,
+				ErrorCode:        protocol.ErrNone.Code(),
+				HighWatermark:    replica.updateHighWatermark(r.ReplicaID, p.FetchOffset),
+				RecordSet:        recordSet,
+				RecordSetRegions: regions,
 			}
+			if r.APIVersion >= 4 {
+				// there aren't transactions, so everything's stable
+				presp.LastStableOffset = presp.HighWatermark
+			}
+			fr.PartitionResponses[j] = presp
 		}
 
 		fresp.Responses[i] = fr
@@ -546,6 +975,85 @@ func (b *Broker) handleFetch(header *protocol.RequestHeader, r *protocol.FetchRe
 	return fresp
 }
 
+// hasMessageFormat returns whether the record set's entries are in the message
+// format of the produce version, record batches from version 3 and legacy
+// messages before it.
+func hasMessageFormat(recordSet []byte, version int16) bool {
+	for _, ms := range commitlog.Entries(recordSet) {
+		isBatch := commitlog.Message(ms.Payload()).MagicByte() == protocol.RecordBatchMagic
+		if isBatch != (version >= 3) {
+			return false
+		}
+	}
+	return true
+}
+
+// downConvert converts the record batches in the record set to legacy
+// messages. The record set's regions are only copied out of the segment files
+// if they have a batch, otherwise they're returned as they are.
+func downConvert(b []byte, regions []protocol.FileRegion) ([]byte, []protocol.FileRegion, error) {
+	var batches bool
+	for _, region := range regions {
+		ok, err := regionHasBatch(region)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			batches = true
+			break
+		}
+	}
+	if batches {
+		buf := bytes.NewBuffer(b)
+		for _, region := range regions {
+			if _, err := io.Copy(buf, io.NewSectionReader(region.File, region.Offset, region.Length)); err != nil {
+				return nil, nil, err
+			}
+		}
+		b, regions = buf.Bytes(), nil
+	}
+	b, err := commitlog.DownConvert(b)
+	return b, regions, err
+}
+
+// regionHasBatch returns whether any of the region's entries is a record
+// batch, by reading the headers of its entries.
+func regionHasBatch(region protocol.FileRegion) (bool, error) {
+	// an entry's offset and size, and its payload up to the magic byte
+	header := make([]byte, 17)
+	for pos := int64(0); pos+int64(len(header)) <= region.Length; {
+		if _, err := region.File.ReadAt(header, region.Offset+pos); err != nil {
+			return false, err
+		}
+		ms := commitlog.MessageSet(header)
+		if commitlog.Message(ms.Payload()).MagicByte() == protocol.RecordBatchMagic {
+			return true, nil
+		}
+		if ms.Size() <= 0 {
+			break
+		}
+		pos += int64(ms.Size())
+	}
+	return false, nil
+}
+
+// waitAppended waits for the message at offset to be appended to the log,
+// returning false if it isn't by the deadline.
+func waitAppended(l jocko.CommitLog, offset int64, deadline time.Time) bool {
+	wait := deadline.Sub(time.Now())
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-l.Appended(offset):
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
 // isController returns true if this is the cluster controller.
 func (b *Broker) isController() bool {
 	return b.isLeader()
@@ -555,6 +1063,30 @@ func (b *Broker) isLeader() bool {
 	return b.raft.State() == raft.Leader
 }
 
+// controllerID returns the ID of the controller, the raft leader, or -1 if
+// there isn't one.
+func (b *Broker) controllerID() int32 {
+	if m := b.controller(); m != nil {
+		return m.ID
+	}
+	return -1
+}
+
+// controller returns the controller, the raft leader, or nil if there isn't
+// one.
+func (b *Broker) controller() *metadata.Broker {
+	leader := string(b.raft.Leader())
+	if leader == "" {
+		return nil
+	}
+	for _, mem := range b.LANMembers() {
+		if m, ok := metadata.IsBroker(mem); ok && m.RaftAddr == leader {
+			return m
+		}
+	}
+	return nil
+}
+
 // createPartition is used to add a partition across the cluster.
 func (b *Broker) createPartition(partition structs.Partition) error {
 	_, err := b.raftApply(structs.RegisterPartitionRequestType, structs.RegisterPartitionRequest{
@@ -586,22 +1118,109 @@ func (b *Broker) startReplica(replica *Replica) protocol.Error {
 		return protocol.ErrReplicaNotAvailable
 	}
 	if replica.Log == nil {
+		dir, err := b.logDir(replica.Partition.Topic, replica.Partition.ID)
+		if err == ErrLogDirOffline {
+			return protocol.ErrKafkaStorageError.WithErr(err)
+		} else if err == ErrInvalidTopicName {
+			return protocol.ErrInvalidTopicException.WithErr(err)
+		} else if err != nil {
+			return protocol.ErrUnknown.WithErr(err)
+		}
+		flushMessages, flushInterval, err := flushPolicy(topic.Config)
+		if err != nil {
+			return protocol.ErrInvalidConfig.WithErr(err)
+		}
+		maxLogBytes, maxLogAge, err := retention(topic.Config, b.config.LogRetentionBytes, b.config.LogRetentionAge)
+		if err != nil {
+			return protocol.ErrInvalidConfig.WithErr(err)
+		}
+		replica.LogDir = filepath.Dir(dir)
 		log, err := commitlog.New(commitlog.Options{
-			Path:            filepath.Join(b.config.DataDir, "data", fmt.Sprintf("%d", replica.Partition.ID)),
-			MaxSegmentBytes: 1024,
-			MaxLogBytes:     -1,
+			Path:            dir,
+			MaxSegmentBytes: b.config.LogSegmentBytes,
+			SegmentMaxAge:   b.config.LogSegmentAge,
+			Preallocate:     b.config.LogPreallocate,
+			MaxLogBytes:     maxLogBytes,
+			MaxLogAge:       maxLogAge,
+			FlushMessages:   flushMessages,
+			FlushInterval:   flushInterval,
+			Logger:          b.logger,
+			Metrics:         b.config.Metrics,
 		})
 		if err != nil {
-			return protocol.ErrUnknown.WithErr(err)
+			return b.logErr(replica, err)
 		}
 		replica.Log = log
+		// the high watermark isn't checkpointed, so the log's trusted as
+		// it was when it's reopened
+		replica.SetHighWatermark(log.NewestOffset())
 		// TODO: register leader-change listener on r.replica.Partition.id
 	}
 	return protocol.ErrNone
 }
 
+// loadReplicas registers the replicas the replicated state assigns to this
+// broker, reopening their logs, and has them lead or follow as the state
+// says. Otherwise the logs on disk wouldn't be served after a restart until a
+// controller sent a LeaderAndISR request.
+func (b *Broker) loadReplicas() {
+	// wait for the state to catch up with the raft log from before the
+	// restart
+	lastIndex := b.raft.LastIndex()
+	for b.raft.AppliedIndex() < lastIndex {
+		select {
+		case <-b.shutdownCh:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	_, partitions, err := b.fsm.State().GetPartitions()
+	if err != nil {
+		b.logger.Error("failed to get partitions", log.Error("error", err))
+		return
+	}
+	for _, p := range partitions {
+		if !contains(p.AR, b.config.ID) {
+			continue
+		}
+		// a controller's told us about it already
+		if _, err := b.replicaLookup.Replica(p.Topic, p.ID); err == nil {
+			continue
+		}
+		replica := &Replica{
+			BrokerID:  b.config.ID,
+			Partition: *p,
+			IsLocal:   true,
+		}
+		b.replicaLookup.AddReplica(replica)
+		if err := b.startReplica(replica); err != protocol.ErrNone {
+			b.logger.Error("failed to start replica", log.String("topic", p.Topic), log.Int32("partition", p.ID), log.Error("error", err))
+			continue
+		}
+		state := &protocol.PartitionState{
+			Topic:           p.Topic,
+			Partition:       p.ID,
+			ControllerEpoch: p.ControllerEpoch,
+			Leader:          p.Leader,
+			ISR:             p.ISR,
+			Replicas:        p.AR,
+			ZKVersion:       p.ControllerEpoch,
+			LeaderEpoch:     p.LeaderEpoch,
+		}
+		var perr protocol.Error
+		if p.Leader == b.config.ID {
+			perr = b.becomeLeader(replica, state)
+		} else {
+			perr = b.becomeFollower(replica, state)
+		}
+		if perr != protocol.ErrNone {
+			b.logger.Error("failed to resume replica", log.String("topic", p.Topic), log.Int32("partition", p.ID), log.Error("error", perr))
+		}
+	}
+}
+
 // createTopic is used to create the topic across the cluster.
-func (b *Broker) createTopic(topic string, partitions int32, replicationFactor int16) protocol.Error {
+func (b *Broker) createTopic(topic string, partitions int32, replicationFactor int16, config map[string]string) protocol.Error {
 	state := b.fsm.State()
 	_, t, _ := state.GetTopic(topic)
 	if t != nil {
@@ -611,6 +1230,7 @@ func (b *Broker) createTopic(topic string, partitions int32, replicationFactor i
 	tt := structs.Topic{
 		Topic:      topic,
 		Partitions: make(map[int32][]int32),
+		Config:     config,
 	}
 	for _, partition := range ps {
 		tt.Partitions[partition.ID] = partition.AR
@@ -754,6 +1374,18 @@ func (b *Broker) Shutdown() error {
 		b.serf.Shutdown()
 	}
 
+	// close the replicas' logs so they're reopened without recovering them
+	for _, replica := range b.replicaLookup.Replicas() {
+		if replica.Replicator != nil {
+			replica.Replicator.Close()
+		}
+		if replica.Log != nil {
+			if err := replica.Log.Close(); err != nil {
+				b.logger.Error("failed to close log", log.Error("error", err))
+			}
+		}
+	}
+
 	if b.raft != nil {
 		b.raftTransport.Close()
 		future := b.raft.Shutdown()
@@ -765,6 +1397,8 @@ func (b *Broker) Shutdown() error {
 		}
 	}
 
+	b.unlockDirs()
+
 	return nil
 }
 
@@ -779,12 +1413,20 @@ func (b *Broker) becomeFollower(replica *Replica, cmd *protocol.PartitionState)
 			return protocol.ErrUnknown.WithErr(err)
 		}
 	}
-	hw := replica.Log.NewestOffset()
-	if err := replica.Log.Truncate(hw); err != nil {
-		return protocol.ErrUnknown.WithErr(err)
+	// the entries past the high watermark may not have been replicated, the
+	// new leader may not have them
+	if err := replica.Log.TruncateTo(replica.HighWatermark()); err != nil {
+		return b.logErr(replica, err)
 	}
 	conn := b.brokerLookup.BrokerByID(raft.ServerID(cmd.Leader))
-	r := NewReplicator(ReplicatorConfig{}, replica, server.NewClient(conn), b.logger)
+	if conn == nil {
+		return protocol.ErrBrokerNotAvailable
+	}
+	r := NewReplicator(ReplicatorConfig{
+		FetchMaxBytes: b.config.ReplicaFetchMaxBytes,
+		// the replica goes offline along with its log dir
+		OnAppendError: func(err error) { b.logErr(replica, err) },
+	}, replica, server.NewClient(conn), b.logger)
 	replica.Replicator = r
 	if !b.config.DevMode {
 		r.Replicate()
@@ -805,6 +1447,7 @@ func (b *Broker) becomeLeader(replica *Replica, cmd *protocol.PartitionState) pr
 	replica.Partition.AR = cmd.Replicas
 	replica.Partition.ISR = cmd.ISR
 	replica.Partition.LeaderEpoch = cmd.ZKVersion
+	replica.resetFollowers()
 	return protocol.ErrNone
 }
 
@@ -861,11 +1504,70 @@ func (s *Broker) LANMembers() []serf.Member {
 
 // Replica
 type Replica struct {
-	BrokerID   int32
-	Partition  structs.Partition
-	IsLocal    bool
-	Log        jocko.CommitLog
+	BrokerID  int32
+	Partition structs.Partition
+	IsLocal   bool
+	// LogDir is the log dir the replica's log is stored on.
+	LogDir string
+	Log    jocko.CommitLog
+	// Hw is the high watermark, the offset the log's replicated up to by
+	// the ISR. It's read and set atomically.
 	Hw         int64
 	Leo        int64
 	Replicator *Replicator
+
+	// followerOffsets are the offsets the followers have fetched from, the
+	// ends of their logs, while the replica leads.
+	followerOffsets map[int32]int64
+	followersLock   sync.Mutex
+}
+
+// HighWatermark returns the replica's high watermark.
+func (r *Replica) HighWatermark() int64 {
+	return atomic.LoadInt64(&r.Hw)
+}
+
+// SetHighWatermark sets the replica's high watermark.
+func (r *Replica) SetHighWatermark(hw int64) {
+	atomic.StoreInt64(&r.Hw, hw)
+}
+
+// updateHighWatermark records the offset the follower fetched from, if the
+// fetch is a follower's, and moves the leader's high watermark up to the
+// lowest offset the ISR's replicated. It returns the high watermark.
+func (r *Replica) updateHighWatermark(follower int32, offset int64) int64 {
+	r.followersLock.Lock()
+	defer r.followersLock.Unlock()
+	if follower >= 0 && follower != r.BrokerID {
+		if r.followerOffsets == nil {
+			r.followerOffsets = make(map[int32]int64)
+		}
+		r.followerOffsets[follower] = offset
+	}
+	hw := r.Log.NewestOffset()
+	for _, id := range r.Partition.ISR {
+		if id == r.BrokerID {
+			continue
+		}
+		offset, ok := r.followerOffsets[id]
+		if !ok {
+			// the follower's position isn't known yet
+			return r.HighWatermark()
+		}
+		if offset < hw {
+			hw = offset
+		}
+	}
+	if hw > r.HighWatermark() {
+		r.SetHighWatermark(hw)
+	}
+	return r.HighWatermark()
+}
+
+// resetFollowers forgets the followers' offsets, as when the replica becomes
+// leader.
+func (r *Replica) resetFollowers() {
+	r.followersLock.Lock()
+	defer r.followersLock.Unlock()
+	r.followerOffsets = nil
 }
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/hashicorp/consul/testutil/retry"
@@ -14,8 +16,11 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/broker/config"
 	"github.com/travisjeffery/jocko/broker/structs"
+	"github.com/travisjeffery/jocko/commitlog"
 	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/mock"
 	"github.com/travisjeffery/jocko/protocol"
 	"github.com/travisjeffery/jocko/testutil"
 )
@@ -56,7 +61,41 @@ func TestBroker_Run(t *testing.T) {
 				}},
 				responses: []jocko.Response{{
 					Header:   &protocol.RequestHeader{CorrelationID: 1},
-					Response: &protocol.Response{CorrelationID: 1, Body: APIVersions},
+					Response: &protocol.Response{CorrelationID: 1, Body: &protocol.APIVersionsResponse{APIVersions: APIVersions}},
+				}},
+			},
+		},
+		{
+			name: "unsupported versions",
+			args: args{
+				requestCh:  make(chan jocko.Request, 3),
+				responseCh: make(chan jocko.Response, 3),
+				requests: []jocko.Request{{
+					Header:  &protocol.RequestHeader{CorrelationID: 1, APIVersion: 99},
+					Request: &protocol.APIVersionsRequest{APIVersion: 99},
+				}, {
+					Header:  &protocol.RequestHeader{CorrelationID: 2, APIVersion: 99},
+					Request: &protocol.ProduceRequest{APIVersion: 99},
+				}, {
+					// the server passes no request for an unknown API key
+					Header: &protocol.RequestHeader{CorrelationID: 3, APIKey: 99},
+				}},
+				responses: []jocko.Response{{
+					Header: &protocol.RequestHeader{CorrelationID: 1, APIVersion: 99},
+					Response: &protocol.Response{CorrelationID: 1, Body: &protocol.APIVersionsResponse{
+						ErrorCode:   protocol.ErrUnsupportedVersion.Code(),
+						APIVersions: APIVersions,
+					}},
+				}, {
+					Header: &protocol.RequestHeader{CorrelationID: 2, APIVersion: 99},
+					Response: &protocol.Response{CorrelationID: 2, Body: &protocol.ErrorResponse{
+						ErrorCode: protocol.ErrUnsupportedVersion.Code(),
+					}},
+				}, {
+					Header: &protocol.RequestHeader{CorrelationID: 3, APIKey: 99},
+					Response: &protocol.Response{CorrelationID: 3, Body: &protocol.ErrorResponse{
+						ErrorCode: protocol.ErrUnsupportedVersion.Code(),
+					}},
 				}},
 			},
 		},
@@ -102,6 +141,27 @@ func TestBroker_Run(t *testing.T) {
 				}},
 			},
 		},
+		{
+			name: "create topic invalid name error",
+			args: args{
+				requestCh:  make(chan jocko.Request, 2),
+				responseCh: make(chan jocko.Response, 2),
+				requests: []jocko.Request{{
+					Header: &protocol.RequestHeader{CorrelationID: 1},
+					Request: &protocol.CreateTopicRequests{Requests: []*protocol.CreateTopicRequest{{
+						Topic:             "../../the-topic",
+						NumPartitions:     1,
+						ReplicationFactor: 1,
+					}}}},
+				},
+				responses: []jocko.Response{{
+					Header: &protocol.RequestHeader{CorrelationID: 1},
+					Response: &protocol.Response{CorrelationID: 1, Body: &protocol.CreateTopicsResponse{
+						TopicErrorCodes: []*protocol.TopicErrorCode{{Topic: "../../the-topic", ErrorCode: protocol.ErrInvalidTopicException.Code()}},
+					}},
+				}},
+			},
+		},
 		{
 			name: "delete topic",
 			args: args{
@@ -171,7 +231,7 @@ func TestBroker_Run(t *testing.T) {
 						Response: &protocol.Response{CorrelationID: 2, Body: &protocol.ProduceResponses{
 							Responses: []*protocol.ProduceResponse{{
 								Topic:              "the-topic",
-								PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 0, ErrorCode: protocol.ErrNone.Code()}},
+								PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 0, ErrorCode: protocol.ErrNone.Code(), Timestamp: -1}},
 							}},
 						}},
 					},
@@ -195,13 +255,118 @@ func TestBroker_Run(t *testing.T) {
 					},
 				},
 			},
-			handle: func(t *testing.T, _ *Broker, req jocko.Request, res jocko.Response) {
-				switch res := res.Response.(*protocol.Response).Body.(type) {
-				// handle timestamp explicitly since we don't know what
-				// it'll be set to
-				case *protocol.ProduceResponses:
-					handleProduceResponse(t, res)
-				}
+		},
+		{
+			name: "offsets for time",
+			args: args{
+				requestCh:  make(chan jocko.Request, 2),
+				responseCh: make(chan jocko.Response, 2),
+				requests: []jocko.Request{
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 1},
+						Request: &protocol.CreateTopicRequests{Requests: []*protocol.CreateTopicRequest{{
+							Topic:             "the-topic",
+							NumPartitions:     1,
+							ReplicationFactor: 1,
+						}}},
+					},
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 2},
+						Request: &protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+							Topic: "the-topic",
+							Data: []*protocol.Data{{
+								RecordSet: mustEncode(&protocol.MessageSet{Offset: 0, Messages: []*protocol.Message{{MagicByte: 1, Timestamp: time.Unix(1000, 0), Value: []byte("The message.")}}})}}}}},
+					},
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 3},
+						Request: &protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+							Topic: "the-topic",
+							Data: []*protocol.Data{{
+								RecordSet: mustEncode(&protocol.MessageSet{Offset: 0, Messages: []*protocol.Message{{MagicByte: 1, Timestamp: time.Unix(2000, 0), Value: []byte("The message.")}}})}}}}},
+					},
+					{
+						Header:  &protocol.RequestHeader{CorrelationID: 4},
+						Request: &protocol.OffsetsRequest{ReplicaID: 0, Topics: []*protocol.OffsetsTopic{{Topic: "the-topic", Partitions: []*protocol.OffsetsPartition{{Partition: 0, Timestamp: 1500000}}}}},
+					},
+					{
+						Header:  &protocol.RequestHeader{CorrelationID: 5},
+						Request: &protocol.OffsetsRequest{ReplicaID: 0, Topics: []*protocol.OffsetsTopic{{Topic: "the-topic", Partitions: []*protocol.OffsetsPartition{{Partition: 0, Timestamp: 3000000}}}}},
+					},
+					{
+						Header:  &protocol.RequestHeader{CorrelationID: 6},
+						Request: &protocol.OffsetsRequest{APIVersion: 1, ReplicaID: 0, Topics: []*protocol.OffsetsTopic{{Topic: "the-topic", Partitions: []*protocol.OffsetsPartition{{Partition: 0, Timestamp: 1500000}}}}},
+					},
+					{
+						Header:  &protocol.RequestHeader{CorrelationID: 7},
+						Request: &protocol.OffsetsRequest{APIVersion: 1, ReplicaID: 0, Topics: []*protocol.OffsetsTopic{{Topic: "the-topic", Partitions: []*protocol.OffsetsPartition{{Partition: 0, Timestamp: 3000000}}}}},
+					},
+				},
+				responses: []jocko.Response{
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 1},
+						Response: &protocol.Response{CorrelationID: 1, Body: &protocol.CreateTopicsResponse{
+							TopicErrorCodes: []*protocol.TopicErrorCode{{Topic: "the-topic", ErrorCode: protocol.ErrNone.Code()}},
+						}},
+					},
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 2},
+						Response: &protocol.Response{CorrelationID: 2, Body: &protocol.ProduceResponses{
+							Responses: []*protocol.ProduceResponse{{
+								Topic:              "the-topic",
+								PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 0, ErrorCode: protocol.ErrNone.Code(), Timestamp: -1}},
+							}},
+						}},
+					},
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 3},
+						Response: &protocol.Response{CorrelationID: 3, Body: &protocol.ProduceResponses{
+							Responses: []*protocol.ProduceResponse{{
+								Topic:              "the-topic",
+								PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 1, ErrorCode: protocol.ErrNone.Code(), Timestamp: -1}},
+							}},
+						}},
+					},
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 4},
+						Response: &protocol.Response{CorrelationID: 4, Body: &protocol.OffsetsResponse{
+							Responses: []*protocol.OffsetResponse{{
+								Topic:              "the-topic",
+								PartitionResponses: []*protocol.PartitionResponse{{Partition: 0, Offsets: []int64{1}, ErrorCode: protocol.ErrNone.Code()}},
+							}},
+						}},
+					},
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 5},
+						Response: &protocol.Response{CorrelationID: 5, Body: &protocol.OffsetsResponse{
+							Responses: []*protocol.OffsetResponse{{
+								Topic:              "the-topic",
+								PartitionResponses: []*protocol.PartitionResponse{{Partition: 0, Offsets: []int64{2}, ErrorCode: protocol.ErrNone.Code()}},
+							}},
+						}},
+					},
+					// from version 1 the found message's timestamp is
+					// returned with its offset
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 6},
+						Response: &protocol.Response{CorrelationID: 6, Body: &protocol.OffsetsResponse{
+							APIVersion: 1,
+							Responses: []*protocol.OffsetResponse{{
+								Topic:              "the-topic",
+								PartitionResponses: []*protocol.PartitionResponse{{Partition: 0, Offset: 1, Timestamp: 2000000, ErrorCode: protocol.ErrNone.Code()}},
+							}},
+						}},
+					},
+					{
+						Header: &protocol.RequestHeader{CorrelationID: 7},
+						Response: &protocol.Response{CorrelationID: 7, Body: &protocol.OffsetsResponse{
+							APIVersion: 1,
+							Responses: []*protocol.OffsetResponse{{
+								Topic:              "the-topic",
+								PartitionResponses: []*protocol.PartitionResponse{{Partition: 0, Offset: 2, Timestamp: -1, ErrorCode: protocol.ErrNone.Code()}},
+							}},
+						}},
+					},
+				},
 			},
 		},
 		{
@@ -243,7 +408,7 @@ func TestBroker_Run(t *testing.T) {
 							Responses: []*protocol.ProduceResponse{
 								{
 									Topic:              "the-topic",
-									PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 0, ErrorCode: protocol.ErrNone.Code()}},
+									PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 0, ErrorCode: protocol.ErrNone.Code(), Timestamp: -1}},
 								},
 							},
 						}},
@@ -266,10 +431,10 @@ func TestBroker_Run(t *testing.T) {
 			},
 			handle: func(t *testing.T, _ *Broker, req jocko.Request, res jocko.Response) {
 				switch res := res.Response.(*protocol.Response).Body.(type) {
-				// handle timestamp explicitly since we don't know what
-				// it'll be set to
-				case *protocol.ProduceResponses:
-					handleProduceResponse(t, res)
+				// the record set refers to the log's files, read it
+				// to compare it
+				case *protocol.FetchResponses:
+					handleFetchResponse(t, res)
 				}
 			},
 		},
@@ -312,7 +477,7 @@ func TestBroker_Run(t *testing.T) {
 							Responses: []*protocol.ProduceResponse{
 								{
 									Topic:              "the-topic",
-									PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 0, ErrorCode: protocol.ErrNone.Code()}},
+									PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, BaseOffset: 0, ErrorCode: protocol.ErrNone.Code(), Timestamp: -1}},
 								},
 							},
 						}},
@@ -320,7 +485,8 @@ func TestBroker_Run(t *testing.T) {
 					{
 						Header: &protocol.RequestHeader{CorrelationID: 3},
 						Response: &protocol.Response{CorrelationID: 3, Body: &protocol.MetadataResponse{
-							Brokers: []*protocol.Broker{{NodeID: 1, Host: "localhost", Port: 9092}},
+							Brokers:      []*protocol.Broker{{NodeID: 1, Host: "localhost", Port: 9092}},
+							ControllerID: 1,
 							TopicMetadata: []*protocol.TopicMetadata{
 								{Topic: "the-topic", TopicErrorCode: protocol.ErrNone.Code(), PartitionMetadata: []*protocol.PartitionMetadata{{PartitionErrorCode: protocol.ErrNone.Code(), ParititionID: 0, Leader: 1, Replicas: []int32{1}, ISR: []int32{1}}}},
 								{Topic: "unknown-topic", TopicErrorCode: protocol.ErrUnknownTopicOrPartition.Code()},
@@ -329,14 +495,6 @@ func TestBroker_Run(t *testing.T) {
 					},
 				},
 			},
-			handle: func(t *testing.T, _ *Broker, req jocko.Request, res jocko.Response) {
-				switch res := res.Response.(*protocol.Response).Body.(type) {
-				// handle timestamp explicitly since we don't know what
-				// it'll be set to
-				case *protocol.ProduceResponses:
-					handleProduceResponse(t, res)
-				}
-			},
 		},
 		{
 			name: "produce topic/partition doesn't exist error",
@@ -355,18 +513,10 @@ func TestBroker_Run(t *testing.T) {
 					Response: &protocol.Response{CorrelationID: 2, Body: &protocol.ProduceResponses{
 						Responses: []*protocol.ProduceResponse{{
 							Topic:              "another-topic",
-							PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, ErrorCode: protocol.ErrUnknownTopicOrPartition.Code()}},
+							PartitionResponses: []*protocol.ProducePartitionResponse{{Partition: 0, ErrorCode: protocol.ErrUnknownTopicOrPartition.Code(), Timestamp: -1}},
 						}},
 					}}}},
 			},
-			handle: func(t *testing.T, _ *Broker, req jocko.Request, res jocko.Response) {
-				switch res := res.Response.(*protocol.Response).Body.(type) {
-				// handle timestamp explicitly since we don't know what
-				// it'll be set to
-				case *protocol.ProduceResponses:
-					handleProduceResponse(t, res)
-				}
-			},
 		},
 	}
 	for _, tt := range tests {
@@ -435,6 +585,69 @@ func spewstr(v interface{}) string {
 	return buf.String()
 }
 
+// newTestBroker starts a broker that's the controller of a one broker cluster
+// and returns it with its data dir. setup, if set, changes the broker's config
+// before it's started.
+func newTestBroker(t *testing.T, setup func(*config.Config)) (*Broker, string) {
+	dir, conf := testutil.TestConfig(t)
+	conf.BootstrapExpect = 1
+	conf.StartAsLeader = true
+	if setup != nil {
+		setup(conf)
+	}
+	b, err := New(conf, log.New())
+	require.NoError(t, err)
+	retry.Run(t, func(r *retry.R) {
+		if !b.isController() || len(b.brokerLookup.Brokers()) != 1 {
+			r.Fatal("not ready")
+		}
+	})
+	return b, dir
+}
+
+// restartTestBroker shuts the broker down and starts another with its ID,
+// data dir and raft address.
+func restartTestBroker(t *testing.T, b *Broker) *Broker {
+	require.NoError(t, b.Shutdown())
+	_, conf := testutil.TestConfig(t)
+	conf.ID = b.config.ID
+	conf.DataDir = b.config.DataDir
+	conf.RaftAddr = b.config.RaftAddr
+	b, err := New(conf, log.New())
+	require.NoError(t, err)
+	return b
+}
+
+// createTopics creates the topics and returns their error codes, after
+// waiting for the broker to have a replica of each that was created.
+func createTopics(t *testing.T, b *Broker, topics ...*protocol.CreateTopicRequest) []int16 {
+	resp := b.handleCreateTopic(nil, &protocol.CreateTopicRequests{Requests: topics})
+	var codes []int16
+	for _, tc := range resp.TopicErrorCodes {
+		codes = append(codes, tc.ErrorCode)
+		if tc.ErrorCode != protocol.ErrNone.Code() {
+			continue
+		}
+		retry.Run(t, func(r *retry.R) {
+			if _, err := b.replicaLookup.Replica(tc.Topic, 0); err != nil {
+				r.Fatal(err)
+			}
+		})
+	}
+	return codes
+}
+
+// createTopic creates topics with one partition and one replica.
+func createTopic(t *testing.T, b *Broker, topics ...string) {
+	var reqs []*protocol.CreateTopicRequest
+	for _, topic := range topics {
+		reqs = append(reqs, &protocol.CreateTopicRequest{Topic: topic, NumPartitions: 1, ReplicationFactor: 1})
+	}
+	for i, code := range createTopics(t, b, reqs...) {
+		require.Equal(t, protocol.ErrNone.Code(), code, topics[i])
+	}
+}
+
 func TestBroker_Shutdown(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -465,6 +678,523 @@ func TestBroker_Shutdown(t *testing.T) {
 	}
 }
 
+func TestBroker_ReloadReplicas(t *testing.T) {
+	b, dir := newTestBroker(t, nil)
+	defer os.RemoveAll(dir)
+	createTopic(t, b, "the-topic")
+	recordSet, err := protocol.Encode(&protocol.MessageSet{Offset: 0, Messages: []*protocol.Message{{Value: []byte("The message.")}}})
+	require.NoError(t, err)
+	presp := b.handleProduce(nil, &protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+		Topic: "the-topic",
+		Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+	}}})
+	require.Equal(t, protocol.ErrNone.Code(), presp.Responses[0].PartitionResponses[0].ErrorCode)
+	// a message that fails its CRC check isn't appended
+	corrupt := append([]byte(nil), recordSet...)
+	corrupt[len(corrupt)-1]++
+	presp = b.handleProduce(nil, &protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+		Topic: "the-topic",
+		Data:  []*protocol.Data{{Partition: 0, RecordSet: corrupt}},
+	}}})
+	require.Equal(t, protocol.ErrCorruptMessage.Code(), presp.Responses[0].PartitionResponses[0].ErrorCode)
+
+	// the restarted broker serves the partition without being told to by a
+	// controller
+	b = restartTestBroker(t, b)
+	defer b.Shutdown()
+	retry.Run(t, func(r *retry.R) {
+		if _, err := b.replicaLookup.Replica("the-topic", 0); err != nil {
+			r.Fatal(err)
+		}
+	})
+	fresp := b.handleFetch(nil, &protocol.FetchRequest{MinBytes: 1, Topics: []*protocol.FetchTopic{{
+		Topic:      "the-topic",
+		Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 100}},
+	}}})
+	pr := fresp.Responses[0].PartitionResponses[0]
+	require.Equal(t, protocol.ErrNone.Code(), pr.ErrorCode)
+	require.Equal(t, int64(1), pr.HighWatermark)
+	handleFetchResponse(t, fresp)
+	require.Equal(t, recordSet, pr.RecordSet)
+}
+
+func TestBroker_Offsets(t *testing.T) {
+	b, dir := newTestBroker(t, nil)
+	defer os.RemoveAll(dir)
+
+	// the controller's the coordinator
+	gresp := b.handleGroupCoordinator(nil, &protocol.GroupCoordinatorRequest{GroupID: "the-group"})
+	require.Equal(t, &protocol.GroupCoordinatorResponse{
+		ErrorCode:   protocol.ErrNone.Code(),
+		Coordinator: &protocol.Coordinator{NodeID: b.config.ID, Host: "localhost", Port: 9092},
+	}, gresp)
+
+	codes := createTopics(t, b, &protocol.CreateTopicRequest{
+		Topic:             "the-topic",
+		NumPartitions:     2,
+		ReplicationFactor: 1,
+	})
+	require.Equal(t, []int16{protocol.ErrNone.Code()}, codes)
+
+	metadata := "the-metadata"
+	tooLarge := strings.Repeat("m", maxOffsetMetadataSize+1)
+	cresp := b.handleOffsetCommit(nil, &protocol.OffsetCommitRequest{
+		APIVersion:    2,
+		GroupID:       "the-group",
+		RetentionTime: -1,
+		Topics: []*protocol.OffsetCommitTopic{{
+			Topic: "the-topic",
+			Partitions: []*protocol.OffsetCommitPartition{
+				{Partition: 0, Offset: 5, Timestamp: -1, Metadata: &metadata},
+				{Partition: 1, Offset: 8, Timestamp: -1, Metadata: &tooLarge},
+				{Partition: 2, Offset: 3, Timestamp: -1},
+			},
+		}, {
+			Topic:      "unknown-topic",
+			Partitions: []*protocol.OffsetCommitPartition{{Partition: 0, Offset: 1, Timestamp: -1}},
+		}},
+	})
+	require.Equal(t, &protocol.OffsetCommitResponse{
+		APIVersion: 2,
+		Responses: []*protocol.OffsetCommitTopicResponse{{
+			Topic: "the-topic",
+			Partitions: []*protocol.OffsetCommitPartitionResponse{
+				{Partition: 0, ErrorCode: protocol.ErrNone.Code()},
+				{Partition: 1, ErrorCode: protocol.ErrOffsetMetadataTooLarge.Code()},
+				{Partition: 2, ErrorCode: protocol.ErrUnknownTopicOrPartition.Code()},
+			},
+		}, {
+			Topic:      "unknown-topic",
+			Partitions: []*protocol.OffsetCommitPartitionResponse{{Partition: 0, ErrorCode: protocol.ErrUnknownTopicOrPartition.Code()}},
+		}},
+	}, cresp)
+
+	// an offset that's expired isn't fetched and is deleted by the
+	// controller
+	cresp = b.handleOffsetCommit(nil, &protocol.OffsetCommitRequest{
+		APIVersion:    2,
+		GroupID:       "another-group",
+		RetentionTime: 0,
+		Topics: []*protocol.OffsetCommitTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.OffsetCommitPartition{{Partition: 0, Offset: 2, Timestamp: -1}},
+		}},
+	})
+	require.Equal(t, protocol.ErrNone.Code(), cresp.Responses[0].Partitions[0].ErrorCode)
+	fresp := b.handleOffsetFetch(nil, &protocol.OffsetFetchRequest{APIVersion: 2, GroupID: "another-group"})
+	require.Empty(t, fresp.Responses)
+	b.expireOffsets()
+	_, offsets, err := b.fsm.State().GetGroupOffsets("another-group")
+	require.NoError(t, err)
+	require.Empty(t, offsets)
+
+	// the offsets are kept across restarts, from the snapshot and the log
+	// after it
+	require.NoError(t, b.raft.Snapshot().Error())
+	cresp = b.handleOffsetCommit(nil, &protocol.OffsetCommitRequest{
+		GroupID: "the-group",
+		Topics: []*protocol.OffsetCommitTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.OffsetCommitPartition{{Partition: 1, Offset: 8, Timestamp: -1}},
+		}},
+	})
+	require.Equal(t, protocol.ErrNone.Code(), cresp.Responses[0].Partitions[0].ErrorCode)
+
+	b = restartTestBroker(t, b)
+	defer b.Shutdown()
+	// the raft log's replayed once the broker's established its leadership
+	retry.Run(t, func(r *retry.R) {
+		if !b.isReadyForConsistentReads() {
+			r.Fatal("not ready")
+		}
+	})
+
+	empty := ""
+	fresp = b.handleOffsetFetch(nil, &protocol.OffsetFetchRequest{
+		APIVersion: 1,
+		GroupID:    "the-group",
+		Topics:     []*protocol.OffsetFetchTopic{{Topic: "the-topic", Partitions: []int32{0, 1, 2}}},
+	})
+	require.Equal(t, &protocol.OffsetFetchResponse{
+		APIVersion: 1,
+		Responses: []*protocol.OffsetFetchTopicResponse{{
+			Topic: "the-topic",
+			Partitions: []*protocol.OffsetFetchPartitionResponse{
+				{Partition: 0, Offset: 5, Metadata: &metadata, ErrorCode: protocol.ErrNone.Code()},
+				{Partition: 1, Offset: 8, Metadata: &empty, ErrorCode: protocol.ErrNone.Code()},
+				{Partition: 2, Offset: -1, Metadata: &empty, ErrorCode: protocol.ErrNone.Code()},
+			},
+		}},
+	}, fresp)
+
+	fresp = b.handleOffsetFetch(nil, &protocol.OffsetFetchRequest{APIVersion: 2, GroupID: "the-group"})
+	require.Equal(t, &protocol.OffsetFetchResponse{
+		APIVersion: 2,
+		Responses: []*protocol.OffsetFetchTopicResponse{{
+			Topic: "the-topic",
+			Partitions: []*protocol.OffsetFetchPartitionResponse{
+				{Partition: 0, Offset: 5, Metadata: &metadata, ErrorCode: protocol.ErrNone.Code()},
+				{Partition: 1, Offset: 8, Metadata: &empty, ErrorCode: protocol.ErrNone.Code()},
+			},
+		}},
+		ErrorCode: protocol.ErrNone.Code(),
+	}, fresp)
+}
+
+func TestBroker_BecomeFollowerTruncates(t *testing.T) {
+	b, dir := newTestBroker(t, nil)
+	defer os.RemoveAll(dir)
+	defer b.Shutdown()
+	createTopic(t, b, "the-topic")
+	replica, err := b.replicaLookup.Replica("the-topic", 0)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		recordSet, err := protocol.Encode(&protocol.MessageSet{Messages: []*protocol.Message{{Value: []byte("The message.")}}})
+		require.NoError(t, err)
+		presp := b.handleProduce(nil, &protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+			Topic: "the-topic",
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+		}}})
+		require.Equal(t, protocol.ErrNone.Code(), presp.Responses[0].PartitionResponses[0].ErrorCode)
+	}
+	require.Equal(t, int64(4), replica.Log.NewestOffset())
+
+	// the last two entries weren't replicated when the replica follows
+	replica.SetHighWatermark(2)
+	require.Equal(t, protocol.ErrNone, b.becomeFollower(replica, &protocol.PartitionState{
+		Topic:    "the-topic",
+		Leader:   b.config.ID,
+		ISR:      []int32{b.config.ID},
+		Replicas: []int32{b.config.ID},
+	}))
+	// there's no other broker to follow
+	require.NoError(t, replica.Replicator.Close())
+	replica.Replicator = nil
+	require.Equal(t, int64(2), replica.Log.NewestOffset())
+}
+
+func TestReplica_updateHighWatermark(t *testing.T) {
+	replica := &Replica{
+		BrokerID:  1,
+		Partition: structs.Partition{ISR: []int32{1, 2, 3}},
+		Log: &mock.CommitLog{NewestOffsetFunc: func() int64 {
+			return 10
+		}},
+	}
+	// the high watermark doesn't move until the ISR's followers have fetched
+	require.Equal(t, int64(0), replica.updateHighWatermark(-1, 0))
+	require.Equal(t, int64(0), replica.updateHighWatermark(2, 5))
+	require.Equal(t, int64(5), replica.updateHighWatermark(3, 7))
+	require.Equal(t, int64(7), replica.updateHighWatermark(2, 10))
+	// nor does it go back
+	require.Equal(t, int64(7), replica.updateHighWatermark(3, 6))
+
+	replica.resetFollowers()
+	replica.Partition.ISR = []int32{1}
+	require.Equal(t, int64(10), replica.updateHighWatermark(-1, 0))
+}
+
+func TestBroker_FetchWait(t *testing.T) {
+	b, dir := newTestBroker(t, nil)
+	defer os.RemoveAll(dir)
+	defer b.Shutdown()
+	createTopic(t, b, "the-topic")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	requestCh := make(chan jocko.Request, 4)
+	responseCh := make(chan jocko.Response, 4)
+	go b.Run(ctx, requestCh, responseCh)
+	// the fetches and the produce come from different connections
+	fetchConn, produceConn := new(bytes.Buffer), new(bytes.Buffer)
+	fetch := func(correlationID, maxWaitTime int32) {
+		requestCh <- jocko.Request{
+			Conn:   fetchConn,
+			Header: &protocol.RequestHeader{CorrelationID: correlationID},
+			Request: &protocol.FetchRequest{MinBytes: 1, MaxWaitTime: maxWaitTime, Topics: []*protocol.FetchTopic{{
+				Topic:      "the-topic",
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 100}},
+			}}},
+		}
+	}
+
+	// a fetch waits up to its max wait time for min bytes
+	start := time.Now()
+	fetch(1, 100)
+	response := (<-responseCh).Response.(*protocol.Response)
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+	require.Equal(t, int32(1), response.CorrelationID)
+	fresp := response.Body.(*protocol.FetchResponses)
+	require.Equal(t, protocol.ErrNone.Code(), fresp.Responses[0].PartitionResponses[0].ErrorCode)
+	require.Equal(t, 0, len(fresp.Responses[0].PartitionResponses[0].RecordSetRegions))
+
+	// without holding up other connections' requests, and returns as soon as
+	// they're appended. The fetch's connection's later requests are responded
+	// to after it.
+	start = time.Now()
+	fetch(2, 5000)
+	requestCh <- jocko.Request{Conn: fetchConn, Header: &protocol.RequestHeader{CorrelationID: 3}, Request: &protocol.APIVersionsRequest{}}
+	time.Sleep(50 * time.Millisecond)
+	recordSet, err := protocol.Encode(&protocol.MessageSet{Offset: 0, Messages: []*protocol.Message{{Value: []byte("The message.")}}})
+	require.NoError(t, err)
+	requestCh <- jocko.Request{
+		Conn:   produceConn,
+		Header: &protocol.RequestHeader{CorrelationID: 4},
+		Request: &protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+			Topic: "the-topic",
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+		}}},
+	}
+	var order []int32
+	for i := 0; i < 3; i++ {
+		resp := <-responseCh
+		r := resp.Response.(*protocol.Response)
+		order = append(order, r.CorrelationID)
+		if fresp, ok := r.Body.(*protocol.FetchResponses); ok {
+			require.Equal(t, fetchConn, resp.Conn)
+			handleFetchResponse(t, fresp)
+			require.Equal(t, recordSet, fresp.Responses[0].PartitionResponses[0].RecordSet)
+		}
+	}
+	require.True(t, time.Since(start) < 5*time.Second)
+	require.Equal(t, []int32{4, 2, 3}, order)
+}
+
+func TestBroker_FetchMaxBytes(t *testing.T) {
+	b, dir := newTestBroker(t, nil)
+	defer os.RemoveAll(dir)
+	defer b.Shutdown()
+	recordSet, err := protocol.Encode(&protocol.MessageSet{Offset: 0, Messages: []*protocol.Message{{Value: []byte("The message.")}}})
+	require.NoError(t, err)
+	topics := []string{"the-topic", "another-topic"}
+	createTopic(t, b, topics...)
+	for _, topic := range topics {
+		presp := b.handleProduce(nil, &protocol.ProduceRequest{TopicData: []*protocol.TopicData{{
+			Topic: topic,
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+		}}})
+		require.Equal(t, protocol.ErrNone.Code(), presp.Responses[0].PartitionResponses[0].ErrorCode)
+	}
+	fetch := func(version int16, maxBytes int32) (sizes []int) {
+		req := &protocol.FetchRequest{APIVersion: version, MinBytes: 1, MaxBytes: maxBytes}
+		for _, topic := range topics {
+			req.Topics = append(req.Topics, &protocol.FetchTopic{
+				Topic:      topic,
+				Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 100}},
+			})
+		}
+		fresp := b.handleFetch(nil, req)
+		handleFetchResponse(t, fresp)
+		for _, tr := range fresp.Responses {
+			pr := tr.PartitionResponses[0]
+			require.Equal(t, protocol.ErrNone.Code(), pr.ErrorCode)
+			sizes = append(sizes, len(pr.RecordSet))
+		}
+		return sizes
+	}
+
+	// the request's max bytes is across its topics' partitions
+	require.Equal(t, []int{len(recordSet), 0}, fetch(3, int32(len(recordSet))))
+	require.Equal(t, []int{len(recordSet), len(recordSet)}, fetch(3, int32(2*len(recordSet))))
+	// but the first entry's returned even if it's bigger
+	require.Equal(t, []int{len(recordSet), 0}, fetch(3, 1))
+	// and before version 3 there's only the partitions' max bytes
+	require.Equal(t, []int{len(recordSet), len(recordSet)}, fetch(2, 1))
+}
+
+func TestBroker_RecordBatches(t *testing.T) {
+	b, dir := newTestBroker(t, nil)
+	defer os.RemoveAll(dir)
+	defer b.Shutdown()
+	createTopic(t, b, "the-topic")
+	recordSet, err := protocol.Encode(&protocol.RecordBatch{
+		LastOffsetDelta: 1,
+		FirstTimestamp:  time.Unix(1000, 0),
+		MaxTimestamp:    time.Unix(1001, 0),
+		Records: []*protocol.Record{
+			{Value: []byte("one")},
+			{TimestampDelta: time.Second, OffsetDelta: 1, Value: []byte("two")},
+		},
+	})
+	require.NoError(t, err)
+	messageSet, err := protocol.Encode(&protocol.MessageSet{Offset: 0, Messages: []*protocol.Message{{Value: []byte("three")}}})
+	require.NoError(t, err)
+	produce := func(version int16, recordSet []byte) *protocol.ProducePartitionResponse {
+		presp := b.handleProduce(nil, &protocol.ProduceRequest{APIVersion: version, TopicData: []*protocol.TopicData{{
+			Topic: "the-topic",
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+		}}})
+		return presp.Responses[0].PartitionResponses[0]
+	}
+
+	// batches are produced from version 3
+	require.Equal(t, protocol.ErrUnsupportedForMessageFormat.Code(), produce(2, recordSet).ErrorCode)
+	presp := produce(3, recordSet)
+	require.Equal(t, protocol.ErrNone.Code(), presp.ErrorCode)
+	require.Equal(t, int64(0), presp.BaseOffset)
+	presp = produce(2, messageSet)
+	require.Equal(t, protocol.ErrNone.Code(), presp.ErrorCode)
+	require.Equal(t, int64(2), presp.BaseOffset)
+
+	fetch := func(version int16) *protocol.FetchPartitionResponse {
+		fresp := b.handleFetch(nil, &protocol.FetchRequest{APIVersion: version, MinBytes: 1, Topics: []*protocol.FetchTopic{{
+			Topic:      "the-topic",
+			Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: 0, MaxBytes: 1000}},
+		}}})
+		handleFetchResponse(t, fresp)
+		return fresp.Responses[0].PartitionResponses[0]
+	}
+
+	// version 4 fetches the batch as it was produced
+	pr := fetch(4)
+	require.Equal(t, protocol.ErrNone.Code(), pr.ErrorCode)
+	require.Equal(t, int64(3), pr.HighWatermark)
+	require.Equal(t, int64(3), pr.LastStableOffset)
+	require.Equal(t, recordSet, pr.RecordSet[:len(recordSet)])
+
+	// and older versions fetch its records as messages
+	pr = fetch(1)
+	require.Equal(t, protocol.ErrNone.Code(), pr.ErrorCode)
+	var values []string
+	for _, ms := range commitlog.Entries(pr.RecordSet) {
+		m := commitlog.Message(ms.Payload())
+		require.NotEqual(t, int8(protocol.RecordBatchMagic), m.MagicByte())
+		values = append(values, string(m.Value()))
+	}
+	require.Equal(t, []string{"one", "two", "three"}, values)
+}
+
+func TestBroker_Compression(t *testing.T) {
+	b, dir := newTestBroker(t, nil)
+	defer os.RemoveAll(dir)
+	defer b.Shutdown()
+	codes := createTopics(t, b, &protocol.CreateTopicRequest{
+		Topic:             "gzip-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"compression.type": "gzip"},
+	}, &protocol.CreateTopicRequest{
+		Topic:             "producer-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+	}, &protocol.CreateTopicRequest{
+		Topic:             "brotli-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"compression.type": "brotli"},
+	})
+	require.Equal(t, []int16{protocol.ErrNone.Code(), protocol.ErrNone.Code(), protocol.ErrInvalidConfig.Code()}, codes)
+	produce := func(topic string, version int16, recordSet []byte) {
+		presp := b.handleProduce(nil, &protocol.ProduceRequest{APIVersion: version, TopicData: []*protocol.TopicData{{
+			Topic: topic,
+			Data:  []*protocol.Data{{Partition: 0, RecordSet: recordSet}},
+		}}})
+		require.Equal(t, protocol.ErrNone.Code(), presp.Responses[0].PartitionResponses[0].ErrorCode)
+	}
+	fetch := func(topic string, version int16, offset int64) []byte {
+		fresp := b.handleFetch(nil, &protocol.FetchRequest{APIVersion: version, MinBytes: 1, Topics: []*protocol.FetchTopic{{
+			Topic:      topic,
+			Partitions: []*protocol.FetchPartition{{Partition: 0, FetchOffset: offset, MaxBytes: 1000}},
+		}}})
+		handleFetchResponse(t, fresp)
+		pr := fresp.Responses[0].PartitionResponses[0]
+		require.Equal(t, protocol.ErrNone.Code(), pr.ErrorCode)
+		return pr.RecordSet
+	}
+	var recordSet []byte
+	for i, value := range []string{"one", "two"} {
+		ms, err := protocol.Encode(&protocol.MessageSet{Offset: int64(i), Messages: []*protocol.Message{{MagicByte: 1, Timestamp: time.Unix(1000, 0), Value: []byte(value)}}})
+		require.NoError(t, err)
+		recordSet = append(recordSet, ms...)
+	}
+
+	// the topic's messages are recompressed with its codec
+	produce("gzip-topic", 2, recordSet)
+	entries := commitlog.Entries(fetch("gzip-topic", 1, 0))
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, int64(1), entries[0].Offset())
+	set := new(protocol.MessageSet)
+	require.NoError(t, protocol.Decode(entries[0], set))
+	require.Equal(t, protocol.CompressionGZIP, set.Messages[0].Codec)
+	require.Equal(t, 2, len(set.Messages[0].Set))
+	require.Equal(t, []byte("two"), set.Messages[0].Set[1].Messages[0].Value)
+
+	batch, err := protocol.Encode(&protocol.RecordBatch{
+		Attributes: int16(protocol.CompressionSnappy),
+		Records:    []*protocol.Record{{Value: []byte("three")}},
+	})
+	require.NoError(t, err)
+	produce("gzip-topic", 3, batch)
+	entries = commitlog.Entries(fetch("gzip-topic", 4, 2))
+	require.Equal(t, 1, len(entries))
+	rb := new(protocol.RecordBatch)
+	require.NoError(t, protocol.Decode(entries[0], rb))
+	require.Equal(t, protocol.CompressionGZIP, rb.Codec())
+	require.Equal(t, []byte("three"), rb.Records[0].Value)
+
+	// and kept as they were produced by default
+	produce("producer-topic", 3, batch)
+	require.Equal(t, batch[8:], fetch("producer-topic", 4, 0)[8:])
+}
+
+func TestBroker_TopicLogConfig(t *testing.T) {
+	b, dir := newTestBroker(t, func(config *config.Config) {
+		config.LogRetentionBytes = 1 << 20
+		config.LogRetentionAge = time.Hour
+	})
+	defer os.RemoveAll(dir)
+	defer b.Shutdown()
+	codes := createTopics(t, b, &protocol.CreateTopicRequest{
+		Topic:             "flushed-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"flush.messages": "1", "flush.ms": "500", "retention.bytes": "2048", "retention.ms": "-1"},
+	}, &protocol.CreateTopicRequest{
+		Topic:             "default-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+	}, &protocol.CreateTopicRequest{
+		Topic:             "bad-flush-messages-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"flush.messages": "0"},
+	}, &protocol.CreateTopicRequest{
+		Topic:             "bad-flush-ms-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"flush.ms": "soon"},
+	}, &protocol.CreateTopicRequest{
+		Topic:             "bad-retention-bytes-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"retention.bytes": "0"},
+	}, &protocol.CreateTopicRequest{
+		Topic:             "bad-retention-ms-topic",
+		NumPartitions:     1,
+		ReplicationFactor: 1,
+		Configs:           map[string]string{"retention.ms": "-2"},
+	})
+	invalid := protocol.ErrInvalidConfig.Code()
+	require.Equal(t, []int16{protocol.ErrNone.Code(), protocol.ErrNone.Code(), invalid, invalid, invalid, invalid}, codes)
+	options := func(topic string) commitlog.Options {
+		replica, err := b.replicaLookup.Replica(topic, 0)
+		require.NoError(t, err)
+		return replica.Log.(*commitlog.CommitLog).Options
+	}
+
+	opts := options("flushed-topic")
+	require.Equal(t, int64(1), opts.FlushMessages)
+	require.Equal(t, 500*time.Millisecond, opts.FlushInterval)
+	require.Equal(t, int64(2048), opts.MaxLogBytes)
+	require.Equal(t, time.Duration(0), opts.MaxLogAge)
+
+	// the broker's defaults are used for what the topic doesn't set
+	opts = options("default-topic")
+	require.Equal(t, int64(0), opts.FlushMessages)
+	require.Equal(t, time.Duration(0), opts.FlushInterval)
+	require.Equal(t, int64(1<<20), opts.MaxLogBytes)
+	require.Equal(t, time.Hour, opts.MaxLogAge)
+}
+
 func Test_contains(t *testing.T) {
 	type args struct {
 		rs []int32
@@ -754,16 +1484,20 @@ func wantPeers(s *Broker, peers int) error {
 	return nil
 }
 
-func handleProduceResponse(t *testing.T, res *protocol.ProduceResponses) {
+func handleFetchResponse(t *testing.T, res *protocol.FetchResponses) {
 	for _, response := range res.Responses {
 		for _, pr := range response.PartitionResponses {
-			if pr.ErrorCode != protocol.ErrNone.Code() {
-				break
+			if len(pr.RecordSetRegions) == 0 {
+				continue
 			}
-			if pr.Timestamp == 0 {
-				t.Error("expected timestamp not to be 0")
+			var b bytes.Buffer
+			for _, region := range pr.RecordSetRegions {
+				if _, err := region.WriteTo(&b); err != nil {
+					t.Fatalf("err: %s", err)
+				}
 			}
-			pr.Timestamp = 0
+			pr.RecordSet = b.Bytes()
+			pr.RecordSetRegions = nil
 		}
 	}
 }
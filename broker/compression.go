@@ -0,0 +1,137 @@
+package broker
+
+import (
+	"time"
+
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// compressionTypeConfig is the topic config for the codec its produced
+	// messages are recompressed with.
+	compressionTypeConfig = "compression.type"
+	// producerCompression keeps messages compressed as they were produced.
+	producerCompression = "producer"
+)
+
+// compressionType returns the codec the topic's config says to recompress
+// produced messages with. ok is false if they're kept as they were produced,
+// which is the default.
+func compressionType(config map[string]string) (codec protocol.CompressionCodec, ok bool, err error) {
+	name, ok := config[compressionTypeConfig]
+	if !ok || name == producerCompression {
+		return protocol.CompressionNone, false, nil
+	}
+	if codec, err = protocol.ParseCompressionCodec(name); err != nil {
+		return protocol.CompressionNone, false, err
+	}
+	return codec, true, nil
+}
+
+// recompress returns the record set with its entries compressed with the
+// codec. A batch's records are recompressed in the batch, and each run of
+// legacy messages is wrapped in one compressed message, or unwrapped if the
+// codec's none. Entries compressed with the codec already are kept as they
+// are.
+func recompress(recordSet []byte, codec protocol.CompressionCodec) ([]byte, error) {
+	var out []byte
+	// the messages of the run of legacy entries being recompressed
+	var run []*protocol.Message
+	flush := func() error {
+		if len(run) == 0 {
+			return nil
+		}
+		b, err := wrap(run, codec)
+		if err != nil {
+			return err
+		}
+		out = append(out, b...)
+		run = nil
+		return nil
+	}
+	for _, ms := range commitlog.Entries(recordSet) {
+		isBatch := commitlog.Message(ms.Payload()).MagicByte() == protocol.RecordBatchMagic
+		if (isBatch && commitlog.RecordBatch(ms).Codec() == codec) || (!isBatch && commitlog.Message(ms.Payload()).Codec() == codec) {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			out = append(out, ms...)
+			continue
+		}
+		if isBatch {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			batch := new(protocol.RecordBatch)
+			if err := protocol.Decode(ms, batch); err != nil {
+				return nil, err
+			}
+			batch.SetCodec(codec)
+			b, err := protocol.Encode(batch)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, b...)
+			continue
+		}
+		set := new(protocol.MessageSet)
+		if err := protocol.Decode(ms, set); err != nil {
+			return nil, err
+		}
+		for _, m := range set.Messages {
+			// a run's wrapped with its first message's magic
+			if len(run) > 0 && m.MagicByte != run[0].MagicByte {
+				if err := flush(); err != nil {
+					return nil, err
+				}
+			}
+			if m.Codec == protocol.CompressionNone {
+				run = append(run, m)
+				continue
+			}
+			for _, wrapped := range m.Set {
+				run = append(run, wrapped.Messages...)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// wrap returns the entries of the messages compressed with the codec in one
+// wrapper message, or the entries of each message if the codec's none. The
+// offsets are assigned when they're appended.
+func wrap(msgs []*protocol.Message, codec protocol.CompressionCodec) ([]byte, error) {
+	var set []*protocol.MessageSet
+	var timestamp time.Time
+	for i, m := range msgs {
+		set = append(set, &protocol.MessageSet{Offset: int64(i), Messages: []*protocol.Message{m}})
+		if m.Timestamp.After(timestamp) {
+			timestamp = m.Timestamp
+		}
+	}
+	if codec == protocol.CompressionNone {
+		var out []byte
+		for _, ms := range set {
+			b, err := protocol.Encode(ms)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, b...)
+		}
+		return out, nil
+	}
+	// a magic 1 wrapper has the newest timestamp of its messages
+	return protocol.Encode(&protocol.MessageSet{
+		Offset: int64(len(set) - 1),
+		Messages: []*protocol.Message{{
+			MagicByte: msgs[0].MagicByte,
+			Timestamp: timestamp,
+			Codec:     codec,
+			Set:       set,
+		}},
+	})
+}
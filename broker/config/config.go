@@ -6,6 +6,7 @@ import (
 
 	"github.com/hashicorp/raft"
 	"github.com/hashicorp/serf/serf"
+	"github.com/travisjeffery/jocko"
 )
 
 const (
@@ -28,6 +29,32 @@ type Config struct {
 	StartJoinAddrsWAN []string
 	NonVoter          bool
 	RaftAddr          string
+	// LogDirs are the dirs partitions' logs are spread across. Defaults to
+	// DataDir.
+	LogDirs []string
+	// LogSegmentBytes is the size partitions' log segments are rolled at,
+	// LogSegmentAge how long after their first message they're rolled at if
+	// they haven't filled up. See commitlog.Options for their defaults.
+	LogSegmentBytes int64
+	LogSegmentAge   time.Duration
+	// LogRetentionBytes is how many bytes of partitions' logs are kept,
+	// LogRetentionAge how long after their newest message their segments
+	// are kept, unless their topics' retention.bytes and retention.ms say
+	// otherwise. Zero or less keeps them regardless.
+	LogRetentionBytes int64
+	LogRetentionAge   time.Duration
+	// LogPreallocate preallocates new log segments' files.
+	LogPreallocate bool
+	// ReplicaFetchMaxBytes is the most followers fetch from a partition's
+	// leader at once. See ReplicatorConfig for its default.
+	ReplicaFetchMaxBytes int32
+	// OffsetsRetention is how long consumer groups' committed offsets are
+	// kept by default, OffsetsRetentionCheckInterval how often the
+	// controller deletes those that have expired.
+	OffsetsRetention              time.Duration
+	OffsetsRetentionCheckInterval time.Duration
+	// Metrics is optional, it's used to report on the broker's logs.
+	Metrics *jocko.Metrics
 }
 
 // DefaultConfig creates/returns a default configuration.
@@ -42,6 +69,9 @@ func DefaultConfig() *Config {
 		NodeName:      hostname,
 		SerfLANConfig: serfDefaultConfig(),
 		RaftConfig:    raft.DefaultConfig(),
+
+		OffsetsRetention:              24 * time.Hour,
+		OffsetsRetentionCheckInterval: 10 * time.Minute,
 	}
 
 	conf.SerfLANConfig.ReconnectTimeout = 3 * 24 * time.Hour
@@ -14,6 +14,8 @@ func init() {
 	registerCommand(structs.DeregisterTopicRequestType, (*FSM).applyDeregisterTopic)
 	registerCommand(structs.RegisterPartitionRequestType, (*FSM).applyRegisterPartition)
 	registerCommand(structs.DeregisterPartitionRequestType, (*FSM).applyDeregisterPartition)
+	registerCommand(structs.CommitOffsetsRequestType, (*FSM).applyCommitOffsets)
+	registerCommand(structs.ExpireOffsetsRequestType, (*FSM).applyExpireOffsets)
 }
 
 func (c *FSM) applyRegisterNode(buf []byte, index uint64) interface{} {
@@ -99,3 +101,31 @@ func (c *FSM) applyDeregisterPartition(buf []byte, index uint64) interface{} {
 
 	return nil
 }
+
+func (c *FSM) applyCommitOffsets(buf []byte, index uint64) interface{} {
+	var req structs.CommitOffsetsRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := c.state.CommitOffsets(index, req.Offsets); err != nil {
+		c.logger.Error("CommitOffsets failed", log.Error("error", err))
+		return err
+	}
+
+	return nil
+}
+
+func (c *FSM) applyExpireOffsets(buf []byte, index uint64) interface{} {
+	var req structs.ExpireOffsetsRequest
+	if err := structs.Decode(buf, &req); err != nil {
+		panic(fmt.Errorf("failed to decode request: %v", err))
+	}
+
+	if err := c.state.ExpireOffsets(index, req.Time); err != nil {
+		c.logger.Error("ExpireOffsets failed", log.Error("error", err))
+		return err
+	}
+
+	return nil
+}
@@ -101,6 +101,57 @@ func TestRegisterPartition(t *testing.T) {
 	}
 }
 
+func TestCommitOffsets(t *testing.T) {
+	fsm, err := New(log.New())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	req := structs.CommitOffsetsRequest{
+		Offsets: []structs.Offset{
+			{Group: "group1", Topic: "test-topic", Partition: 0, Offset: 5, Metadata: "meta", ExpireTimestamp: 100},
+			{Group: "group1", Topic: "test-topic", Partition: 1, Offset: 8, ExpireTimestamp: 200},
+		},
+	}
+	buf, err := structs.Encode(structs.CommitOffsetsRequestType, req)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	resp := fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, offset, err := fsm.state.GetOffset("group1", "test-topic", 0)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if offset == nil {
+		t.Fatalf("offset not found")
+	}
+	if offset.Offset != 5 || offset.Metadata != "meta" || offset.ModifyIndex != 1 {
+		t.Fatalf("bad offset: %#v", offset)
+	}
+
+	buf, err = structs.Encode(structs.ExpireOffsetsRequestType, structs.ExpireOffsetsRequest{Time: 100})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resp = fsm.Apply(makeLog(buf))
+	if resp != nil {
+		t.Fatalf("resp: %v", resp)
+	}
+
+	_, offsets, err := fsm.state.GetGroupOffsets("group1")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(offsets) != 1 || offsets[0].Partition != 1 {
+		t.Fatalf("bad offsets: %#v", offsets)
+	}
+}
+
 func makeLog(buf []byte) *raft.Log {
 	return &raft.Log{
 		Index: 1,
@@ -468,6 +468,22 @@ func (s *Store) GetPartition(topic string, id int32) (uint64, *structs.Partition
 	return idx, nil, nil
 }
 
+// GetPartitions is used to get all the partitions.
+func (s *Store) GetPartitions() (uint64, []*structs.Partition, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	idx := maxIndexTxn(tx, "partitions")
+	it, err := tx.Get("partitions", "id")
+	if err != nil {
+		return 0, nil, err
+	}
+	var partitions []*structs.Partition
+	for next := it.Next(); next != nil; next = it.Next() {
+		partitions = append(partitions, next.(*structs.Partition))
+	}
+	return idx, partitions, nil
+}
+
 // DeletePartition is used to delete partitions.
 func (s *Store) DeletePartition(idx uint64, topic string, partition int32) error {
 	tx := s.db.Txn(true)
@@ -501,6 +517,111 @@ func (s *Store) deletePartitionTxn(tx *memdb.Txn, idx uint64, topic string, id i
 	return nil
 }
 
+// CommitOffsets is used to upsert consumer groups' offsets.
+func (s *Store) CommitOffsets(idx uint64, offsets []structs.Offset) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+	for i := range offsets {
+		if err := s.commitOffsetTxn(tx, idx, &offsets[i]); err != nil {
+			return err
+		}
+	}
+	tx.Commit()
+	return nil
+}
+
+func (s *Store) commitOffsetTxn(tx *memdb.Txn, idx uint64, offset *structs.Offset) error {
+	existing, err := tx.First("offsets", "id", offset.Group, offset.Topic, offset.Partition)
+	if err != nil {
+		return fmt.Errorf("offset lookup failed: %s", err)
+	}
+
+	if existing != nil {
+		offset.CreateIndex = existing.(*structs.Offset).CreateIndex
+		offset.ModifyIndex = idx
+	} else {
+		offset.CreateIndex = idx
+		offset.ModifyIndex = idx
+	}
+
+	if err := tx.Insert("offsets", offset); err != nil {
+		return fmt.Errorf("failed inserting offset: %s", err)
+	}
+
+	if err := tx.Insert("index", &IndexEntry{"offsets", idx}); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+
+	return nil
+}
+
+// GetOffset is used to get a group's offset for a partition.
+func (s *Store) GetOffset(group, topic string, partition int32) (uint64, *structs.Offset, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	idx := maxIndexTxn(tx, "offsets")
+
+	offset, err := tx.First("offsets", "id", group, topic, partition)
+	if err != nil {
+		return 0, nil, fmt.Errorf("offset lookup failed: %s", err)
+	}
+	if offset != nil {
+		return idx, offset.(*structs.Offset), nil
+	}
+
+	return idx, nil, nil
+}
+
+// GetGroupOffsets is used to get all of a group's offsets.
+func (s *Store) GetGroupOffsets(group string) (uint64, []*structs.Offset, error) {
+	tx := s.db.Txn(false)
+	defer tx.Abort()
+	idx := maxIndexTxn(tx, "offsets")
+	it, err := tx.Get("offsets", "group", group)
+	if err != nil {
+		return 0, nil, err
+	}
+	var offsets []*structs.Offset
+	for next := it.Next(); next != nil; next = it.Next() {
+		offsets = append(offsets, next.(*structs.Offset))
+	}
+	return idx, offsets, nil
+}
+
+// ExpireOffsets is used to delete the offsets that expire at or before now,
+// in ms.
+func (s *Store) ExpireOffsets(idx uint64, now int64) error {
+	tx := s.db.Txn(true)
+	defer tx.Abort()
+
+	it, err := tx.Get("offsets", "id")
+	if err != nil {
+		return err
+	}
+	var expired []interface{}
+	for next := it.Next(); next != nil; next = it.Next() {
+		if next.(*structs.Offset).ExpireTimestamp <= now {
+			expired = append(expired, next)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	for _, offset := range expired {
+		if err := tx.Delete("offsets", offset); err != nil {
+			s.logger.Error("failed deleting offset", log.Error("error", err))
+			return err
+		}
+	}
+	if err := tx.Insert("index", &IndexEntry{"offsets", idx}); err != nil {
+		s.logger.Error("failed updating index", log.Error("error", err))
+		return err
+	}
+
+	tx.Commit()
+	return nil
+}
+
 // maxIndex is a helper used to retrieve the highest known index amongst a set of tables in the db.
 func (s *Store) maxIndex(tables ...string) uint64 {
 	tx := s.db.Txn(false)
@@ -541,12 +662,35 @@ func (s *Store) Snapshot() *Snapshot {
 	return &Snapshot{s, tx, idx}
 }
 
+// Offset is used when restoring from a snapshot.
+func (s *Restore) Offset(offset *structs.Offset) error {
+	if err := s.tx.Insert("offsets", offset); err != nil {
+		return fmt.Errorf("failed restoring offset: %s", err)
+	}
+	if err := indexUpdateMaxTxn(s.tx, offset.ModifyIndex, "offsets"); err != nil {
+		return fmt.Errorf("failed updating index: %s", err)
+	}
+	return nil
+}
+
 // IndexEntry keeps a record of the last index per-table.
 type IndexEntry struct {
 	Key   string
 	Value uint64
 }
 
+// indexUpdateMaxTxn is used to update the table's index if idx is higher.
+func indexUpdateMaxTxn(tx *memdb.Txn, idx uint64, table string) error {
+	ti, err := tx.First("index", "id", table)
+	if err != nil {
+		return err
+	}
+	if existing, ok := ti.(*IndexEntry); ok && existing.Value >= idx {
+		return nil
+	}
+	return tx.Insert("index", &IndexEntry{table, idx})
+}
+
 // maxIndexTxn is a helper used to retrieve the highest known index
 // amongst a set of tables in the db.
 func maxIndexTxn(tx *memdb.Txn, tables ...string) uint64 {
@@ -576,6 +720,11 @@ func (s *Snapshot) LastIndex() uint64 {
 	return s.lastIndex
 }
 
+// Offsets is used to iterate over all the offsets for a snapshot.
+func (s *Snapshot) Offsets() (memdb.ResultIterator, error) {
+	return s.tx.Get("offsets", "id")
+}
+
 // Close performs cleanup of a state snapshot.
 func (s *Snapshot) Close() {
 	s.tx.Abort()
@@ -691,9 +840,39 @@ func partitionsTableSchema() *memdb.TableSchema {
 	}
 }
 
+// offsetsTableSchema returns a new table schema used for storing consumer
+// groups' offsets.
+func offsetsTableSchema() *memdb.TableSchema {
+	return &memdb.TableSchema{
+		Name: "offsets",
+		Indexes: map[string]*memdb.IndexSchema{
+			"id": &memdb.IndexSchema{
+				Name:   "id",
+				Unique: true,
+				Indexer: &memdb.CompoundIndex{
+					Indexes: []memdb.Indexer{
+						&memdb.StringFieldIndex{Field: "Group"},
+						&memdb.StringFieldIndex{Field: "Topic"},
+						&IntFieldIndex{Field: "Partition"},
+					},
+				},
+			},
+			"group": &memdb.IndexSchema{
+				Name:         "group",
+				AllowMissing: false,
+				Unique:       false,
+				Indexer: &memdb.StringFieldIndex{
+					Field: "Group",
+				},
+			},
+		},
+	}
+}
+
 func init() {
 	registerSchema(indexTableSchema)
 	registerSchema(nodesTableSchema)
 	registerSchema(topicsTableSchema)
 	registerSchema(partitionsTableSchema)
+	registerSchema(offsetsTableSchema)
 }
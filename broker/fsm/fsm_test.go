@@ -151,6 +151,14 @@ func TestStore_RegisterPartition(t *testing.T) {
 		t.Fatalf("err: %s, partition: %v", err, p)
 	}
 
+	testRegisterPartition(t, s, 1, 2, "test-topic")
+	if _, ps, err := s.GetPartitions(); err != nil || len(ps) != 2 {
+		t.Fatalf("err: %s, partitions: %v", err, ps)
+	}
+	if err := s.DeletePartition(1, "test-topic", 2); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
 	// delete the partition
 	if err := s.DeletePartition(1, "test-topic", 1); err != nil {
 		t.Fatalf("err: %s", err)
@@ -189,3 +197,51 @@ func testRegisterPartition(t *testing.T, s *Store, idx uint64, id int32, topic s
 		t.Fatalf("bad partition: %#v", result)
 	}
 }
+
+func TestStore_CommitOffsets(t *testing.T) {
+	s := testStore(t)
+
+	if _, o, err := s.GetOffset("group1", "test-topic", 0); err != nil || o != nil {
+		t.Fatalf("err: %s, offset: %v", err, o)
+	}
+
+	if err := s.CommitOffsets(1, []structs.Offset{{Group: "group1", Topic: "test-topic", Offset: 1, ExpireTimestamp: 100}}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := s.CommitOffsets(2, []structs.Offset{
+		{Group: "group1", Topic: "test-topic", Offset: 2, ExpireTimestamp: 200},
+		{Group: "group2", Topic: "test-topic", Offset: 3, ExpireTimestamp: 100},
+	}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	// a commit replaces the group's offset
+	if idx, o, err := s.GetOffset("group1", "test-topic", 0); err != nil || idx != 2 || o.Offset != 2 || o.CreateIndex != 1 || o.ModifyIndex != 2 {
+		t.Fatalf("bad: %#v %d (err: %s)", o, idx, err)
+	}
+	if _, offsets, err := s.GetGroupOffsets("group1"); err != nil || len(offsets) != 1 {
+		t.Fatalf("err: %s, offsets: %v", err, offsets)
+	}
+
+	// expiring deletes the offsets that have expired
+	if err := s.ExpireOffsets(3, 150); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, o, err := s.GetOffset("group2", "test-topic", 0); err != nil || o != nil {
+		t.Fatalf("err: %s, offset: %v", err, o)
+	}
+	if _, o, err := s.GetOffset("group1", "test-topic", 0); err != nil || o == nil {
+		t.Fatalf("err: %s, offset: %v", err, o)
+	}
+	if idx := s.maxIndex("offsets"); idx != 3 {
+		t.Fatalf("err: %d", idx)
+	}
+
+	// expiring nothing leaves the index as is
+	if err := s.ExpireOffsets(4, 150); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if idx := s.maxIndex("offsets"); idx != 3 {
+		t.Fatalf("err: %d", idx)
+	}
+}
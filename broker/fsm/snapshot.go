@@ -8,6 +8,11 @@ import (
 	"github.com/ugorji/go/codec"
 )
 
+func init() {
+	registerPersister(persistOffsets)
+	registerRestorer(structs.CommitOffsetsRequestType, restoreOffset)
+}
+
 type snapshot struct {
 	state *Snapshot
 }
@@ -73,3 +78,28 @@ func (s *snapshot) Persist(sink raft.SnapshotSink) error {
 func (s *snapshot) Release() {
 	s.state.Close()
 }
+
+// persistOffsets writes each offset prefixed with its message type.
+func persistOffsets(s *snapshot, sink raft.SnapshotSink, encoder *codec.Encoder) error {
+	offsets, err := s.state.Offsets()
+	if err != nil {
+		return err
+	}
+	for next := offsets.Next(); next != nil; next = offsets.Next() {
+		if _, err := sink.Write([]byte{byte(structs.CommitOffsetsRequestType)}); err != nil {
+			return err
+		}
+		if err := encoder.Encode(next.(*structs.Offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreOffset(header *snapshotHeader, restore *Restore, decoder *codec.Decoder) error {
+	var offset structs.Offset
+	if err := decoder.Decode(&offset); err != nil {
+		return err
+	}
+	return restore.Offset(&offset)
+}
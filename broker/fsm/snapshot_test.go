@@ -0,0 +1,83 @@
+package fsm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/travisjeffery/jocko/broker/structs"
+	"github.com/travisjeffery/jocko/log"
+)
+
+// testSink is a raft.SnapshotSink that buffers the snapshot.
+type testSink struct {
+	bytes.Buffer
+	cancel bool
+}
+
+func (s *testSink) ID() string {
+	return "test"
+}
+
+func (s *testSink) Cancel() error {
+	s.cancel = true
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func TestSnapshotRestoreOffsets(t *testing.T) {
+	fsm, err := New(log.New())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	offsets := []structs.Offset{
+		{Group: "group1", Topic: "test-topic", Partition: 0, Offset: 5, Metadata: "meta", CommitTimestamp: 10, ExpireTimestamp: 100},
+		{Group: "group1", Topic: "test-topic", Partition: 1, Offset: 8, ExpireTimestamp: 200},
+		{Group: "group2", Topic: "test-topic", Partition: 0, Offset: 2, ExpireTimestamp: 200},
+	}
+	if err := fsm.state.CommitOffsets(7, offsets); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer snap.Release()
+	sink := new(testSink)
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if sink.cancel {
+		t.Fatalf("snapshot cancelled")
+	}
+
+	restored, err := New(log.New())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := restored.Restore(ioutil.NopCloser(sink)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for _, exp := range []string{"group1", "group2"} {
+		_, want, err := fsm.state.GetGroupOffsets(exp)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		idx, got, err := restored.state.GetGroupOffsets(exp)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if idx != 7 {
+			t.Fatalf("bad index: %d", idx)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("bad offsets: %#v, want: %#v", got, want)
+		}
+	}
+}
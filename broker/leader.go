@@ -160,6 +160,13 @@ func (s *Broker) leaderLoop(stopCh chan struct{}) {
 	var reconcileCh chan serf.Member
 	establishedLeader := false
 
+	var expireOffsets <-chan time.Time
+	if s.config.OffsetsRetentionCheckInterval > 0 {
+		ticker := time.NewTicker(s.config.OffsetsRetentionCheckInterval)
+		defer ticker.Stop()
+		expireOffsets = ticker.C
+	}
+
 RECONCILE:
 	reconcileCh = nil
 	interval := time.After(60 * time.Second)
@@ -201,10 +208,20 @@ WAIT:
 			goto RECONCILE
 		case member := <-reconcileCh:
 			s.reconcileMember(member)
+		case <-expireOffsets:
+			s.expireOffsets()
 		}
 	}
 }
 
+// expireOffsets deletes the groups' offsets that have expired.
+func (s *Broker) expireOffsets() {
+	req := structs.ExpireOffsetsRequest{Time: time.Now().UnixNano() / int64(time.Millisecond)}
+	if _, err := s.raftApply(structs.ExpireOffsetsRequestType, &req); err != nil {
+		s.logger.Error("failed to expire offsets", log.Error("error", err))
+	}
+}
+
 func (s *Broker) reconcile() error {
 	members := s.LANMembers()
 	for _, member := range members {
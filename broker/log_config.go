@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// flushMessagesConfig is the topic config for how many messages are
+	// appended to a partition's log before it's flushed to disk,
+	// flushMsConfig for how often it's flushed in milliseconds. Flushing's
+	// left to the OS unless they're set.
+	flushMessagesConfig = "flush.messages"
+	flushMsConfig       = "flush.ms"
+	// retentionBytesConfig is the topic config for how many bytes of a
+	// partition's log are kept, retentionMsConfig for how many milliseconds
+	// its messages are kept for. -1 keeps them regardless, the broker's
+	// defaults are used unless they're set.
+	retentionBytesConfig = "retention.bytes"
+	retentionMsConfig    = "retention.ms"
+)
+
+// flushPolicy returns how many messages are appended and how long passes
+// between flushes of the topic's partitions' logs, zero for those its config
+// doesn't set.
+func flushPolicy(config map[string]string) (messages int64, interval time.Duration, err error) {
+	if messages, err = positiveConfig(config, flushMessagesConfig); err != nil {
+		return 0, 0, err
+	}
+	ms, err := positiveConfig(config, flushMsConfig)
+	if err != nil {
+		return 0, 0, err
+	}
+	return messages, time.Duration(ms) * time.Millisecond, nil
+}
+
+// retention returns how many bytes of the topic's partitions' logs are kept
+// and how long they're kept for, as commitlog.Options' MaxLogBytes and
+// MaxLogAge, from the topic's config or the given defaults if it doesn't set
+// them. Defaults of zero or less keep the logs regardless.
+func retention(config map[string]string, defaultBytes int64, defaultAge time.Duration) (bytes int64, age time.Duration, err error) {
+	bytes, ok, err := limitConfig(config, retentionBytesConfig)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !ok {
+		bytes = defaultBytes
+	}
+	if bytes <= 0 {
+		bytes = -1
+	}
+	ms, ok, err := limitConfig(config, retentionMsConfig)
+	if err != nil {
+		return 0, 0, err
+	}
+	age = time.Duration(ms) * time.Millisecond
+	if !ok {
+		age = defaultAge
+	}
+	if age < 0 {
+		age = 0
+	}
+	return bytes, age, nil
+}
+
+// limitConfig returns the topic config's value for name and whether it's set,
+// it has to be a positive integer or -1 for no limit.
+func limitConfig(config map[string]string, name string) (int64, bool, error) {
+	value, ok := config[name]
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || (n <= 0 && n != -1) {
+		return 0, false, errors.Errorf("%s must be a positive integer or -1: %q", name, value)
+	}
+	return n, true, nil
+}
+
+// positiveConfig returns the topic config's value for name, which has to be
+// a positive integer if it's set. It's zero if it isn't.
+func positiveConfig(config map[string]string, name string) (int64, error) {
+	value, ok := config[name]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.Errorf("%s must be a positive integer: %q", name, value)
+	}
+	return n, nil
+}
+
+// validateTopicConfig returns an error if any of the topic configs the broker
+// uses are invalid.
+func validateTopicConfig(config map[string]string) error {
+	if _, _, err := compressionType(config); err != nil {
+		return err
+	}
+	if _, _, err := flushPolicy(config); err != nil {
+		return err
+	}
+	if _, _, err := retention(config, 0, 0); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+const (
+	// partitionMetadataFile records the topic and partition a log dir is for.
+	partitionMetadataFile = "partition.metadata"
+	// quarantineSuffix is added to the name of log dirs that can't be
+	// trusted to hold the partition their name says they do.
+	quarantineSuffix = ".quarantined"
+)
+
+var (
+	ErrLogDirMismatch   = errors.New("log dir metadata doesn't match its partition")
+	ErrLogDirOffline    = errors.New("log dir is offline")
+	ErrInvalidTopicName = errors.New("invalid topic name")
+)
+
+// maxTopicNameLength is the longest a topic's name can be, so its log dirs'
+// names fit in the file system's limit.
+const maxTopicNameLength = 249
+
+// validTopicName returns whether the topic's name is one its log dirs can
+// be named for, ASCII letters, digits, '.', '_', and '-', and not '.' or '..'
+// so they can't be outside the log dirs.
+func validTopicName(topic string) bool {
+	if topic == "" || topic == "." || topic == ".." || len(topic) > maxTopicNameLength {
+		return false
+	}
+	for _, c := range topic {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// partitionMetadata is the contents of a log dir's metadata file.
+type partitionMetadata struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+}
+
+// logDirName returns the name of the dir the partition's log is stored in.
+func logDirName(topic string, partition int32) string {
+	return fmt.Sprintf("%s-%d", topic, partition)
+}
+
+// logDirs returns the dirs partitions' logs are spread across.
+func (b *Broker) logDirs() []string {
+	if len(b.config.LogDirs) > 0 {
+		return b.config.LogDirs
+	}
+	return []string{b.config.DataDir}
+}
+
+// logDir returns the dir the partition's log is stored in. If the partition
+// is on one of the log dirs already its dir is checked to be the partition's,
+// otherwise it's placed on the online log dir with the fewest partitions.
+func (b *Broker) logDir(topic string, partition int32) (string, error) {
+	if !validTopicName(topic) {
+		return "", ErrInvalidTopicName
+	}
+	name := logDirName(topic, partition)
+	for _, logDir := range b.logDirs() {
+		dir := filepath.Join(logDir, name)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			b.failLogDir(logDir, err)
+		}
+		if b.isLogDirOffline(logDir) {
+			return "", ErrLogDirOffline
+		}
+		m, err := readPartitionMetadata(dir)
+		if err != nil {
+			return "", err
+		}
+		if m != nil && (m.Topic != topic || m.Partition != partition) {
+			return "", ErrLogDirMismatch
+		}
+		// a crash could have left the dir without its metadata
+		if m == nil {
+			if err := writePartitionMetadata(dir, partitionMetadata{Topic: topic, Partition: partition}); err != nil {
+				return "", err
+			}
+		}
+		return dir, nil
+	}
+
+	var placed string
+	min := -1
+	for _, logDir := range b.logDirs() {
+		if b.isLogDirOffline(logDir) {
+			continue
+		}
+		n, err := countPartitions(logDir)
+		if err != nil {
+			b.failLogDir(logDir, err)
+			continue
+		}
+		if min == -1 || n < min {
+			placed, min = logDir, n
+		}
+	}
+	if placed == "" {
+		return "", ErrLogDirOffline
+	}
+	dir := filepath.Join(placed, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "mkdir failed")
+	}
+	if err := writePartitionMetadata(dir, partitionMetadata{Topic: topic, Partition: partition}); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// countPartitions returns how many partitions are stored in the log dir.
+func countPartitions(logDir string) (int, error) {
+	files, err := ioutil.ReadDir(logDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "read dir failed")
+	}
+	var n int
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(logDir, file.Name(), partitionMetadataFile))
+		if err == nil {
+			n++
+		} else if !os.IsNotExist(err) {
+			return 0, errors.Wrap(err, "stat file failed")
+		}
+	}
+	return n, nil
+}
+
+// failLogDir takes the log dir offline after an I/O error, so the replicas
+// stored on it go offline while the broker's other replicas carry on.
+func (b *Broker) failLogDir(logDir string, err error) {
+	b.logDirsLock.Lock()
+	defer b.logDirsLock.Unlock()
+	if _, ok := b.offlineLogDirs[logDir]; ok {
+		return
+	}
+	if b.offlineLogDirs == nil {
+		b.offlineLogDirs = make(map[string]error)
+	}
+	b.offlineLogDirs[logDir] = err
+	b.logger.Error("log dir failed, taking its replicas offline", log.String("dir", logDir), log.Error("error", err))
+}
+
+func (b *Broker) isLogDirOffline(logDir string) bool {
+	b.logDirsLock.RLock()
+	defer b.logDirsLock.RUnlock()
+	_, ok := b.offlineLogDirs[logDir]
+	return ok
+}
+
+// logErr returns the protocol error for an error using the replica's log. I/O
+// errors take the replica's log dir offline and are storage errors.
+func (b *Broker) logErr(replica *Replica, err error) protocol.Error {
+	if replica.LogDir != "" && isIOError(err) {
+		b.failLogDir(replica.LogDir, err)
+	}
+	if replica.LogDir != "" && b.isLogDirOffline(replica.LogDir) {
+		return protocol.ErrKafkaStorageError.WithErr(err)
+	}
+	if cause := errors.Cause(err); cause == commitlog.ErrMalformedEntry || cause == commitlog.ErrCompressedEntry {
+		return protocol.ErrCorruptMessage.WithErr(err)
+	}
+	return protocol.ErrUnknown.WithErr(err)
+}
+
+// isIOError returns whether the error's from the disk failing or filling up,
+// rather than from using a file wrong, as when it's closed or doesn't exist.
+func isIOError(err error) bool {
+	err = errors.Cause(err)
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case syscall.EIO, syscall.ENOSPC, syscall.EROFS, syscall.EDQUOT:
+		return true
+	}
+	return false
+}
+
+// quarantineLogDirs moves aside the partition dirs whose metadata is
+// unreadable or is for a different partition than their name, so their data
+// isn't served as another partition's. The broker's other dirs don't have
+// metadata and are left alone. A log dir that can't be read is taken offline.
+func (b *Broker) quarantineLogDirs() error {
+	for _, logDir := range b.logDirs() {
+		files, err := ioutil.ReadDir(logDir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			b.failLogDir(logDir, err)
+			continue
+		}
+		for _, file := range files {
+			if !file.IsDir() || strings.HasSuffix(file.Name(), quarantineSuffix) {
+				continue
+			}
+			dir := filepath.Join(logDir, file.Name())
+			m, err := readPartitionMetadata(dir)
+			if err == nil && (m == nil || logDirName(m.Topic, m.Partition) == file.Name()) {
+				continue
+			}
+			quarantined := fmt.Sprintf("%s.%d%s", dir, time.Now().UnixNano(), quarantineSuffix)
+			b.logger.Error("quarantining log dir", log.String("dir", dir), log.String("quarantined dir", quarantined), log.Any("metadata", m), log.Error("error", err))
+			if err := os.Rename(dir, quarantined); err != nil {
+				return errors.Wrap(err, "rename dir failed")
+			}
+		}
+	}
+	return nil
+}
+
+// lockDirs locks the data dir and log dirs, failing if another process holds
+// any of their locks.
+func (b *Broker) lockDirs() error {
+	dirs := b.logDirs()
+	if b.config.DataDir != "" {
+		dirs = append([]string{b.config.DataDir}, dirs...)
+	}
+	locked := make(map[string]bool)
+	for _, dir := range dirs {
+		if locked[dir] {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.unlockDirs()
+			return errors.Wrap(err, "mkdir failed")
+		}
+		lock, err := commitlog.Lock(filepath.Join(dir, commitlog.LockFileName))
+		if err != nil {
+			b.unlockDirs()
+			return err
+		}
+		locked[dir] = true
+		b.dirLocks = append(b.dirLocks, lock)
+	}
+	return nil
+}
+
+func (b *Broker) unlockDirs() {
+	for _, lock := range b.dirLocks {
+		if err := lock.Unlock(); err != nil {
+			b.logger.Error("failed to unlock dir", log.Error("error", err))
+		}
+	}
+	b.dirLocks = nil
+}
+
+// readPartitionMetadata returns the metadata of the log dir, nil if it
+// hasn't any.
+func readPartitionMetadata(dir string) (*partitionMetadata, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, partitionMetadataFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read file failed")
+	}
+	m := new(partitionMetadata)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrap(err, "unmarshal partition metadata failed")
+	}
+	return m, nil
+}
+
+// writePartitionMetadata writes the log dir's metadata to a temporary file
+// and renames it, so a crash can't leave a torn metadata file.
+func writePartitionMetadata(dir string, m partitionMetadata) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "marshal partition metadata failed")
+	}
+	path := filepath.Join(dir, partitionMetadataFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Wrap(err, "write file failed")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "rename file failed")
+	}
+	return nil
+}
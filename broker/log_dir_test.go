@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/broker/config"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestLogDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logdir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	b := &Broker{config: &config.Config{DataDir: dir}, logger: log.New()}
+
+	// topics' partitions with the same id get their own dirs
+	got, err := b.logDir("the-topic", 0)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "the-topic-0"), got)
+	got, err = b.logDir("another-topic", 0)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "another-topic-0"), got)
+	got, err = b.logDir("the-topic", 0)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "the-topic-0"), got)
+
+	// nor can a topic's name put its dir outside the log dirs
+	for _, topic := range []string{"", ".", "..", "../the-topic", "the/topic", strings.Repeat("t", maxTopicNameLength+1)} {
+		_, err = b.logDir(topic, 0)
+		require.Equal(t, ErrInvalidTopicName, err, topic)
+	}
+	require.True(t, validTopicName("The_topic.1-"))
+
+	// a dir whose metadata is for another partition isn't used
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "the-topic-1"), 0755))
+	require.NoError(t, writePartitionMetadata(filepath.Join(dir, "the-topic-1"), partitionMetadata{Topic: "the-topic", Partition: 2}))
+	_, err = b.logDir("the-topic", 1)
+	require.Equal(t, ErrLogDirMismatch, err)
+
+	// and is quarantined on startup, along with unreadable metadata
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bad-topic-0"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "bad-topic-0", partitionMetadataFile), []byte("{"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "raft"), 0755))
+	require.NoError(t, b.quarantineLogDirs())
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names, quarantined []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), quarantineSuffix) {
+			quarantined = append(quarantined, file.Name())
+		} else {
+			names = append(names, file.Name())
+		}
+	}
+	require.Equal(t, []string{"another-topic-0", "raft", "the-topic-0"}, names)
+	require.Equal(t, 2, len(quarantined))
+}
+
+func TestLogDirs(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "logdir")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	b := &Broker{config: &config.Config{LogDirs: dirs}, logger: log.New()}
+
+	// partitions are placed on the dir with the fewest
+	for i, dir := range []string{dirs[0], dirs[1], dirs[0]} {
+		got, err := b.logDir("the-topic", int32(i))
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(dir, logDirName("the-topic", int32(i))), got)
+	}
+	got, err := b.logDir("the-topic", 1)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dirs[1], "the-topic-1"), got)
+
+	// an I/O error takes the replica's dir offline and only its replicas
+	replica := &Replica{LogDir: dirs[0]}
+	perr := b.logErr(replica, errors.Wrap(&os.PathError{Op: "write", Path: "x", Err: syscall.EIO}, "log write failed"))
+	require.Equal(t, protocol.ErrKafkaStorageError.Code(), perr.Code())
+	_, err = b.logDir("the-topic", 0)
+	require.Equal(t, ErrLogDirOffline, err)
+	got, err = b.logDir("the-topic", 1)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dirs[1], "the-topic-1"), got)
+	got, err = b.logDir("the-topic", 3)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dirs[1], "the-topic-3"), got)
+
+	// other errors don't
+	perr = b.logErr(&Replica{LogDir: dirs[1]}, errors.New("bad"))
+	require.Equal(t, protocol.ErrUnknown.Code(), perr.Code())
+	require.False(t, b.isLogDirOffline(dirs[1]))
+	// including errors from using a file wrong rather than from the disk
+	for _, err := range []error{
+		&os.PathError{Op: "read", Path: "x", Err: os.ErrClosed},
+		&os.PathError{Op: "open", Path: "x", Err: syscall.ENOENT},
+		&os.LinkError{Op: "rename", Old: "x", New: "y", Err: syscall.ENOENT},
+	} {
+		perr = b.logErr(&Replica{LogDir: dirs[1]}, errors.Wrap(err, "log read failed"))
+		require.Equal(t, protocol.ErrUnknown.Code(), perr.Code())
+		require.False(t, b.isLogDirOffline(dirs[1]))
+	}
+	for _, errno := range []syscall.Errno{syscall.EIO, syscall.ENOSPC, syscall.EROFS, syscall.EDQUOT} {
+		require.True(t, isIOError(&os.SyscallError{Syscall: "fsync", Err: errno}))
+	}
+}
+
+func TestLockDirs(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "logdir")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	conf := &config.Config{DataDir: dirs[0], LogDirs: dirs}
+	b1 := &Broker{config: conf, logger: log.New()}
+	require.NoError(t, b1.lockDirs())
+
+	// another broker can't use the dirs until the first's done with them
+	b2 := &Broker{config: &config.Config{DataDir: dirs[1]}, logger: log.New()}
+	err := b2.lockDirs()
+	require.Error(t, err)
+	require.Equal(t, commitlog.ErrLocked, errors.Cause(err))
+	b1.unlockDirs()
+	require.NoError(t, b2.lockDirs())
+	b2.unlockDirs()
+}
@@ -43,6 +43,19 @@ func (rl *replicaLookup) Replica(topic string, partition int32) (*Replica, error
 	return r, nil
 }
 
+// Replicas returns all the replicas.
+func (rl *replicaLookup) Replicas() []*Replica {
+	rl.lock.RLock()
+	defer rl.lock.RUnlock()
+	var replicas []*Replica
+	for _, t := range rl.replica {
+		for _, replica := range t {
+			replicas = append(replicas, replica)
+		}
+	}
+	return replicas
+}
+
 func (rl *replicaLookup) RemoveReplica(replica *Replica) {
 	rl.lock.Lock()
 	defer rl.lock.Unlock()
@@ -2,12 +2,21 @@ package broker
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/commitlog"
 	"github.com/travisjeffery/jocko/log"
 	"github.com/travisjeffery/jocko/protocol"
 )
 
+const (
+	defaultReplicaMinBytes      = 1
+	defaultReplicaMaxWaitTime   = 500
+	defaultReplicaFetchMaxBytes = 1024 * 1024
+)
+
 // Replicator fetches from the partition's leader producing to itself the follower, thereby replicating the partition.
 type Replicator struct {
 	config              ReplicatorConfig
@@ -22,47 +31,78 @@ type Replicator struct {
 	msgs                chan []byte
 	done                chan struct{}
 	leader              jocko.Client
+	// wg waits for the fetching and appending goroutines to exit.
+	wg sync.WaitGroup
 }
 
 type ReplicatorConfig struct {
+	// MinBytes and MaxWaitTime, in milliseconds, are how much the leader
+	// waits to be appended before answering the replicator's fetches, so
+	// it isn't fetching in a busy loop. They default to 1 byte and 500ms.
 	MinBytes    int32
 	MaxWaitTime int32
+	// FetchMaxBytes is the most the replicator fetches at once, though an
+	// entry bigger than it is fetched by itself. It defaults to 1MiB.
+	FetchMaxBytes int32
+	// OnAppendError is called if appending to the replica's log fails, the
+	// replicator stops appending after it.
+	OnAppendError func(error)
 }
 
 // NewReplicator returns a new replicator instance.
 func NewReplicator(config ReplicatorConfig, replica *Replica, leader jocko.Client, logger log.Logger) *Replicator {
+	if config.MinBytes == 0 {
+		config.MinBytes = defaultReplicaMinBytes
+	}
+	if config.MaxWaitTime == 0 {
+		config.MaxWaitTime = defaultReplicaMaxWaitTime
+	}
+	if config.FetchMaxBytes == 0 {
+		config.FetchMaxBytes = defaultReplicaFetchMaxBytes
+	}
 	r := &Replicator{
-		config:   config,
-		logger:   logger,
-		replica:  replica,
-		clientID: fmt.Sprintf("Replicator-%d", replica.BrokerID),
-		leader:   leader,
-		done:     make(chan struct{}, 2),
-		msgs:     make(chan []byte, 2),
+		config:      config,
+		logger:      logger,
+		replica:     replica,
+		clientID:    fmt.Sprintf("Replicator-%d", replica.BrokerID),
+		minBytes:    config.MinBytes,
+		fetchSize:   config.FetchMaxBytes,
+		maxWaitTime: config.MaxWaitTime,
+		// the replica's log can have entries already, as when it's
+		// reloaded after a restart, it follows on from them
+		offset: replica.Log.NewestOffset(),
+		leader: leader,
+		done:   make(chan struct{}, 2),
+		msgs:   make(chan []byte, 2),
 	}
 	return r
 }
 
 func (r *Replicator) Replicate() {
+	r.wg.Add(2)
 	go r.fetchMessages()
 	go r.appendMessages()
 }
 
 func (r *Replicator) fetchMessages() {
+	defer r.wg.Done()
 	for {
 		select {
 		case <-r.done:
 			return
 		default:
 			fetchRequest := &protocol.FetchRequest{
+				APIVersion:  4,
 				ReplicaID:   r.replica.BrokerID,
 				MaxWaitTime: r.maxWaitTime,
 				MinBytes:    r.minBytes,
+				MaxBytes:    r.fetchSize,
 				Topics: []*protocol.FetchTopic{{
 					Topic: r.replica.Partition.Topic,
 					Partitions: []*protocol.FetchPartition{{
 						Partition:   r.replica.Partition.ID,
 						FetchOffset: r.offset,
+						MaxBytes:    r.fetchSize,
 					}},
 				}},
 			}
@@ -70,23 +110,69 @@ func (r *Replicator) fetchMessages() {
 			// TODO: probably shouldn't panic. just let this replica fall out of ISR.
 			if err != nil {
 				r.logger.Error("failed to fetch messages", log.Error("error", err))
+				if !r.backoff() {
+					return
+				}
 				continue
 			}
+			var failed bool
 			for _, resp := range fetchResponse.Responses {
 				for _, p := range resp.PartitionResponses {
-					offset := int64(protocol.Encoding.Uint64(p.RecordSet[:8])) + 1
+					if p.ErrorCode != protocol.ErrNone.Code() {
+						failed = true
+						continue
+					}
+					// the follower's replicated up to the leader's high
+					// watermark, as far as it's appended
+					hw := r.replica.Log.NewestOffset()
+					if p.HighWatermark < hw {
+						hw = p.HighWatermark
+					}
+					r.replica.SetHighWatermark(hw)
+					// the leader's max wait time passed without an append,
+					// or max bytes cut the record set's only entry short
+					entries := commitlog.Entries(p.RecordSet)
+					if len(entries) == 0 {
+						continue
+					}
+					// a partial entry at the end is fetched again
+					var end int
+					for _, e := range entries {
+						end += len(e)
+					}
+					offset := entries[len(entries)-1].LastOffset() + 1
 					if offset > r.offset {
-						r.msgs <- p.RecordSet
+						select {
+						case r.msgs <- p.RecordSet[:end]:
+						case <-r.done:
+							return
+						}
 						r.highwaterMarkOffset = p.HighWatermark
 						r.offset = offset
 					}
 				}
 			}
+			if failed && !r.backoff() {
+				return
+			}
 		}
 	}
 }
 
+// backoff waits the max wait time after a failed fetch before the next one,
+// so the replicator isn't fetching in a busy loop while the leader's failing.
+// It returns false if the replicator's closed in the meantime.
+func (r *Replicator) backoff() bool {
+	select {
+	case <-time.After(time.Duration(r.maxWaitTime) * time.Millisecond):
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
 func (r *Replicator) appendMessages() {
+	defer r.wg.Done()
 	for {
 		select {
 		case <-r.done:
@@ -94,14 +180,21 @@ func (r *Replicator) appendMessages() {
 		case msg := <-r.msgs:
 			_, err := r.replica.Log.Append(msg)
 			if err != nil {
-				panic(err)
+				r.logger.Error("failed to append messages", log.Error("error", err))
+				if r.config.OnAppendError != nil {
+					r.config.OnAppendError(err)
+				}
+				return
 			}
 		}
 	}
 }
 
-// Close the replicator object when we are no longer following
+// Close the replicator object when we are no longer following. It waits for
+// the replicator to stop appending, so the replica's log can be truncated
+// after it.
 func (r *Replicator) Close() error {
 	close(r.done)
+	r.wg.Wait()
 	return nil
 }
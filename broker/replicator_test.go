@@ -2,16 +2,25 @@ package broker_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/jocko/broker"
 	"github.com/travisjeffery/jocko/broker/structs"
+	"github.com/travisjeffery/jocko/commitlog"
 	"github.com/travisjeffery/jocko/log"
 	"github.com/travisjeffery/jocko/mock"
+	"github.com/travisjeffery/jocko/protocol"
 	"github.com/travisjeffery/jocko/testutil"
 )
 
@@ -54,6 +63,37 @@ func TestBroker_Replicate(t *testing.T) {
 	require.NoError(t, replicator.Close())
 }
 
+func TestBroker_ReplicatorCloseWaits(t *testing.T) {
+	c := newCommitLog()
+	var once sync.Once
+	appending := make(chan struct{})
+	release := make(chan struct{})
+	var appended int32
+	c.AppendFunc = func(b []byte) (int64, error) {
+		once.Do(func() { close(appending) })
+		<-release
+		atomic.StoreInt32(&appended, 1)
+		return 0, nil
+	}
+	replica := &broker.Replica{
+		Partition: structs.Partition{Topic: "test", ID: 0, Leader: 0, AR: []int32{0, 1}},
+		BrokerID:  1,
+		Log:       c,
+	}
+	replicator := broker.NewReplicator(broker.ReplicatorConfig{}, replica, mock.NewClient(4), log.New())
+	replicator.Replicate()
+
+	// closing waits for the append in progress, so the log can be
+	// truncated after it
+	<-appending
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	require.NoError(t, replicator.Close())
+	require.Equal(t, int32(1), atomic.LoadInt32(&appended))
+}
+
 type commitLog struct {
 	*mock.CommitLog
 	sync.RWMutex
@@ -83,7 +123,7 @@ func newCommitLog() *commitLog {
 		NewReaderFunc: func(offset int64, maxBytes int32) (io.Reader, error) {
 			return nil, nil
 		},
-		TruncateFunc: func(int64) error {
+		TruncateToFunc: func(int64) error {
 			return nil
 		},
 
@@ -97,3 +137,142 @@ func newCommitLog() *commitLog {
 	}
 	return c
 }
+
+func TestBroker_ReplicateReloaded(t *testing.T) {
+	newLog := func(name string) (*commitlog.CommitLog, commitlog.Options) {
+		opts := commitlog.Options{
+			Path:            filepath.Join(os.TempDir(), fmt.Sprintf("replicatortest-%s-%d", name, rand.Int63())),
+			MaxSegmentBytes: 1024,
+			MaxLogBytes:     -1,
+		}
+		l, err := commitlog.New(opts)
+		require.NoError(t, err)
+		return l, opts
+	}
+	appendValue := func(l *commitlog.CommitLog, value string) {
+		ms, err := protocol.Encode(&protocol.MessageSet{Messages: []*protocol.Message{{Value: []byte(value)}}})
+		require.NoError(t, err)
+		_, err = l.Append(ms)
+		require.NoError(t, err)
+	}
+
+	leader, leaderOpts := newLog("leader")
+	defer os.RemoveAll(leaderOpts.Path)
+	defer leader.Close()
+	follower, followerOpts := newLog("follower")
+	defer os.RemoveAll(followerOpts.Path)
+	for _, v := range []string{"zero", "one", "two", "three"} {
+		appendValue(leader, v)
+	}
+	// the follower replicated the first two before it restarted
+	for _, v := range []string{"zero", "one"} {
+		appendValue(follower, v)
+	}
+	require.NoError(t, follower.Close())
+	follower, err := commitlog.New(followerOpts)
+	require.NoError(t, err)
+	defer follower.Close()
+
+	replica := &broker.Replica{
+		Partition: structs.Partition{Topic: "test", ID: 0, Leader: 0, AR: []int32{0, 1}},
+		BrokerID:  1,
+		Log:       follower,
+	}
+	client := &logClient{log: leader}
+	replicator := broker.NewReplicator(broker.ReplicatorConfig{
+		MaxWaitTime:   10,
+		FetchMaxBytes: 2048,
+	}, replica, client, log.New())
+	replicator.Replicate()
+	defer replicator.Close()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return follower.NewestOffset() >= 4, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	// give a duplicate fetch time to be appended
+	time.Sleep(50 * time.Millisecond)
+
+	var values []string
+	require.NoError(t, follower.Scan(0, func(r commitlog.Record) error {
+		values = append(values, string(r.Value))
+		return nil
+	}))
+	require.Equal(t, []string{"zero", "one", "two", "three"}, values)
+	// the replicator fetches up to its max bytes at once
+	require.Equal(t, int32(2048), atomic.LoadInt32(&client.maxBytes))
+}
+
+func TestBroker_ReplicateBackoff(t *testing.T) {
+	for _, partitionErr := range []bool{false, true} {
+		replica := &broker.Replica{
+			Partition: structs.Partition{Topic: "test", ID: 0, Leader: 0, AR: []int32{0, 1}},
+			BrokerID:  1,
+			Log:       newCommitLog(),
+		}
+		client := &errClient{partitionErr: partitionErr}
+		replicator := broker.NewReplicator(broker.ReplicatorConfig{
+			MaxWaitTime: 50,
+		}, replica, client, log.New())
+		replicator.Replicate()
+
+		// failed fetches are retried after the max wait time rather than
+		// straight away
+		time.Sleep(200 * time.Millisecond)
+		require.NoError(t, replicator.Close())
+		fetches := atomic.LoadInt32(&client.fetches)
+		require.True(t, fetches >= 2 && fetches <= 6, "fetches: %d", fetches)
+	}
+}
+
+// errClient is a leader whose fetches fail, with an error or with the
+// partition's error code.
+type errClient struct {
+	mock.Client
+	partitionErr bool
+	fetches      int32
+}
+
+func (c *errClient) FetchMessages(clientID string, req *protocol.FetchRequest) (*protocol.FetchResponses, error) {
+	atomic.AddInt32(&c.fetches, 1)
+	if !c.partitionErr {
+		return nil, errors.New("connection refused")
+	}
+	return &protocol.FetchResponses{Responses: []*protocol.FetchResponse{{
+		Topic: req.Topics[0].Topic,
+		PartitionResponses: []*protocol.FetchPartitionResponse{{
+			Partition: req.Topics[0].Partitions[0].Partition,
+			ErrorCode: protocol.ErrNotLeaderForPartition.Code(),
+		}},
+	}}}, nil
+}
+
+// logClient is a leader that fetches from its log. maxBytes is the partition
+// max bytes of the last fetch.
+type logClient struct {
+	mock.Client
+	log      *commitlog.CommitLog
+	maxBytes int32
+}
+
+func (c *logClient) FetchMessages(clientID string, req *protocol.FetchRequest) (*protocol.FetchResponses, error) {
+	p := req.Topics[0].Partitions[0]
+	atomic.StoreInt32(&c.maxBytes, p.MaxBytes)
+	resp := &protocol.FetchPartitionResponse{Partition: p.Partition, HighWatermark: c.log.NewestOffset()}
+	if p.FetchOffset < c.log.NewestOffset() {
+		r, err := c.log.NewReader(p.FetchOffset, p.MaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		if resp.RecordSet, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+	} else {
+		time.Sleep(time.Duration(req.MaxWaitTime) * time.Millisecond)
+	}
+	return &protocol.FetchResponses{Responses: []*protocol.FetchResponse{{
+		Topic:              req.Topics[0].Topic,
+		PartitionResponses: []*protocol.FetchPartitionResponse{resp},
+	}}}, nil
+}
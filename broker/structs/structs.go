@@ -15,6 +15,8 @@ const (
 	DeregisterTopicRequestType                 = 3
 	RegisterPartitionRequestType               = 4
 	DeregisterPartitionRequestType             = 5
+	CommitOffsetsRequestType                   = 6
+	ExpireOffsetsRequestType                   = 7
 )
 
 type RegisterNodeRequest struct {
@@ -41,6 +43,16 @@ type DeregisterPartitionRequest struct {
 	Partition Partition
 }
 
+type CommitOffsetsRequest struct {
+	Offsets []Offset
+}
+
+// ExpireOffsetsRequest deletes the offsets that expire at or before Time, in
+// ms. The leader sets it so every server expires the same offsets.
+type ExpireOffsetsRequest struct {
+	Time int64
+}
+
 // msgpackHandle is a shared handle for encoding/decoding of structs
 var msgpackHandle = &codec.MsgpackHandle{}
 
@@ -101,6 +113,9 @@ type Topic struct {
 	Topic string
 	// Partitions is a map of partition IDs to slice of replicas IDs.
 	Partitions map[int32][]int32
+	// Config is the topic's config the topic was created with, like
+	// compression.type.
+	Config map[string]string
 
 	RaftIndex
 }
@@ -125,3 +140,18 @@ type Partition struct {
 
 	RaftIndex
 }
+
+// Offset is a consumer group's committed offset for a partition.
+type Offset struct {
+	Group     string
+	Topic     string
+	Partition int32
+	Offset    int64
+	// Metadata is what the consumer committed along with the offset.
+	Metadata string
+	// CommitTimestamp and ExpireTimestamp are in ms.
+	CommitTimestamp int64
+	ExpireTimestamp int64
+
+	RaftIndex
+}
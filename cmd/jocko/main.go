@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/spf13/cobra"
 	gracefully "github.com/tj/go-gracefully"
 	"github.com/travisjeffery/jocko/broker"
 	"github.com/travisjeffery/jocko/broker/config"
+	"github.com/travisjeffery/jocko/commitlog"
 	"github.com/travisjeffery/jocko/log"
+	"github.com/travisjeffery/jocko/prometheus"
 	"github.com/travisjeffery/jocko/protocol"
 	"github.com/travisjeffery/jocko/server"
 )
@@ -25,10 +28,10 @@ var (
 	}
 
 	brokerCfg = struct {
-		ID      int32
-		DataDir string
-		Broker  *config.Config
-		Server  *server.Config
+		ID       int32
+		DataDirs []string
+		Broker   *config.Config
+		Server   *server.Config
 	}{
 		Broker: config.DefaultConfig(),
 		Server: &server.Config{},
@@ -45,13 +48,21 @@ var (
 func init() {
 	brokerCmd := &cobra.Command{Use: "broker", Short: "Run a Jocko broker", Run: run}
 	brokerCmd.Flags().StringVar(&brokerCfg.Broker.RaftAddr, "raft-addr", "127.0.0.1:9093", "Address for Raft to bind and advertise on")
-	brokerCmd.Flags().StringVar(&brokerCfg.DataDir, "data-dir", "/tmp/jocko", "A comma separated list of directories under which to store log files")
+	brokerCmd.Flags().StringSliceVar(&brokerCfg.DataDirs, "data-dir", []string{"/tmp/jocko"}, "A comma separated list of directories under which to store log files")
 	brokerCmd.Flags().StringVar(&brokerCfg.Broker.Addr, "broker-addr", "0.0.0.0:9092", "Address for broker to bind on")
 	brokerCmd.Flags().StringVar(&brokerCfg.Broker.SerfLANConfig.MemberlistConfig.BindAddr, "serf-addr", "0.0.0.0:9094", "Address for Serf to bind on") // TODO: can set addr alone or need to set bind port separately?
 	brokerCmd.Flags().StringVar(&brokerCfg.Server.HTTPAddr, "http-addr", ":9095", "Address for HTTP handlers to serve Prometheus metrics on")
 	brokerCmd.Flags().StringSliceVar(&brokerCfg.Broker.StartJoinAddrsLAN, "join", nil, "Address of an broker serf to join at start time. Can be specified multiple times.")
 	brokerCmd.Flags().StringSliceVar(&brokerCfg.Broker.StartJoinAddrsWAN, "join-wan", nil, "Address of an broker serf to join -wan at start time. Can be specified multiple times.")
 	brokerCmd.Flags().Int32Var(&brokerCfg.ID, "id", 0, "Broker ID")
+	brokerCmd.Flags().Int64Var(&brokerCfg.Broker.LogSegmentBytes, "log-segment-bytes", 1024*1024*1024, "Size log segments are rolled at")
+	brokerCmd.Flags().DurationVar(&brokerCfg.Broker.LogSegmentAge, "log-segment-age", 7*24*time.Hour, "Age log segments are rolled at if they haven't filled up")
+	brokerCmd.Flags().Int64Var(&brokerCfg.Broker.LogRetentionBytes, "log-retention-bytes", -1, "Bytes of partitions' logs kept by default, -1 keeps them regardless of size")
+	brokerCmd.Flags().DurationVar(&brokerCfg.Broker.LogRetentionAge, "log-retention-age", 7*24*time.Hour, "How long partitions' messages are kept by default, 0 keeps them regardless of age")
+	brokerCmd.Flags().BoolVar(&brokerCfg.Broker.LogPreallocate, "log-preallocate", false, "Preallocate new log segments' files")
+	brokerCmd.Flags().Int32Var(&brokerCfg.Broker.ReplicaFetchMaxBytes, "replica-fetch-max-bytes", 1024*1024, "Most followers fetch from a partition's leader at once")
+	brokerCmd.Flags().DurationVar(&brokerCfg.Broker.OffsetsRetention, "offsets-retention", 24*time.Hour, "How long consumer groups' committed offsets are kept by default")
+	brokerCmd.Flags().DurationVar(&brokerCfg.Broker.OffsetsRetentionCheckInterval, "offsets-retention-check-interval", 10*time.Minute, "How often expired consumer group offsets are deleted")
 
 	topicCmd := &cobra.Command{Use: "topic", Short: "Manage topics"}
 	createTopicCmd := &cobra.Command{Use: "create", Short: "Create a topic", Run: createTopic}
@@ -60,9 +71,14 @@ func init() {
 	createTopicCmd.Flags().Int32Var(&topicCfg.Partitions, "partitions", 1, "Number of partitions")
 	createTopicCmd.Flags().IntVar(&topicCfg.ReplicationFactor, "replication-factor", 1, "Replication factor")
 
+	logCmd := &cobra.Command{Use: "log", Short: "Inspect logs"}
+	dumpLogCmd := &cobra.Command{Use: "dump [log dir or segment log file]...", Short: "Dump log segments and verify their indexes", Run: dumpLog}
+
 	cli.AddCommand(brokerCmd)
 	cli.AddCommand(topicCmd)
 	topicCmd.AddCommand(createTopicCmd)
+	cli.AddCommand(logCmd)
+	logCmd.AddCommand(dumpLogCmd)
 }
 
 func run(cmd *cobra.Command, args []string) {
@@ -75,13 +91,25 @@ func run(cmd *cobra.Command, args []string) {
 		log.String("raft addr", brokerCfg.Broker.RaftAddr),
 	)
 
+	if len(brokerCfg.DataDirs) == 0 {
+		fmt.Fprintf(os.Stderr, "error starting broker: no data dir\n")
+		os.Exit(1)
+	}
+	// the broker's own state is kept in the first data dir, partitions are
+	// spread across all of them
+	brokerCfg.Broker.DataDir = brokerCfg.DataDirs[0]
+	brokerCfg.Broker.LogDirs = brokerCfg.DataDirs
+
+	metrics := prometheus.NewMetrics()
+	brokerCfg.Broker.Metrics = metrics
+
 	broker, err := broker.New(brokerCfg.Broker, logger)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error starting broker: %v\n", err)
 		os.Exit(1)
 	}
 
-	srv := server.New(brokerCfg.Server, broker, nil, logger)
+	srv := server.New(brokerCfg.Server, broker, metrics, logger)
 	if err := srv.Start(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "error starting server: %v\n", err)
 		os.Exit(1)
@@ -136,6 +164,47 @@ func createTopic(cmd *cobra.Command, args []string) {
 	fmt.Printf("created topic: %v\n", topicCfg.Topic)
 }
 
+func dumpLog(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "error: no log dirs or segment log files given\n")
+		os.Exit(1)
+	}
+	var paths []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading log: %v\n", err)
+			os.Exit(1)
+		}
+		if !fi.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		// the segments' names sort by their base offsets
+		logs, err := filepath.Glob(filepath.Join(arg, "*"+commitlog.LogFileSuffix))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading log dir: %v\n", err)
+			os.Exit(1)
+		}
+		paths = append(paths, logs...)
+	}
+	corrupt := false
+	for _, path := range paths {
+		valid, err := commitlog.DumpSegment(os.Stdout, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error dumping segment: %v\n", err)
+			os.Exit(1)
+		}
+		if !valid {
+			corrupt = true
+		}
+	}
+	if corrupt {
+		fmt.Fprintf(os.Stderr, "error: log is corrupt\n")
+		os.Exit(1)
+	}
+}
+
 func main() {
 	cli.Execute()
 }
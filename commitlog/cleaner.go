@@ -1,45 +1,221 @@
 package commitlog
 
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 type Cleaner interface {
 	Clean([]*Segment) ([]*Segment, error)
 }
 
+// DeleteCleaner deletes the oldest segments once the log is over its byte
+// retention or once a segment's newest message is older than the age
+// retention, by its timestamp, or by when it was appended if the segment's
+// messages don't have timestamps. Either limit can be disabled: bytes with
+// zero or less, like -1, age with 0.
 type DeleteCleaner struct {
 	Retention struct {
 		Bytes int64
+		Age   time.Duration
 	}
 }
 
-func NewDeleteCleaner(bytes int64) *DeleteCleaner {
+func NewDeleteCleaner(bytes int64, age time.Duration) *DeleteCleaner {
 	c := &DeleteCleaner{}
 	c.Retention.Bytes = bytes
+	c.Retention.Age = age
 	return c
 }
 
 func (c *DeleteCleaner) Clean(segments []*Segment) ([]*Segment, error) {
-	if len(segments) == 0 || c.Retention.Bytes == -1 {
+	if len(segments) == 0 || (c.Retention.Bytes <= 0 && c.Retention.Age == 0) {
 		return segments, nil
 	}
-	cleanedSegments := []*Segment{segments[len(segments)-1]}
-	totalBytes := cleanedSegments[0].Position
-	if len(segments) > 1 {
-		var i int
-		for i = len(segments) - 2; i > -1; i-- {
-			s := segments[i]
-			totalBytes += s.Position
-			if totalBytes > c.Retention.Bytes {
-				break
+	var totalBytes int64
+	for _, s := range segments {
+		totalBytes += s.Position
+	}
+	var deadline time.Time
+	if c.Retention.Age > 0 {
+		deadline = time.Now().Add(-c.Retention.Age)
+	}
+	// never delete the active segment, it's the last one
+	var i int
+	for i = 0; i < len(segments)-1; i++ {
+		s := segments[i]
+		overBytes := c.Retention.Bytes > 0 && totalBytes > c.Retention.Bytes
+		overAge := false
+		if !deadline.IsZero() {
+			newest, err := s.newestTime()
+			if err != nil {
+				return nil, err
 			}
-			cleanedSegments = append([]*Segment{s}, cleanedSegments...)
+			overAge = newest.Before(deadline)
+		}
+		if !overBytes && !overAge {
+			break
+		}
+		totalBytes -= s.Position
+	}
+	for _, s := range segments[:i] {
+		if err := s.delete(); err != nil {
+			return nil, err
 		}
-		if i > -1 {
-			for ; i != 0; i-- {
-				s := segments[i]
-				if err := s.Delete(); err != nil {
-					return nil, err
+	}
+	return segments[i:], nil
+}
+
+// CompactCleaner rewrites the log's closed segments to keep only the latest
+// message for each key. Messages without a key are always kept. A tombstone,
+// a message with a null value, is kept as the key's latest message until its
+// segment is older than the tombstone retention, so consumers have time to
+// see the delete.
+type CompactCleaner struct {
+	Retention struct {
+		Tombstones time.Duration
+	}
+}
+
+func NewCompactCleaner(tombstones time.Duration) *CompactCleaner {
+	c := &CompactCleaner{}
+	c.Retention.Tombstones = tombstones
+	return c
+}
+
+func (c *CompactCleaner) Clean(segments []*Segment) ([]*Segment, error) {
+	if len(segments) <= 1 {
+		return segments, nil
+	}
+	// the latest offset of each key across the whole log, including the
+	// active segment, so anything it supersedes can be dropped
+	latest := make(map[string]int64)
+	for _, s := range segments {
+		err := s.forEachEntry(func(_ int64, ms MessageSet) error {
+			err := ms.Records(func(r Record) error {
+				if r.Key != nil {
+					latest[string(r.Key)] = r.Offset
 				}
+				return nil
+			})
+			// entries whose records can't be read are kept as they are
+			if err == ErrMalformedEntry || err == ErrCompressedEntry {
+				return nil
 			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	deadline := time.Now().Add(-c.Retention.Tombstones)
+	var cleaned []*Segment
+	// never compact the active segment, it's the last one
+	for _, s := range segments[:len(segments)-1] {
+		s, err := c.compact(s, latest, deadline)
+		if err != nil {
+			return nil, err
+		}
+		if s != nil {
+			cleaned = append(cleaned, s)
+		}
+	}
+	return append(cleaned, segments[len(segments)-1]), nil
+}
+
+// compact rewrites the segment without its superseded messages. It returns
+// the reopened segment, or nil if no messages were left and the segment was
+// deleted.
+func (c *CompactCleaner) compact(s *Segment, latest map[string]int64, deadline time.Time) (*Segment, error) {
+	modTime, err := s.ModTime()
+	if err != nil {
+		return nil, err
+	}
+	expired := modTime.Before(deadline)
+	opts := s.segmentOptions
+	opts.suffix = cleanedSuffix
+	cleaned, err := newSegment(s.BaseOffset, opts, true)
+	if err != nil {
+		return nil, err
+	}
+	var dropped bool
+	err = s.forEachEntry(func(_ int64, ms MessageSet) error {
+		if superseded(ms, latest, expired) {
+			dropped = true
+			return nil
+		}
+		position := cleaned.Position
+		if _, err := cleaned.Write(ms); err != nil {
+			return err
 		}
+		return cleaned.indexEntry(ms, position)
+	})
+	if err != nil || !dropped {
+		if cerr := cleaned.Delete(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if cleaned.Position == 0 {
+		if err := cleaned.Delete(); err != nil {
+			return nil, err
+		}
+		return nil, s.delete()
+	}
+	if err := cleaned.Close(); err != nil {
+		return nil, err
+	}
+	if err := swap(s); err != nil {
+		return nil, err
 	}
-	return cleanedSegments, nil
+	// keep the original modification time so age and tombstone retention
+	// aren't reset by compaction
+	if err := os.Chtimes(s.log.Name(), modTime, modTime); err != nil {
+		return nil, errors.Wrap(err, "chtimes failed")
+	}
+	return newSegment(s.BaseOffset, s.segmentOptions, true)
+}
+
+// swap replaces the segment's files with the files of the segment cleaned
+// from it. The cleaned files are renamed with the swap suffix, the log last,
+// then the segment's deleted through the log's deleter, so readers that have
+// it open can finish, and the swap files take its names. If the log crashes
+// part way the swap's finished when it's reopened if the swap log exists and
+// dropped if it doesn't.
+func swap(s *Segment) error {
+	names := s.fileNames()
+	// the log's renamed last
+	names = append(names[1:], names[0])
+	for _, name := range names {
+		if err := os.Rename(name+cleanedSuffix, name+swapSuffix); err != nil {
+			return errors.Wrap(err, "rename file failed")
+		}
+	}
+	if err := s.delete(); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Rename(name+swapSuffix, name); err != nil {
+			return errors.Wrap(err, "rename file failed")
+		}
+	}
+	return nil
+}
+
+// superseded returns whether each of the entry's records has a later record
+// with its key, or is a tombstone that's expired, so the entry can be dropped.
+// A record batch is kept whole if any of its records are still needed.
+func superseded(ms MessageSet, latest map[string]int64, expired bool) bool {
+	err := ms.Records(func(r Record) error {
+		if r.Key == nil || (latest[string(r.Key)] == r.Offset && !(r.Value == nil && expired)) {
+			return ErrStopScan
+		}
+		return nil
+	})
+	return err == nil
 }
@@ -0,0 +1,149 @@
+package commitlog_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestCompactCleaner(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		Cleaner:         commitlog.NewCompactCleaner(time.Hour),
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	appends := []struct {
+		key, value []byte
+	}{
+		{[]byte("k1"), []byte("a")},
+		{[]byte("k2"), []byte("b")},
+		{[]byte("k1"), []byte("c")},
+		{[]byte("k2"), nil},
+		{nil, []byte("d")},
+		{[]byte("k3"), []byte("e")},
+	}
+	for _, a := range appends {
+		appendMessage(t, l, a.key, a.value)
+	}
+
+	// k1=a and k2=b were superseded and their segments deleted, the
+	// tombstone for k2 is kept because it's within retention
+	require.Equal(t, []int64{2, 3, 4, 5}, offsets(t, l))
+	require.Equal(t, int64(2), l.OldestOffset())
+	require.Equal(t, int64(6), l.NewestOffset())
+
+	// once the tombstone's segment is past retention it's removed too
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(path, fmt.Sprintf("%020d.log", 3)), old, old)
+	require.NoError(t, err)
+	appendMessage(t, l, []byte("k3"), []byte("f"))
+	require.Equal(t, []int64{2, 4, 5, 6}, offsets(t, l))
+
+	// the rewritten segments are reloaded with rebuilt indexes
+	require.NoError(t, l.Close())
+	l, err = commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		Cleaner:         commitlog.NewCompactCleaner(time.Hour),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 4, 5, 6}, offsets(t, l))
+	r, err := l.NewReader(4, 1024)
+	require.NoError(t, err)
+	p, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	ms := commitlog.MessageSet(p)
+	require.Equal(t, int64(4), ms.Offset())
+	require.Equal(t, []byte("d"), commitlog.Message(ms.Payload()).Value())
+}
+
+func TestCompactCleanerSwap(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 60,
+		Cleaner:         commitlog.NewCompactCleaner(time.Hour),
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+
+	for _, kv := range []string{"k1=a", "k2=b", "k3=c", "k1=d", "k2=e", "k4=f"} {
+		appendMessage(t, l, []byte(kv[:2]), []byte(kv[3:]))
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5}, offsets(t, l))
+	// a reader of the segment before it's compacted can still read it
+	// after it's swapped out
+	before, err := l.NewReader(0, 1024)
+	require.NoError(t, err)
+	appendMessage(t, l, []byte("k4"), []byte("g"))
+	require.Equal(t, []int64{2, 3, 4, 5, 6}, offsets(t, l))
+	p, err := ioutil.ReadAll(before)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), commitlog.MessageSet(p).Offset())
+	files, err := ioutil.ReadDir(path)
+	require.NoError(t, err)
+	var deleted int
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".deleted") {
+			deleted++
+		}
+	}
+	require.Equal(t, 3, deleted)
+
+	// a swap that crashed after its log was renamed is finished when the
+	// log's reopened, the segment it replaced can be gone already
+	require.NoError(t, l.Close())
+	name := func(format string, baseOffset int64) string {
+		return filepath.Join(path, fmt.Sprintf(format, baseOffset))
+	}
+	require.NoError(t, os.Rename(name("%020d.log", 0), name("%020d.log", 0)+".swap"))
+	require.NoError(t, os.Rename(name("%020d.timeindex", 0), name("%020d.timeindex", 0)+".swap"))
+	// and one that crashed before is dropped
+	require.NoError(t, ioutil.WriteFile(name("%020d.index", 3)+".swap", []byte("partial"), 0666))
+	require.NoError(t, ioutil.WriteFile(name("%020d.log", 3)+".cleaned", []byte("partial"), 0666))
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	require.Equal(t, []int64{2, 3, 4, 5, 6}, offsets(t, l))
+	files, err = ioutil.ReadDir(path)
+	require.NoError(t, err)
+	for _, file := range files {
+		require.False(t, strings.HasSuffix(file.Name(), ".swap") || strings.HasSuffix(file.Name(), ".cleaned"), file.Name())
+	}
+}
+
+func appendMessage(t *testing.T, l *commitlog.CommitLog, key, value []byte) {
+	b, err := protocol.Encode(&protocol.Message{Key: key, Value: value})
+	require.NoError(t, err)
+	_, err = l.Append(commitlog.NewMessageSet(0, commitlog.NewMessage(b)))
+	require.NoError(t, err)
+}
+
+func offsets(t *testing.T, l *commitlog.CommitLog) []int64 {
+	r, err := l.NewReader(l.OldestOffset(), 1024)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	var offsets []int64
+	for len(b) > 0 {
+		ms := commitlog.MessageSet(b)
+		offsets = append(offsets, ms.Offset())
+		b = b[ms.Size():]
+	}
+	return offsets
+}
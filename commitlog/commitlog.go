@@ -9,8 +9,11 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko"
+	"github.com/travisjeffery/jocko/log"
 )
 
 var (
@@ -19,8 +22,20 @@ var (
 )
 
 const (
-	LogFileSuffix   = ".log"
-	IndexFileSuffix = ".index"
+	LogFileSuffix       = ".log"
+	IndexFileSuffix     = ".index"
+	TimeIndexFileSuffix = ".timeindex"
+
+	// cleanShutdownFile is written when the log is closed and removed when
+	// it's opened, so its presence means the log's indexes can be trusted.
+	cleanShutdownFile = ".clean_shutdown"
+	// recoveryPointFile holds the offset up to which the log is known to be
+	// on disk, segments before it don't need recovering after a crash.
+	recoveryPointFile = "recovery-point"
+
+	defaultMaxSegmentBytes    = 1024 * 1024 * 1024
+	defaultCleanupInterval    = 5 * time.Minute
+	defaultIndexIntervalBytes = 4096
 )
 
 type CommitLog struct {
@@ -30,12 +45,93 @@ type CommitLog struct {
 	mu             sync.RWMutex
 	segments       []*Segment
 	vActiveSegment atomic.Value
+	closeOnce      sync.Once
+	shutdownCh     chan struct{}
+	deleter        *deleter
+	// unflushed is how many messages have been appended since the last
+	// flush.
+	unflushed int64
+	// flushMu guards flushing and recoveryPoint, the offset last written to
+	// the recovery point file.
+	flushMu       sync.Mutex
+	recoveryPoint int64
+	// appended is closed and replaced after each append, to wake the
+	// readers waiting for it.
+	appendedMu sync.Mutex
+	appended   chan struct{}
+	// lock is held on the log's dir while it's open, so another process
+	// can't open it too.
+	lock *FileLock
+	// tierMu serialises uploading segments with deleting them, remote has
+	// the base offsets of the segments in the remote storage and is guarded
+	// by mu.
+	tierMu sync.Mutex
+	remote []int64
+	// fetched has the remote segments downloaded for reading, oldest fetched
+	// first.
+	fetchedMu sync.Mutex
+	fetched   []*Segment
 }
 
 type Options struct {
-	Path            string
+	Path string
+	// MaxSegmentBytes is the size a segment's rolled at. Defaults to 1GB.
 	MaxSegmentBytes int64
-	MaxLogBytes     int64
+	// SegmentMaxAge is how long after its first message was appended a
+	// segment's rolled, even if it isn't full, so it's eligible for retention.
+	// Zero disables rolling by age.
+	SegmentMaxAge time.Duration
+	// Preallocate preallocates new segments' log files to MaxSegmentBytes so
+	// they're less fragmented. Their unused tails are trimmed when they're
+	// rolled or closed.
+	Preallocate bool
+	// MaxLogBytes is how many bytes of the newest segments are kept. Zero or
+	// less, like -1, disables size based retention.
+	MaxLogBytes int64
+	// MaxLogAge is how long segments are kept after their newest message's
+	// timestamp, or after it was appended if it doesn't have one. Zero
+	// disables age based retention.
+	MaxLogAge time.Duration
+	// CleanupInterval is how often the log checks for segments to delete
+	// in the background. Defaults to five minutes.
+	CleanupInterval time.Duration
+	// IndexIntervalBytes is how many bytes are appended between entries in a
+	// segment's offset index. Defaults to 4096, set to 1 to index every
+	// entry.
+	IndexIntervalBytes int64
+	// MaxIndexBytes is the size a segment's indexes are preallocated to, a
+	// segment is rolled when they're full. Defaults to 10MB.
+	MaxIndexBytes int64
+	// FlushMessages is how many messages are appended before the log is
+	// flushed to disk, set to 1 to flush every append. Zero leaves flushing
+	// to the OS.
+	FlushMessages int64
+	// FlushInterval is how often the log is flushed to disk in the
+	// background. Zero disables flushing on an interval.
+	FlushInterval time.Duration
+	// FileDeleteDelay is how long a deleted segment's files are kept before
+	// they're removed, so readers that have the segment open can finish.
+	// Defaults to a minute, set to -1 to remove them straight away.
+	FileDeleteDelay time.Duration
+	// Cleaner cleans up the log's old segments. Defaults to a DeleteCleaner
+	// using MaxLogBytes and MaxLogAge, use a CompactCleaner for compacted
+	// logs.
+	Cleaner Cleaner
+	// RemoteStorage is where closed segments are uploaded to if it's set,
+	// readers of offsets no longer on local disk fetch their segments from
+	// it. Segments are uploaded on the cleanup interval. The cleaner only
+	// deletes local segments, segments are deleted from the remote storage
+	// by MaxLogBytes and MaxLogAge once they're only there, and by
+	// DeleteBefore and TruncateTo.
+	RemoteStorage RemoteStorage
+	// LocalRetentionBytes is how many bytes of the newest uploaded segments
+	// are kept on local disk too, older ones are deleted once they're
+	// uploaded. Zero deletes them straight away, set to -1 to keep them all.
+	LocalRetentionBytes int64
+	// Logger and Metrics are optional, they're used to report recovery
+	// from a crash and flush latency.
+	Logger  log.Logger
+	Metrics *jocko.Metrics
 }
 
 func New(opts Options) (*CommitLog, error) {
@@ -44,24 +140,56 @@ func New(opts Options) (*CommitLog, error) {
 	}
 
 	if opts.MaxSegmentBytes == 0 {
-		// TODO default here
+		opts.MaxSegmentBytes = defaultMaxSegmentBytes
+	}
+
+	if opts.CleanupInterval == 0 {
+		opts.CleanupInterval = defaultCleanupInterval
+	}
+
+	if opts.IndexIntervalBytes == 0 {
+		opts.IndexIntervalBytes = defaultIndexIntervalBytes
+	}
+
+	if opts.FileDeleteDelay == 0 {
+		opts.FileDeleteDelay = defaultFileDeleteDelay
+	}
+
+	if opts.Cleaner == nil {
+		opts.Cleaner = NewDeleteCleaner(opts.MaxLogBytes, opts.MaxLogAge)
 	}
 
 	path, _ := filepath.Abs(opts.Path)
 	l := &CommitLog{
-		Options: opts,
-		name:    filepath.Base(path),
-		cleaner: NewDeleteCleaner(opts.MaxLogBytes),
+		Options:    opts,
+		name:       filepath.Base(path),
+		cleaner:    opts.Cleaner,
+		shutdownCh: make(chan struct{}),
+		deleter:    newDeleter(opts.FileDeleteDelay, opts.Logger),
+		appended:   make(chan struct{}),
 	}
 
 	if err := l.init(); err != nil {
 		return nil, err
 	}
 
+	lock, err := Lock(filepath.Join(l.Path, LockFileName))
+	if err != nil {
+		return nil, err
+	}
+	l.lock = lock
+
 	if err := l.open(); err != nil {
+		lock.Unlock()
 		return nil, err
 	}
 
+	go l.cleanupLoop()
+
+	if l.FlushInterval > 0 {
+		go l.flushLoop()
+	}
+
 	return l, nil
 }
 
@@ -74,16 +202,32 @@ func (l *CommitLog) init() error {
 }
 
 func (l *CommitLog) open() error {
+	if err := l.openRemote(); err != nil {
+		return err
+	}
+	if err := l.finishSwaps(); err != nil {
+		return err
+	}
 	files, err := ioutil.ReadDir(l.Path)
 	if err != nil {
 		return errors.Wrap(err, "read dir failed")
 	}
+	var baseOffsets []int64
 	for _, file := range files {
+		// a leftover from a compaction that didn't finish, the original
+		// segment is still intact, or from a deleted segment that wasn't
+		// removed
+		if strings.HasSuffix(file.Name(), cleanedSuffix) || strings.HasSuffix(file.Name(), swapSuffix) || strings.HasSuffix(file.Name(), deletedSuffix) {
+			if err := os.Remove(filepath.Join(l.Path, file.Name())); err != nil {
+				return errors.Wrap(err, "remove file failed")
+			}
+			continue
+		}
 		// if this file is an index file, make sure it has a corresponding .log file
-		if strings.HasSuffix(file.Name(), IndexFileSuffix) {
-			_, err := os.Stat(filepath.Join(l.Path, strings.Replace(file.Name(), IndexFileSuffix, LogFileSuffix, 1)))
+		if suffix := indexSuffix(file.Name()); suffix != "" {
+			_, err := os.Stat(filepath.Join(l.Path, strings.TrimSuffix(file.Name(), suffix)+LogFileSuffix))
 			if os.IsNotExist(err) {
-				if err := os.Remove(file.Name()); err != nil {
+				if err := os.Remove(filepath.Join(l.Path, file.Name())); err != nil {
 					return err
 				}
 			} else if err != nil {
@@ -91,16 +235,38 @@ func (l *CommitLog) open() error {
 			}
 		} else if strings.HasSuffix(file.Name(), LogFileSuffix) {
 			offsetStr := strings.TrimSuffix(file.Name(), LogFileSuffix)
-			baseOffset, err := strconv.Atoi(offsetStr)
-			segment, err := NewSegment(l.Path, int64(baseOffset), l.MaxSegmentBytes)
+			baseOffset, err := strconv.ParseInt(offsetStr, 10, 64)
 			if err != nil {
-				return err
+				return errors.Wrap(err, "parse base offset failed")
 			}
-			l.segments = append(l.segments, segment)
+			baseOffsets = append(baseOffsets, baseOffset)
+		}
+	}
+
+	clean, err := l.readCleanShutdown()
+	if err != nil {
+		return err
+	}
+	recoveryPoint, err := l.readRecoveryPoint()
+	if err != nil {
+		return err
+	}
+	l.recoveryPoint = recoveryPoint
+	for i, baseOffset := range baseOffsets {
+		// after a clean shutdown every index is trusted, otherwise only
+		// segments that end before the recovery point are
+		recover := !clean && (i == len(baseOffsets)-1 || baseOffsets[i+1] > recoveryPoint)
+		segment, err := newSegment(baseOffset, l.segmentOptions(), recover)
+		if err != nil {
+			return err
+		}
+		if segment.discarded > 0 {
+			l.reportDiscarded(segment)
 		}
+		l.segments = append(l.segments, segment)
 	}
 	if len(l.segments) == 0 {
-		segment, err := NewSegment(l.Path, 0, l.MaxSegmentBytes)
+		segment, err := newSegment(0, l.segmentOptions(), true)
 		if err != nil {
 			return err
 		}
@@ -110,8 +276,130 @@ func (l *CommitLog) open() error {
 	return nil
 }
 
+// finishSwaps finishes swapping in the compacted segments whose swap log was
+// renamed before the log crashed, their swap files replace the segments'.
+func (l *CommitLog) finishSwaps() error {
+	files, err := ioutil.ReadDir(l.Path)
+	if err != nil {
+		return errors.Wrap(err, "read dir failed")
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), LogFileSuffix+swapSuffix) {
+			continue
+		}
+		prefix := filepath.Join(l.Path, strings.TrimSuffix(file.Name(), LogFileSuffix+swapSuffix))
+		for _, suffix := range []string{IndexFileSuffix, TimeIndexFileSuffix, LogFileSuffix} {
+			// the indexes can have been renamed already
+			err := os.Rename(prefix+suffix+swapSuffix, prefix+suffix)
+			if err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "rename file failed")
+			}
+		}
+	}
+	return nil
+}
+
+func indexSuffix(name string) string {
+	for _, suffix := range []string{IndexFileSuffix, TimeIndexFileSuffix} {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+func (l *CommitLog) segmentOptions() segmentOptions {
+	return segmentOptions{
+		path:               l.Path,
+		maxBytes:           l.MaxSegmentBytes,
+		maxIndexBytes:      l.MaxIndexBytes,
+		indexIntervalBytes: l.IndexIntervalBytes,
+		deleter:            l.deleter,
+		preallocate:        l.Preallocate,
+	}
+}
+
+// readCleanShutdown returns whether the log was closed cleanly, removing the
+// marker so a crash from here on is noticed.
+func (l *CommitLog) readCleanShutdown() (bool, error) {
+	err := os.Remove(filepath.Join(l.Path, cleanShutdownFile))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "remove file failed")
+	}
+	return true, nil
+}
+
+func (l *CommitLog) readRecoveryPoint() (int64, error) {
+	b, err := ioutil.ReadFile(filepath.Join(l.Path, recoveryPointFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "read file failed")
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		// recover the whole log rather than trusting a bad checkpoint
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// writeRecoveryPoint checkpoints the offset up to which the log is on disk.
+// It's written to a temporary file and renamed so a crash can't leave a torn
+// checkpoint.
+func (l *CommitLog) writeRecoveryPoint(offset int64) error {
+	path := filepath.Join(l.Path, recoveryPointFile)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, []byte(strconv.FormatInt(offset, 10))); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "rename file failed")
+	}
+	return nil
+}
+
+// reportDiscarded reports the invalid bytes truncated from the segment when
+// it was recovered.
+func (l *CommitLog) reportDiscarded(segment *Segment) {
+	if l.Logger != nil {
+		l.Logger.Info("truncated invalid entries from log",
+			log.String("path", segment.log.Name()),
+			log.Int64("valid bytes", segment.Position),
+			log.Int64("discarded bytes", segment.discarded))
+	}
+	if l.Metrics != nil && l.Metrics.LogBytesDiscarded != nil {
+		l.Metrics.LogBytesDiscarded.Add(float64(segment.discarded))
+	}
+}
+
+// Append appends the entries in b, assigning them the log's next offsets, and
+// returns the offset of the first. A legacy entry takes one offset, a
+// compressed legacy message takes one for each message it wraps, and a record
+// batch takes one for each of its records. Compressed entries are stored as
+// they are, unless a compressed message's wrapped messages need their offsets
+// rewritten. Entries that fail their CRC check are rejected with
+// ErrMalformedEntry.
 func (l *CommitLog) Append(b []byte) (offset int64, err error) {
-	ms := MessageSet(b)
+	entries := Entries(b)
+	wrapped := make([][]MessageSet, len(entries))
+	var size int
+	for i, ms := range entries {
+		if ms.LastOffset() < ms.Offset() || !ms.valid() {
+			return offset, ErrMalformedEntry
+		}
+		if ms.isWrapper() {
+			if wrapped[i], err = ms.wrapped(); err != nil {
+				return offset, err
+			}
+		}
+		size += len(ms)
+	}
+	if len(entries) == 0 || size != len(b) {
+		return offset, ErrMalformedEntry
+	}
 	if l.checkSplit() {
 		if err := l.split(); err != nil {
 			return offset, err
@@ -119,20 +407,127 @@ func (l *CommitLog) Append(b []byte) (offset int64, err error) {
 	}
 	position := l.activeSegment().Position
 	offset = l.activeSegment().NextOffset
-	ms.PutOffset(offset)
-	if _, err := l.activeSegment().Write(ms); err != nil {
-		return offset, err
+	next := offset
+	var rewrap bool
+	for i, ms := range entries {
+		if wrapped[i] != nil {
+			if entries[i], err = ms.assignWrapped(next, wrapped[i]); err != nil {
+				return offset, err
+			}
+			rewrap = true
+			next += int64(len(wrapped[i]))
+			continue
+		}
+		delta := ms.LastOffset() - ms.Offset()
+		ms.PutOffset(next)
+		next += delta + 1
 	}
-	e := Entry{
-		Offset:   offset,
-		Position: position,
+	// a compressed message can have been recompressed, so the entries are
+	// put back together
+	if rewrap {
+		b = nil
+		for _, ms := range entries {
+			b = append(b, ms...)
+		}
 	}
-	if err := l.activeSegment().Index.WriteEntry(e); err != nil {
+	if _, err := l.activeSegment().Write(b); err != nil {
 		return offset, err
 	}
+	for _, ms := range entries {
+		if err := l.activeSegment().indexEntry(ms, position); err != nil {
+			return offset, err
+		}
+		position += int64(len(ms))
+	}
+	l.notifyAppended()
+	if n := atomic.AddInt64(&l.unflushed, 1); l.FlushMessages > 0 && n >= l.FlushMessages {
+		if err := l.Flush(); err != nil {
+			return offset, err
+		}
+	}
 	return offset, nil
 }
 
+// Flush syncs the messages appended since the last flush to disk. Once a
+// segment's flushed the recovery point is moved past it, so it isn't
+// recovered after a crash.
+func (l *CommitLog) Flush() (err error) {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	unflushed := atomic.SwapInt64(&l.unflushed, 0)
+	if unflushed == 0 {
+		return nil
+	}
+	// the messages are counted as unflushed again if the flush fails, so
+	// it's retried
+	defer func() {
+		if err != nil {
+			atomic.AddInt64(&l.unflushed, unflushed)
+		}
+	}()
+	start := time.Now()
+	l.mu.RLock()
+	segments := l.segments
+	for i, segment := range segments {
+		// segments that end before the recovery point were already flushed
+		if i < len(segments)-1 && segments[i+1].BaseOffset <= l.recoveryPoint {
+			continue
+		}
+		if err := segment.Sync(); err != nil {
+			l.mu.RUnlock()
+			return err
+		}
+	}
+	l.mu.RUnlock()
+	if l.Metrics != nil && l.Metrics.LogFlushLatency != nil {
+		l.Metrics.LogFlushLatency.Observe(time.Since(start).Seconds())
+	}
+	// the active segment is always recovered, so the recovery point only
+	// needs writing when it moves past a segment
+	active := segments[len(segments)-1]
+	if active.BaseOffset <= l.recoveryPoint {
+		return nil
+	}
+	if err := l.writeRecoveryPoint(active.BaseOffset); err != nil {
+		return err
+	}
+	l.recoveryPoint = active.BaseOffset
+	return nil
+}
+
+// Appended returns a channel that's closed once the message at offset has
+// been appended, or the log's closed. It's closed already if the message has
+// been appended or the log's been closed, so readers at the end of the log
+// can wait for more without polling.
+func (l *CommitLog) Appended(offset int64) <-chan struct{} {
+	l.appendedMu.Lock()
+	defer l.appendedMu.Unlock()
+	if offset < l.NewestOffset() || l.isClosed() {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	return l.appended
+}
+
+// isClosed returns whether the log's been closed.
+func (l *CommitLog) isClosed() bool {
+	select {
+	case <-l.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// notifyAppended wakes the readers waiting for an append.
+func (l *CommitLog) notifyAppended() {
+	l.appendedMu.Lock()
+	defer l.appendedMu.Unlock()
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
 func (l *CommitLog) Read(p []byte) (n int, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -146,45 +541,217 @@ func (l *CommitLog) NewestOffset() int64 {
 func (l *CommitLog) OldestOffset() int64 {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	if len(l.remote) > 0 && l.remote[0] < l.segments[0].BaseOffset {
+		return l.remote[0]
+	}
 	return l.segments[0].BaseOffset
 }
 
+// OffsetForTime returns the offset of the first message with a timestamp at
+// or after ts, in milliseconds, and that message's timestamp. If there isn't
+// one it returns the offset the next message will be appended at and -1.
+// Segments only in the remote storage are searched first, fetching them as
+// needed.
+func (l *CommitLog) OffsetForTime(ts int64) (offset int64, timestamp int64, err error) {
+	l.mu.RLock()
+	segments, remote := l.segments, l.remote
+	l.mu.RUnlock()
+	for _, baseOffset := range remote {
+		if baseOffset >= segments[0].BaseOffset {
+			break
+		}
+		segment, err := l.fetch(baseOffset)
+		if err != nil {
+			return 0, 0, err
+		}
+		if segment.MaxTimestamp() < ts {
+			continue
+		}
+		if e, ok := segment.TimeIndex.Find(ts); ok {
+			return e.Offset, e.Timestamp, nil
+		}
+	}
+	for _, segment := range segments {
+		if segment.MaxTimestamp() < ts {
+			continue
+		}
+		if e, ok := segment.TimeIndex.Find(ts); ok {
+			return e.Offset, e.Timestamp, nil
+		}
+	}
+	return l.NewestOffset(), -1, nil
+}
+
 func (l *CommitLog) activeSegment() *Segment {
 	return l.vActiveSegment.Load().(*Segment)
 }
 
-func (l *CommitLog) Close() error {
+// cleanupLoop periodically runs the cleaner so segments are deleted once they
+// expire even if nothing is being appended to the log. With remote storage,
+// retention's applied to the remote segments first and closed segments are
+// uploaded after.
+func (l *CommitLog) cleanupLoop() {
+	ticker := time.NewTicker(l.CleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// errors are retried on the next tick
+			_ = l.cleanRemote()
+			_ = l.clean()
+			_ = l.Tier()
+		case <-l.shutdownCh:
+			return
+		}
+	}
+}
+
+// flushLoop periodically flushes the log to disk.
+func (l *CommitLog) flushLoop() {
+	ticker := time.NewTicker(l.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// errors are retried on the next tick
+			_ = l.Flush()
+		case <-l.shutdownCh:
+			return
+		}
+	}
+}
+
+func (l *CommitLog) clean() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	segments, err := l.cleaner.Clean(l.segments)
+	if err != nil {
+		return err
+	}
+	l.segments = segments
+	return nil
+}
+
+func (l *CommitLog) Close() (err error) {
+	l.closeOnce.Do(func() { close(l.shutdownCh) })
+	l.deleter.close()
+	// readers waiting for appends find the log closed
+	defer l.notifyAppended()
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	// the dir's unlocked even if closing fails, so it can be opened again
+	defer func() {
+		if uerr := l.lock.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	if err := l.closeRemote(); err != nil {
+		return err
+	}
+	if err := l.writeRecoveryPoint(l.NewestOffset()); err != nil {
+		return err
+	}
+	l.recoveryPoint = l.NewestOffset()
+	atomic.StoreInt64(&l.unflushed, 0)
+	return writeFileSync(filepath.Join(l.Path, cleanShutdownFile), nil)
 }
 
 func (l *CommitLog) Delete() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
+	if err := l.deleteAllRemote(); err != nil {
+		return err
+	}
 	return os.RemoveAll(l.Path)
 }
 
-func (l *CommitLog) Truncate(offset int64) error {
+// TruncateTo removes every message at or after offset, so the next message
+// is appended at offset, or at the start of the record batch offset's in as
+// batches are removed whole. Followers use it to drop the messages after the
+// leader's high watermark, it mustn't be called while appending. Uploaded
+// segments with messages at or after offset are deleted from the remote
+// storage.
+func (l *CommitLog) TruncateTo(offset int64) error {
+	if offset >= l.NewestOffset() {
+		return nil
+	}
+	l.tierMu.Lock()
+	defer l.tierMu.Unlock()
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	var segments []*Segment
-	for _, segment := range l.segments {
-		if segment.BaseOffset < offset {
-			if err := segment.Delete(); err != nil {
-				return err
-			}
-		} else {
-			segments = append(segments, segment)
+	if err := l.deleteRemote(func(_, end int64) bool { return end > offset }); err != nil {
+		return err
+	}
+	// the segment offset is in is truncated and the ones after deleted
+	i := len(l.segments) - 1
+	for i >= 0 && l.segments[i].BaseOffset > offset {
+		if err := l.segments[i].delete(); err != nil {
+			l.segments = l.segments[:i+1]
+			return err
 		}
+		i--
+	}
+	var active *Segment
+	if i < 0 {
+		// every message was after offset, start over from it
+		segment, err := newSegment(offset, l.segmentOptions(), true)
+		if err != nil {
+			l.segments = nil
+			return err
+		}
+		active = segment
+		l.segments = []*Segment{segment}
+	} else {
+		active = l.segments[i]
+		l.segments = l.segments[:i+1]
+		if err := active.truncateTo(offset); err != nil {
+			return err
+		}
+		if err := active.Sync(); err != nil {
+			return err
+		}
+	}
+	l.vActiveSegment.Store(active)
+	// the recovery point can't be past the truncated messages, or segments
+	// appended in their place would be trusted after a crash without having
+	// been flushed
+	if l.recoveryPoint > active.BaseOffset {
+		if err := l.writeRecoveryPoint(active.BaseOffset); err != nil {
+			return err
+		}
+		l.recoveryPoint = active.BaseOffset
+	}
+	return nil
+}
+
+// DeleteBefore deletes the segments whose messages are all before offset, for
+// retention and deleting records. Segments are deleted whole, so the messages
+// before offset in the segment it's in are kept, and the active segment is
+// never deleted. Uploaded segments are deleted from the remote storage too.
+func (l *CommitLog) DeleteBefore(offset int64) error {
+	l.tierMu.Lock()
+	defer l.tierMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.deleteRemote(func(_, end int64) bool { return end <= offset }); err != nil {
+		return err
+	}
+	for len(l.segments) > 1 && l.segments[1].BaseOffset <= offset {
+		if err := l.segments[0].delete(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
 	}
-	l.segments = segments
 	return nil
 }
 
@@ -194,12 +761,44 @@ func (l *CommitLog) Segments() []*Segment {
 	return l.segments
 }
 
+// nextSegment returns the log's segment after s, nil if s is the active
+// segment. The segment's fetched from the remote storage if it's no longer on
+// local disk.
+func (l *CommitLog) nextSegment(s *Segment) (*Segment, error) {
+	l.mu.RLock()
+	var next *Segment
+	for _, segment := range l.segments {
+		if segment.BaseOffset > s.BaseOffset {
+			next = segment
+			break
+		}
+	}
+	remote := int64(-1)
+	for _, baseOffset := range l.remote {
+		if baseOffset > s.BaseOffset {
+			remote = baseOffset
+			break
+		}
+	}
+	l.mu.RUnlock()
+	if remote >= 0 && (next == nil || remote < next.BaseOffset) {
+		return l.fetch(remote)
+	}
+	return next, nil
+}
+
+// checkSplit returns whether the active segment should be rolled, because
+// it's full or older than the max age.
 func (l *CommitLog) checkSplit() bool {
-	return l.activeSegment().IsFull()
+	active := l.activeSegment()
+	return active.IsFull() || (l.SegmentMaxAge > 0 && active.Age() >= l.SegmentMaxAge)
 }
 
 func (l *CommitLog) split() error {
-	segment, err := NewSegment(l.Path, l.NewestOffset(), l.MaxSegmentBytes)
+	if err := l.activeSegment().trim(); err != nil {
+		return err
+	}
+	segment, err := newSegment(l.NewestOffset(), l.segmentOptions(), true)
 	if err != nil {
 		return err
 	}
@@ -207,6 +806,7 @@ func (l *CommitLog) split() error {
 	segments := append(l.segments, segment)
 	segments, err = l.cleaner.Clean(segments)
 	if err != nil {
+		l.mu.Unlock()
 		return err
 	}
 	l.segments = segments
@@ -2,31 +2,48 @@ package commitlog_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/mock"
+	"github.com/travisjeffery/jocko/protocol"
 )
 
 var (
 	msgs = []commitlog.Message{
-		commitlog.NewMessage([]byte("one")),
-		commitlog.NewMessage([]byte("two")),
-		commitlog.NewMessage([]byte("three")),
-		commitlog.NewMessage([]byte("four")),
+		newMessage([]byte("one")),
+		newMessage([]byte("two")),
 	}
 	msgSets = []commitlog.MessageSet{
-		commitlog.NewMessageSet(0, msgs...),
-		commitlog.NewMessageSet(1, msgs...),
+		commitlog.NewMessageSet(0, msgs[0]),
+		commitlog.NewMessageSet(1, msgs[1]),
 	}
 	maxBytes = msgSets[0].Size()
 	path     = filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
 )
 
+// newMessage returns a message with the value, encoded with its CRC so the
+// log accepts it.
+func newMessage(value []byte) commitlog.Message {
+	b, err := protocol.Encode(&protocol.Message{Value: value})
+	if err != nil {
+		panic(err)
+	}
+	return commitlog.NewMessage(b)
+}
+
 func TestNewCommitLog(t *testing.T) {
 	var err error
 	l := setup(t)
@@ -37,7 +54,7 @@ func TestNewCommitLog(t *testing.T) {
 		require.NoError(t, err)
 	}
 	maxBytes := msgSets[0].Size()
-	r, err := l.NewReader(0, maxBytes)
+	r, err := l.NewReader(0, maxBytes*int32(len(msgSets)))
 	require.NoError(t, err)
 
 	for i := range msgSets {
@@ -48,12 +65,7 @@ func TestNewCommitLog(t *testing.T) {
 		ms := commitlog.MessageSet(p)
 		require.Equal(t, int64(i), ms.Offset())
 
-		payload := ms.Payload()
-		var offset int
-		for _, msg := range msgs {
-			require.Equal(t, []byte(msg), payload[offset:offset+len(msg)])
-			offset += len(msg)
-		}
+		require.Equal(t, []byte(msgs[i]), ms.Payload())
 	}
 }
 
@@ -70,7 +82,7 @@ func BenchmarkCommitLog(b *testing.B) {
 	}
 }
 
-func TestTruncate(t *testing.T) {
+func TestDeleteBefore(t *testing.T) {
 	var err error
 	l := setup(t)
 	defer cleanup(t)
@@ -82,7 +94,7 @@ func TestTruncate(t *testing.T) {
 	require.Equal(t, int64(2), l.NewestOffset())
 	require.Equal(t, 2, len(l.Segments()))
 
-	err = l.Truncate(int64(1))
+	err = l.DeleteBefore(int64(1))
 	require.NoError(t, err)
 	require.Equal(t, 1, len(l.Segments()))
 
@@ -102,13 +114,450 @@ func TestTruncate(t *testing.T) {
 		ms := commitlog.MessageSet(p)
 		require.Equal(t, int64(i+1), ms.Offset())
 
-		payload := ms.Payload()
-		var offset int
-		for _, msg := range msgs {
-			require.Equal(t, []byte(msg), payload[offset:offset+len(msg)])
-			offset += len(msg)
+		require.Equal(t, []byte(msgs[i+1]), ms.Payload())
+	}
+}
+
+func TestTruncateTo(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:               path,
+		MaxSegmentBytes:    100,
+		MaxLogBytes:        -1,
+		IndexIntervalBytes: 1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	appendAt := func(ts int64) {
+		b, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: time.Unix(0, ts*int64(time.Millisecond)),
+			Value:     []byte("value"),
+		})
+		require.NoError(t, err)
+		_, err = l.Append(commitlog.NewMessageSet(0, commitlog.NewMessage(b)))
+		require.NoError(t, err)
+	}
+	for i := int64(1); i <= 6; i++ {
+		appendAt(i * 1000)
+	}
+	segments := len(l.Segments())
+	require.True(t, segments > 1)
+
+	// the messages at and after the offset are removed from the middle of a
+	// segment and the later segments are deleted
+	require.NoError(t, l.TruncateTo(2))
+	require.Equal(t, int64(2), l.NewestOffset())
+	require.Equal(t, []int64{0, 1}, offsets(t, l))
+	require.True(t, len(l.Segments()) < segments)
+	offset, _, err := l.OffsetForTime(3000)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), offset)
+
+	// and are replaced by new appends
+	appendAt(7000)
+	appendAt(8000)
+	require.Equal(t, []int64{0, 1, 2, 3}, offsets(t, l))
+	offset, _, err = l.OffsetForTime(3000)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), offset)
+
+	// the truncated indexes are trusted after a clean shutdown
+	require.NoError(t, l.Close())
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, int64(4), l.NewestOffset())
+	require.Equal(t, []int64{0, 1, 2, 3}, offsets(t, l))
+	r, err := l.NewReader(3, 1024)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), commitlog.MessageSet(b).Offset())
+
+	// truncating to the start of the log empties it
+	require.NoError(t, l.TruncateTo(0))
+	require.Equal(t, int64(0), l.NewestOffset())
+	require.Equal(t, 1, len(l.Segments()))
+	require.Equal(t, 0, len(offsets(t, l)))
+	appendAt(9000)
+	require.Equal(t, []int64{0}, offsets(t, l))
+}
+
+func TestDeleteDelay(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	require.NoError(t, os.MkdirAll(path, 0755))
+	// left behind by a deleted segment that wasn't removed
+	leftover := filepath.Join(path, fmt.Sprintf("%020d.log.deleted", 100))
+	require.NoError(t, ioutil.WriteFile(leftover, []byte("leftover"), 0666))
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+		FileDeleteDelay: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = os.Stat(leftover)
+	require.True(t, os.IsNotExist(err))
+	for i := 0; i < 10; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	require.Equal(t, 3, len(l.Segments()))
+	r, err := l.NewReader(0, 1024)
+	require.NoError(t, err)
+
+	// the deleted segments' files are renamed rather than removed
+	require.NoError(t, l.DeleteBefore(8))
+	require.Equal(t, int64(8), l.OldestOffset())
+	deleted := func() []string {
+		names, err := filepath.Glob(filepath.Join(path, "*.deleted"))
+		require.NoError(t, err)
+		return names
+	}
+	require.Equal(t, 6, len(deleted()))
+	_, err = os.Stat(filepath.Join(path, fmt.Sprintf("%020d.log", 0)))
+	require.True(t, os.IsNotExist(err))
+
+	// so an open reader carries on through them to the log's next segment
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	var got []int64
+	for len(b) > 0 {
+		ms := commitlog.MessageSet(b)
+		got = append(got, ms.Offset())
+		b = b[ms.Size():]
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 8, 9}, got)
+
+	// and they're removed after the delay
+	for i := 0; i < 50 && len(deleted()) > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Equal(t, 0, len(deleted()))
+}
+
+func TestSegmentMaxAge(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:          path,
+		MaxLogBytes:   -1,
+		SegmentMaxAge: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// an empty segment isn't rolled however old it is
+	time.Sleep(60 * time.Millisecond)
+	appendMessage(t, l, nil, []byte("value-0"))
+	appendMessage(t, l, nil, []byte("value-1"))
+	require.Equal(t, 1, len(l.Segments()))
+
+	// once its first message is older than the max age it's rolled
+	time.Sleep(60 * time.Millisecond)
+	appendMessage(t, l, nil, []byte("value-2"))
+	segments := l.Segments()
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, int64(2), segments[1].BaseOffset)
+	require.Equal(t, []int64{0, 1, 2}, offsets(t, l))
+}
+
+func TestPreallocate(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+		Preallocate:     true,
+		Metrics:         mock.NewMetrics(),
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	size := func(base int64) int64 {
+		fi, err := os.Stat(filepath.Join(path, fmt.Sprintf("%020d.log", base)))
+		require.NoError(t, err)
+		return fi.Size()
+	}
+
+	// new segments are preallocated, readers stop at their last entry
+	require.Equal(t, int64(100), size(0))
+	for i := 0; i < 5; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4}, offsets(t, l))
+	require.Equal(t, int64(100), size(4))
+
+	// and they're trimmed when they're rolled
+	require.Equal(t, int64(4*33), size(0))
+
+	// a preallocated tail left by a crash is trimmed without being
+	// counted as invalid
+	require.NoError(t, l.Flush())
+	copts := opts
+	copts.Path = crash(t, path)
+	defer os.RemoveAll(copts.Path)
+	cl, err := commitlog.New(copts)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), cl.NewestOffset())
+	require.Equal(t, []int64{0, 1, 2, 3, 4}, offsets(t, cl))
+	require.Equal(t, float64(0), counterValue(t, copts.Metrics.LogBytesDiscarded))
+	require.NoError(t, cl.Close())
+
+	// and on close
+	require.NoError(t, l.Close())
+	require.Equal(t, int64(33), size(4))
+}
+
+func TestAppended(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:        path,
+		MaxLogBytes: -1,
+	})
+	require.NoError(t, err)
+	closed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	// waiting for a message fires when it's appended
+	ch := l.Appended(0)
+	require.False(t, closed(ch))
+	appendMessage(t, l, nil, []byte("value-0"))
+	require.True(t, closed(ch))
+	require.True(t, closed(l.Appended(0)))
+
+	// or when the log's closed
+	ch = l.Appended(1)
+	require.False(t, closed(ch))
+	require.NoError(t, l.Close())
+	require.True(t, closed(ch))
+	require.True(t, closed(l.Appended(1)))
+}
+
+func TestScan(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// legacy messages across segments followed by a v2 batch
+	for i := int64(0); i < 4; i++ {
+		b, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: time.Unix(0, (i+1)*int64(time.Second)),
+			Key:       []byte(fmt.Sprintf("key-%d", i)),
+			Value:     []byte(fmt.Sprintf("value-%d", i)),
+		})
+		require.NoError(t, err)
+		_, err = l.Append(commitlog.NewMessageSet(0, commitlog.NewMessage(b)))
+		require.NoError(t, err)
+	}
+	require.True(t, len(l.Segments()) > 1)
+	batch := []commitlog.Record{
+		{Offset: 0, Timestamp: 0, Key: []byte("key-4"), Value: []byte("value-4"), Headers: []commitlog.Header{{Key: "h", Value: []byte("v")}}},
+		{Offset: 1, Timestamp: 1000, Key: nil, Value: []byte("value-5")},
+	}
+	rb := recordBatch(5000, batch)
+	require.True(t, commitlog.RecordBatch(rb).Valid())
+	_, err = l.Append(rb)
+	require.NoError(t, err)
+
+	var got []commitlog.Record
+	require.NoError(t, l.Scan(1, func(r commitlog.Record) error {
+		got = append(got, r)
+		return nil
+	}))
+	require.Equal(t, 5, len(got))
+	for i, r := range got[:3] {
+		require.Equal(t, commitlog.Record{
+			Offset:    int64(i + 1),
+			Timestamp: int64(i+2) * 1000,
+			Key:       []byte(fmt.Sprintf("key-%d", i+1)),
+			Value:     []byte(fmt.Sprintf("value-%d", i+1)),
+		}, r)
+	}
+	require.Equal(t, commitlog.Record{Offset: 4, Timestamp: 5000, Key: []byte("key-4"), Value: []byte("value-4"), Headers: batch[0].Headers}, got[3])
+	require.Equal(t, commitlog.Record{Offset: 5, Timestamp: 6000, Value: []byte("value-5")}, got[4])
+
+	// scanning stops early without an error
+	got = nil
+	require.NoError(t, l.Scan(0, func(r commitlog.Record) error {
+		got = append(got, r)
+		if len(got) == 2 {
+			return commitlog.ErrStopScan
 		}
+		return nil
+	}))
+	require.Equal(t, 2, len(got))
+}
+
+func TestAppendRecordBatch(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:               path,
+		MaxLogBytes:        -1,
+		IndexIntervalBytes: 1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+
+	// a record batch takes an offset for each of its records
+	appendMessage(t, l, nil, []byte("value-0"))
+	offset, err := l.Append(recordBatch(1000, []commitlog.Record{
+		{Offset: 0, Timestamp: 0, Value: []byte("value-1")},
+		{Offset: 1, Timestamp: 1, Value: []byte("value-2")},
+		{Offset: 2, Timestamp: 2, Value: []byte("value-3")},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), offset)
+	// and the entries in a record set each take theirs
+	var b []byte
+	for _, value := range []string{"value-4", "value-5"} {
+		m, err := protocol.Encode(&protocol.Message{Value: []byte(value)})
+		require.NoError(t, err)
+		b = append(b, commitlog.NewMessageSet(0, commitlog.NewMessage(m))...)
+	}
+	offset, err = l.Append(b)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), offset)
+	require.Equal(t, int64(6), l.NewestOffset())
+	_, err = l.Append(b[:20])
+	require.Equal(t, commitlog.ErrMalformedEntry, err)
+	// entries that fail their CRC check aren't appended
+	corrupt := append([]byte(nil), b...)
+	corrupt[len(corrupt)-1]++
+	_, err = l.Append(corrupt)
+	require.Equal(t, commitlog.ErrMalformedEntry, err)
+	batch := recordBatch(1000, []commitlog.Record{{Offset: 0, Timestamp: 0, Value: []byte("value-6")}})
+	batch[len(batch)-1]++
+	_, err = l.Append(batch)
+	require.Equal(t, commitlog.ErrMalformedEntry, err)
+	require.Equal(t, int64(6), l.NewestOffset())
+
+	// reading from inside a batch starts at the batch
+	r, err := l.NewReader(2, 1024)
+	require.NoError(t, err)
+	read, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	var got []int64
+	for _, ms := range commitlog.Entries(read) {
+		got = append(got, ms.Offset())
+	}
+	require.Equal(t, []int64{1, 4, 5}, got)
+
+	// batches are validated when the log's recovered
+	require.NoError(t, l.Close())
+	uncleanShutdown(t, path)
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, int64(6), l.NewestOffset())
+	offset, _, err = l.OffsetForTime(1001)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), offset)
+
+	// batches are down converted to a message for each record
+	converted, err := commitlog.DownConvert(read)
+	require.NoError(t, err)
+	var values []string
+	for _, ms := range commitlog.Entries(converted) {
+		m := commitlog.Message(ms.Payload())
+		require.True(t, m.Valid())
+		values = append(values, fmt.Sprintf("%d:%s", ms.Offset(), m.Value()))
+	}
+	require.Equal(t, []string{"1:value-1", "2:value-2", "3:value-3", "4:value-4", "5:value-5"}, values)
+
+	// truncating inside a batch removes the whole batch
+	require.NoError(t, l.TruncateTo(2))
+	require.Equal(t, int64(1), l.NewestOffset())
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:        path,
+		MaxLogBytes: -1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+
+	// the log can't be opened twice until it's closed
+	_, err = commitlog.New(opts)
+	require.Error(t, err)
+	require.Equal(t, commitlog.ErrLocked, errors.Cause(err))
+	require.NoError(t, l.Close())
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	appendMessage(t, l, nil, []byte("value"))
+
+	// and it's unlocked even if closing it fails
+	tmp := filepath.Join(path, "recovery-point.tmp")
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "dir"), 0755))
+	require.Error(t, l.Close())
+	require.NoError(t, os.RemoveAll(tmp))
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
+
+func TestReaderMaxBytes(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 6; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
 	}
+	require.True(t, len(l.Segments()) > 1)
+
+	read := func(offset int64, maxBytes int32) ([]byte, int64) {
+		r, err := l.NewReader(offset, maxBytes)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		return b, r.(*commitlog.Reader).LastOffset()
+	}
+
+	// the 33 byte entries are only returned whole and across segments
+	b, last := read(1, 100)
+	require.Equal(t, 3*33, len(b))
+	require.Equal(t, int64(1), commitlog.MessageSet(b).Offset())
+	require.Equal(t, int64(3), last)
+	b, last = read(0, 1000)
+	require.Equal(t, 6*33, len(b))
+	require.Equal(t, int64(5), last)
+
+	// the first entry is returned even if it's bigger than maxBytes
+	b, last = read(2, 10)
+	require.Equal(t, 33, len(b))
+	require.Equal(t, int64(2), last)
+
+	// nothing's returned past the end of the log
+	b, last = read(6, 100)
+	require.Equal(t, 0, len(b))
+	require.Equal(t, int64(-1), last)
 }
 
 func TestCleaner(t *testing.T) {
@@ -133,6 +582,499 @@ func TestCleaner(t *testing.T) {
 	}
 }
 
+func TestCleanerAge(t *testing.T) {
+	var err error
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		MaxLogBytes:     -1,
+		MaxLogAge:       time.Hour,
+		CleanupInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	for _, msgSet := range msgSets {
+		_, err = l.Append(msgSet)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, len(l.Segments()))
+
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(filepath.Join(path, fmt.Sprintf("%020d.log", 0)), old, old)
+	require.NoError(t, err)
+
+	for i := 0; i < 100 && l.OldestOffset() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, int64(1), l.OldestOffset())
+	require.Equal(t, 1, len(l.Segments()))
+	_, err = os.Stat(filepath.Join(path, fmt.Sprintf("%020d.log", 0)))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCleanerUnsetRetention(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		CleanupInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	for _, msgSet := range msgSets {
+		_, err = l.Append(msgSet)
+		require.NoError(t, err)
+	}
+
+	// a log without retention limits keeps all its segments
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(0), l.OldestOffset())
+	require.Equal(t, 2, len(l.Segments()))
+}
+
+func TestCleanerAgeTimestamp(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, ts := range []time.Time{old, time.Now(), time.Now()} {
+		b, err := protocol.Encode(&protocol.MessageSet{Messages: []*protocol.Message{{MagicByte: 1, Timestamp: ts, Value: []byte("value")}}})
+		require.NoError(t, err)
+		_, err = l.Append(b)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 3, len(l.Segments()))
+	require.NoError(t, l.Close())
+
+	// the segment's age is its newest message's timestamp, not when its file
+	// was last written to
+	err = os.Chtimes(filepath.Join(path, fmt.Sprintf("%020d.log", 1)), old, old)
+	require.NoError(t, err)
+
+	opts.MaxLogAge = time.Hour
+	opts.CleanupInterval = 10 * time.Millisecond
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 100 && l.OldestOffset() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, int64(1), l.OldestOffset())
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int64(1), l.OldestOffset())
+	require.Equal(t, 2, len(l.Segments()))
+}
+
+func TestRecovery(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+		Metrics:         mock.NewMetrics(),
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	require.NoError(t, l.Close())
+	uncleanShutdown(t, path)
+
+	logPath := filepath.Join(path, fmt.Sprintf("%020d.log", 0))
+	fi, err := os.Stat(logPath)
+	require.NoError(t, err)
+	size := fi.Size()
+
+	// a torn write: a header whose entry runs past the end of the file
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	_, err = f.Write(commitlog.NewMessageSet(3, commitlog.NewMessage([]byte("torn")))[:14])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), l.NewestOffset())
+	fi, err = os.Stat(logPath)
+	require.NoError(t, err)
+	require.Equal(t, size, fi.Size())
+	require.Equal(t, float64(14), counterValue(t, opts.Metrics.LogBytesDiscarded))
+
+	// new appends follow the last valid entry
+	appendMessage(t, l, nil, []byte("value-3"))
+	require.Equal(t, []int64{0, 1, 2, 3}, offsets(t, l))
+	require.NoError(t, l.Close())
+	uncleanShutdown(t, path)
+
+	// a corrupt entry fails its CRC check and is discarded with everything
+	// after it
+	b, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	b[size-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(logPath, b, 0666))
+
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, int64(2), l.NewestOffset())
+	require.Equal(t, []int64{0, 1}, offsets(t, l))
+}
+
+func TestCleanShutdown(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	require.NoError(t, l.Close())
+	_, err = os.Stat(filepath.Join(path, ".clean_shutdown"))
+	require.NoError(t, err)
+
+	// the indexes are trusted after a clean shutdown and the marker is
+	// removed while the log is open
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(path, ".clean_shutdown"))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, int64(3), l.NewestOffset())
+	require.Equal(t, []int64{0, 1, 2}, offsets(t, l))
+
+	// crash after appending past the recovery point
+	for i := 3; i < 5; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	corrupt := func(baseOffset int64) {
+		logPath := filepath.Join(path, fmt.Sprintf("%020d.log", baseOffset))
+		b, err := ioutil.ReadFile(logPath)
+		require.NoError(t, err)
+		b[len(b)-1] ^= 0xff
+		require.NoError(t, ioutil.WriteFile(logPath, b, 0666))
+	}
+	corrupt(0)
+	corrupt(4)
+
+	// segments before the recovery point aren't rescanned, so the
+	// corruption in the first goes unnoticed, the ones after are recovered
+	opts.Path = crash(t, path)
+	defer os.RemoveAll(opts.Path)
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, []int64{0, 1, 2, 3}, offsets(t, l))
+	require.Equal(t, int64(4), l.NewestOffset())
+}
+
+func TestCleanShutdownInvalidTail(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	require.NoError(t, l.Close())
+
+	// an entry header after the last indexed entry that can't be right,
+	// its size takes it before its position
+	logPath := filepath.Join(path, fmt.Sprintf("%020d.log", 0))
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0666)
+	require.NoError(t, err)
+	header := make([]byte, 12)
+	commitlog.Encoding.PutUint32(header[8:], 0xfffffff0)
+	_, err = f.Write(header)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// the index isn't trusted and the segment's recovered instead
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, int64(3), l.NewestOffset())
+	require.Equal(t, []int64{0, 1, 2}, offsets(t, l))
+}
+
+func TestOffsetForTime(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+
+	// timestamps needn't be in order, a message is found by the first one
+	// at or after the time
+	for _, ts := range []int64{1000, 3000, 2000, 4000, 5000, 6000} {
+		b, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: time.Unix(0, ts*int64(time.Millisecond)),
+			Value:     []byte("value"),
+		})
+		require.NoError(t, err)
+		_, err = l.Append(commitlog.NewMessageSet(0, commitlog.NewMessage(b)))
+		require.NoError(t, err)
+	}
+	require.True(t, len(l.Segments()) > 1)
+
+	check := func() {
+		// the message's found with its timestamp
+		for ts, exp := range map[int64]struct{ offset, timestamp int64 }{
+			0:    {0, 1000},
+			1000: {0, 1000},
+			1500: {1, 3000},
+			2000: {1, 3000},
+			3500: {3, 4000},
+			6000: {5, 6000},
+			7000: {6, -1},
+		} {
+			offset, timestamp, err := l.OffsetForTime(ts)
+			require.NoError(t, err)
+			require.Equal(t, exp.offset, offset, "timestamp %d", ts)
+			require.Equal(t, exp.timestamp, timestamp, "timestamp %d", ts)
+		}
+	}
+	check()
+
+	// the time indexes are loaded after a clean shutdown and rebuilt after a
+	// crash
+	require.NoError(t, l.Close())
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	check()
+	require.NoError(t, l.Close())
+	uncleanShutdown(t, path)
+	require.NoError(t, os.Remove(filepath.Join(path, "recovery-point")))
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	check()
+}
+
+func TestSparseIndex(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:               path,
+		MaxSegmentBytes:    1024,
+		MaxLogBytes:        -1,
+		IndexIntervalBytes: 100,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+
+	check := func() {
+		for i := int64(0); i < 10; i++ {
+			r, err := l.NewReader(i, 1024)
+			require.NoError(t, err)
+			p := make([]byte, 12)
+			_, err = io.ReadFull(r, p)
+			require.NoError(t, err)
+			require.Equal(t, i, commitlog.MessageSet(p).Offset())
+		}
+	}
+	check()
+
+	// the 33 byte entries are indexed at offsets 0, 4 and 8
+	require.NoError(t, l.Close())
+	fi, err := os.Stat(filepath.Join(path, fmt.Sprintf("%020d.index", 0)))
+	require.NoError(t, err)
+	require.Equal(t, int64(3*8), fi.Size())
+
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	check()
+	require.NoError(t, l.Close())
+	uncleanShutdown(t, path)
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	check()
+}
+
+func TestFlush(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		MaxLogBytes:     -1,
+		FlushMessages:   2,
+		Metrics:         mock.NewMetrics(),
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// every second append is flushed and moves the recovery point to the
+	// active segment
+	for i := 0; i < 5; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	require.Equal(t, uint64(2), histogramCount(t, opts.Metrics.LogFlushLatency))
+	b, err := ioutil.ReadFile(filepath.Join(path, "recovery-point"))
+	require.NoError(t, err)
+	require.Equal(t, "3", string(b))
+
+	// nothing's flushed if nothing's been appended
+	require.NoError(t, l.Flush())
+	require.Equal(t, uint64(3), histogramCount(t, opts.Metrics.LogFlushLatency))
+	require.NoError(t, l.Flush())
+	require.Equal(t, uint64(3), histogramCount(t, opts.Metrics.LogFlushLatency))
+}
+
+func TestFlushRetried(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		MaxLogBytes:     -1,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	appendMessage(t, l, nil, []byte("one"))
+	appendMessage(t, l, nil, []byte("two"))
+
+	// the recovery point can't be written while its temp file's path is a
+	// directory
+	tmp := filepath.Join(path, "recovery-point.tmp")
+	require.NoError(t, os.MkdirAll(filepath.Join(tmp, "dir"), 0755))
+	require.Error(t, l.Flush())
+	require.Error(t, l.Flush())
+
+	// the failed flush is retried once it can succeed
+	require.NoError(t, os.RemoveAll(tmp))
+	require.NoError(t, l.Flush())
+	b, err := ioutil.ReadFile(filepath.Join(path, "recovery-point"))
+	require.NoError(t, err)
+	require.Equal(t, "1", string(b))
+}
+
+func TestFlushInterval(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+		FlushInterval:   10 * time.Millisecond,
+		Metrics:         mock.NewMetrics(),
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendMessage(t, l, nil, []byte("value"))
+	for i := 0; i < 100 && histogramCount(t, opts.Metrics.LogFlushLatency) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, uint64(1), histogramCount(t, opts.Metrics.LogFlushLatency))
+}
+
+// recordBatch encodes the records as a v2 record batch, their offsets and
+// timestamps are relative to the batch's.
+func recordBatch(firstTimestamp int64, records []commitlog.Record) []byte {
+	putVarint := func(b []byte, v int64) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return append(b, buf[:binary.PutVarint(buf, v)]...)
+	}
+	putVarbytes := func(b []byte, v []byte) []byte {
+		if v == nil {
+			return putVarint(b, -1)
+		}
+		return append(putVarint(b, int64(len(v))), v...)
+	}
+	b := make([]byte, 61)
+	b[16] = 2
+	commitlog.Encoding.PutUint32(b[23:], uint32(len(records)-1))
+	commitlog.Encoding.PutUint64(b[27:], uint64(firstTimestamp))
+	commitlog.Encoding.PutUint64(b[35:], uint64(firstTimestamp+records[len(records)-1].Timestamp))
+	commitlog.Encoding.PutUint64(b[43:], ^uint64(0))
+	commitlog.Encoding.PutUint32(b[57:], uint32(len(records)))
+	for _, r := range records {
+		rb := []byte{0}
+		rb = putVarint(rb, r.Timestamp)
+		rb = putVarint(rb, r.Offset)
+		rb = putVarbytes(rb, r.Key)
+		rb = putVarbytes(rb, r.Value)
+		rb = putVarint(rb, int64(len(r.Headers)))
+		for _, h := range r.Headers {
+			rb = putVarbytes(rb, []byte(h.Key))
+			rb = putVarbytes(rb, h.Value)
+		}
+		b = append(putVarint(b, int64(len(rb))), rb...)
+	}
+	commitlog.Encoding.PutUint32(b[8:], uint32(len(b)-12))
+	commitlog.Encoding.PutUint32(b[17:], crc32.Checksum(b[21:], crc32.MakeTable(crc32.Castagnoli)))
+	return b
+}
+
+// crash copies the files of the open log at path as they'd be left if the
+// process crashed, returning the copy's path.
+func crash(t *testing.T, path string) string {
+	crashed := path + "-crashed"
+	require.NoError(t, os.MkdirAll(crashed, 0755))
+	files, err := ioutil.ReadDir(path)
+	require.NoError(t, err)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(filepath.Join(path, file.Name()))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(crashed, file.Name()), b, 0666))
+	}
+	return crashed
+}
+
+// uncleanShutdown makes the log at path look like it crashed rather than
+// being closed.
+func uncleanShutdown(t *testing.T, path string) {
+	require.NoError(t, os.Remove(filepath.Join(path, ".clean_shutdown")))
+}
+
+func counterValue(t *testing.T, c interface {
+	Write(*dto.Metric) error
+}) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, c.Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func histogramCount(t *testing.T, h interface {
+	Write(*dto.Metric) error
+}) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, h.Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
 func check(t require.TestingT, got, want []byte) {
 	if !bytes.Equal(got, want) {
 		t.Errorf("got = %s, want %s", string(got), string(want))
@@ -0,0 +1,151 @@
+package commitlog
+
+import "github.com/travisjeffery/jocko/protocol"
+
+// Codec returns the codec the message's value is compressed with. A
+// compressed message wraps other messages, its value is their entries
+// compressed.
+func (m Message) Codec() protocol.CompressionCodec {
+	return protocol.CompressionCodec(m.Attributes() & compressionCodecMask)
+}
+
+// Codec returns the codec the batch's records are compressed with.
+func (b RecordBatch) Codec() protocol.CompressionCodec {
+	return protocol.CompressionCodec(b.Attributes() & compressionCodecMask)
+}
+
+// decompress returns b decompressed with the codec, ErrCompressedEntry if the
+// codec's unknown and ErrMalformedEntry if b can't be decompressed.
+func decompress(codec protocol.CompressionCodec, b []byte) ([]byte, error) {
+	b, err := protocol.Decompress(codec, b)
+	if err == protocol.ErrUnknownCompressionCodec {
+		return nil, ErrCompressedEntry
+	} else if err != nil {
+		return nil, ErrMalformedEntry
+	}
+	return b, nil
+}
+
+// isWrapper returns whether the entry's a compressed legacy message. It has
+// the offset of the last message it wraps, whose offsets are absolute in
+// magic 0 and relative to the first in magic 1. A message that fails its CRC
+// check isn't one, its attributes can't be trusted.
+func (ms MessageSet) isWrapper() bool {
+	if ms.isBatch() {
+		return false
+	}
+	m := Message(ms.Payload())
+	return m.Codec() != protocol.CompressionNone && m.Valid()
+}
+
+// wrapped returns the entries wrapped by the entry's compressed message.
+func (ms MessageSet) wrapped() ([]MessageSet, error) {
+	m := Message(ms.Payload())
+	_, value, ok := m.fields()
+	if !ok {
+		return nil, ErrMalformedEntry
+	}
+	b, err := decompress(m.Codec(), value)
+	if err != nil {
+		return nil, err
+	}
+	entries := Entries(b)
+	if len(entries) == 0 {
+		return nil, ErrMalformedEntry
+	}
+	// as in Kafka, a compressed message can't wrap compressed messages
+	for _, e := range entries {
+		if Message(e.Payload()).Codec() != protocol.CompressionNone {
+			return nil, ErrMalformedEntry
+		}
+	}
+	return entries, nil
+}
+
+// firstOffset returns the offset of the entry's first message, which for a
+// compressed message means decompressing it to count the messages it wraps.
+func (ms MessageSet) firstOffset() (int64, error) {
+	if !ms.isWrapper() {
+		return ms.Offset(), nil
+	}
+	entries, err := ms.wrapped()
+	if err != nil {
+		return 0, err
+	}
+	return ms.Offset() - int64(len(entries)) + 1, nil
+}
+
+// wrappedRecords calls fn with the records of the messages wrapped by the
+// entry's compressed message.
+func (ms MessageSet) wrappedRecords(fn func(Record) error) error {
+	wrapper := Message(ms.Payload())
+	entries, err := ms.wrapped()
+	if err != nil {
+		return err
+	}
+	var base int64
+	if wrapper.MagicByte() > 0 {
+		base = ms.Offset() - entries[len(entries)-1].Offset()
+	}
+	logAppendTime := wrapper.Attributes()&timestampTypeMask != 0
+	for _, e := range entries {
+		m := Message(e.Payload())
+		key, value, ok := m.fields()
+		if !ok {
+			return ErrMalformedEntry
+		}
+		r := Record{
+			Offset:    base + e.Offset(),
+			Timestamp: m.Timestamp(),
+			Key:       key,
+			Value:     value,
+		}
+		if logAppendTime {
+			r.Timestamp = wrapper.Timestamp()
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assignWrapped assigns the entry's compressed message the offsets from
+// offset, one for each message it wraps, and returns the entry. The wrapped
+// messages are recompressed with their offsets if they don't have them
+// already, so the entry returned can be a new one.
+func (ms MessageSet) assignWrapped(offset int64, entries []MessageSet) (MessageSet, error) {
+	wrapper := Message(ms.Payload())
+	last := offset + int64(len(entries)) - 1
+	var changed bool
+	for i, e := range entries {
+		want := int64(i)
+		if wrapper.MagicByte() == 0 {
+			want += offset
+		}
+		if e.Offset() != want {
+			e.PutOffset(want)
+			changed = true
+		}
+	}
+	if !changed {
+		ms.PutOffset(last)
+		return ms, nil
+	}
+	// the wrapped entries are one after another in the decompressed value
+	var raw []byte
+	for _, e := range entries {
+		raw = append(raw, e...)
+	}
+	value, err := protocol.Compress(wrapper.Codec(), raw)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _ := wrapper.fields()
+	return appendMessage(nil, wrapper.MagicByte(), wrapper.Attributes(), Record{
+		Offset:    last,
+		Timestamp: wrapper.Timestamp(),
+		Key:       key,
+		Value:     value,
+	}), nil
+}
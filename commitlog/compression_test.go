@@ -0,0 +1,156 @@
+package commitlog_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestAppendCompressed(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 1024,
+		MaxLogBytes:     -1,
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+
+	appendMessage(t, l, nil, []byte("zero"))
+	// a magic 1 wrapper's messages have offsets relative to the first
+	offset, err := l.Append(wrapper(t, 1, protocol.CompressionGZIP, 0, "one", "two", "three"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), offset)
+	// a magic 0 wrapper's have absolute offsets, so they're rewritten
+	offset, err = l.Append(wrapper(t, 0, protocol.CompressionSnappy, 0, "four", "five"))
+	require.NoError(t, err)
+	require.Equal(t, int64(4), offset)
+	batch, err := protocol.Encode(&protocol.RecordBatch{
+		Attributes:      int16(protocol.CompressionZSTD),
+		LastOffsetDelta: 1,
+		Records: []*protocol.Record{
+			{Value: []byte("six")},
+			{OffsetDelta: 1, Value: []byte("seven")},
+		},
+	})
+	require.NoError(t, err)
+	offset, err = l.Append(batch)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), offset)
+	require.Equal(t, int64(8), l.NewestOffset())
+	// a wrapper can't wrap compressed messages
+	nested, err := protocol.Encode(&protocol.MessageSet{Messages: []*protocol.Message{{
+		Codec: protocol.CompressionGZIP,
+		Set: []*protocol.MessageSet{{Messages: []*protocol.Message{{
+			Codec: protocol.CompressionGZIP,
+			Set:   []*protocol.MessageSet{{Messages: []*protocol.Message{{Value: []byte("eight")}}}},
+		}}}},
+	}}})
+	require.NoError(t, err)
+	_, err = l.Append(nested)
+	require.Equal(t, commitlog.ErrMalformedEntry, err)
+	require.Equal(t, int64(8), l.NewestOffset())
+
+	records := func(from int64) (offsets []int64, values []string) {
+		require.NoError(t, l.Scan(from, func(r commitlog.Record) error {
+			offsets = append(offsets, r.Offset)
+			values = append(values, string(r.Value))
+			return nil
+		}))
+		return offsets, values
+	}
+	offsets, values := records(0)
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7}, offsets)
+	require.Equal(t, []string{"zero", "one", "two", "three", "four", "five", "six", "seven"}, values)
+	offsets, _ = records(2)
+	require.Equal(t, []int64{2, 3, 4, 5, 6, 7}, offsets)
+
+	// the wrapper's stored compressed with the offset of its last message
+	r, err := l.NewReader(2, 1024)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	ms := commitlog.MessageSet(b)
+	require.Equal(t, int64(3), ms.Offset())
+	require.Equal(t, protocol.CompressionGZIP, commitlog.Message(ms.Payload()).Codec())
+
+	// and it's recovered as it was appended
+	require.NoError(t, l.Close())
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	require.Equal(t, int64(8), l.NewestOffset())
+
+	// truncating into a wrapper removes it whole
+	require.NoError(t, l.TruncateTo(5))
+	require.Equal(t, int64(4), l.NewestOffset())
+	require.NoError(t, l.TruncateTo(2))
+	require.Equal(t, int64(1), l.NewestOffset())
+	offsets, _ = records(0)
+	require.Equal(t, []int64{0}, offsets)
+}
+
+func TestCompactCleanerCompressed(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 6,
+		Cleaner:         commitlog.NewCompactCleaner(time.Hour),
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	keyed := func(codec protocol.CompressionCodec, keys ...string) []byte {
+		b := &protocol.RecordBatch{Attributes: int16(codec), LastOffsetDelta: int32(len(keys) - 1)}
+		for i, key := range keys {
+			b.Records = append(b.Records, &protocol.Record{OffsetDelta: int64(i), Key: []byte(key), Value: []byte("v")})
+		}
+		p, err := protocol.Encode(b)
+		require.NoError(t, err)
+		return p
+	}
+	for _, p := range [][]byte{
+		keyed(protocol.CompressionGZIP, "k1", "k2"),
+		keyed(protocol.CompressionLZ4, "k1"),
+		keyed(protocol.CompressionNone, "k3"),
+	} {
+		_, err = l.Append(p)
+		require.NoError(t, err)
+	}
+	// the first batch is kept whole while k2's still needed
+	require.Equal(t, []int64{0, 2, 3}, offsets(t, l))
+
+	for _, p := range [][]byte{
+		keyed(protocol.CompressionZSTD, "k2"),
+		keyed(protocol.CompressionNone, "k4"),
+	} {
+		_, err = l.Append(p)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int64{2, 3, 4, 5}, offsets(t, l))
+}
+
+// wrapper returns an entry holding a message compressed with the codec, which
+// wraps messages with the values at offsets from offset.
+func wrapper(t *testing.T, magic int8, codec protocol.CompressionCodec, offset int64, values ...string) []byte {
+	m := &protocol.Message{MagicByte: magic, Codec: codec, Timestamp: time.Unix(1000, 0)}
+	for i, value := range values {
+		m.Set = append(m.Set, &protocol.MessageSet{
+			Offset:   offset + int64(i),
+			Messages: []*protocol.Message{{MagicByte: magic, Timestamp: time.Unix(1000, 0), Value: []byte(value)}},
+		})
+	}
+	b, err := protocol.Encode(&protocol.MessageSet{Messages: []*protocol.Message{m}})
+	require.NoError(t, err)
+	return b
+}
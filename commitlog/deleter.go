@@ -0,0 +1,81 @@
+package commitlog
+
+import (
+	"sync"
+	"time"
+
+	"github.com/travisjeffery/jocko/log"
+)
+
+const (
+	// deletedSuffix is added to the names of a deleted segment's files until
+	// they're removed.
+	deletedSuffix = ".deleted"
+
+	defaultFileDeleteDelay = time.Minute
+)
+
+// deleter removes the files of the segments deleted from a log once they've
+// waited out the delay, so readers that have the segments open can finish
+// reading them. Segments are deleted straight away if there's no delay.
+type deleter struct {
+	delay   time.Duration
+	logger  log.Logger
+	mu      sync.Mutex
+	pending map[*Segment]*time.Timer
+}
+
+func newDeleter(delay time.Duration, logger log.Logger) *deleter {
+	return &deleter{
+		delay:   delay,
+		logger:  logger,
+		pending: make(map[*Segment]*time.Timer),
+	}
+}
+
+// delete takes the segment out of the log by renaming its files with the
+// deleted suffix, and removes them after the delay.
+func (d *deleter) delete(s *Segment) error {
+	if d == nil || d.delay <= 0 {
+		return s.Delete()
+	}
+	if err := s.markDeleted(); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending[s] = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		delete(d.pending, s)
+		d.mu.Unlock()
+		d.remove(s)
+	})
+	return nil
+}
+
+func (d *deleter) remove(s *Segment) {
+	// the log carries on without the segment, and its files are removed
+	// when the log's reopened if they're left behind
+	if err := s.Delete(); err != nil && d.logger != nil {
+		d.logger.Error("failed to remove deleted segment", log.Int64("base offset", s.BaseOffset), log.Error("error", err))
+	}
+}
+
+// close removes the pending segments' files without waiting out the delay.
+func (d *deleter) close() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	var segments []*Segment
+	for s, timer := range d.pending {
+		if timer.Stop() {
+			segments = append(segments, s)
+		}
+		delete(d.pending, s)
+	}
+	d.mu.Unlock()
+	for _, s := range segments {
+		d.remove(s)
+	}
+}
@@ -0,0 +1,201 @@
+package commitlog
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// DumpSegment writes each entry of the segment whose log is at logPath to w,
+// then cross-checks the segment's indexes against its log. It reads the files
+// as they are rather than opening the log, so they aren't recovered or
+// truncated. It returns false if the segment's corrupt, the problems are
+// written to w.
+func DumpSegment(w io.Writer, logPath string) (bool, error) {
+	name := filepath.Base(logPath)
+	if !strings.HasSuffix(name, LogFileSuffix) {
+		return false, errors.Errorf("%s isn't a log file", logPath)
+	}
+	baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, LogFileSuffix), 10, 64)
+	if err != nil {
+		return false, errors.Wrap(err, "parse base offset failed")
+	}
+	d := &dumper{
+		w:          w,
+		baseOffset: baseOffset,
+		entries:    make(map[int64]int64),
+		offsets:    make(map[int64]bool),
+	}
+	fmt.Fprintf(w, "Dumping %s\n", logPath)
+	if err := d.dumpLog(logPath); err != nil {
+		return false, err
+	}
+	prefix := strings.TrimSuffix(logPath, LogFileSuffix)
+	if err := d.checkIndex(prefix + IndexFileSuffix); err != nil {
+		return false, err
+	}
+	if err := d.checkTimeIndex(prefix + TimeIndexFileSuffix); err != nil {
+		return false, err
+	}
+	return d.problems == 0, nil
+}
+
+type dumper struct {
+	w          io.Writer
+	baseOffset int64
+	// entries maps the positions of the log's entries to their offsets,
+	// offsets has the offsets of the log's records.
+	entries  map[int64]int64
+	offsets  map[int64]bool
+	problems int
+}
+
+func (d *dumper) problem(format string, args ...interface{}) {
+	d.problems++
+	fmt.Fprintf(d.w, "CORRUPT: "+format+"\n", args...)
+}
+
+func (d *dumper) dumpLog(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "read file failed")
+	}
+	lastOffset := d.baseOffset - 1
+	var position int64
+	for position+msgSetHeaderLen <= int64(len(b)) {
+		header := b[position : position+msgSetHeaderLen]
+		if isZero(header) {
+			fmt.Fprintf(d.w, "preallocated tail at position: %d\n", position)
+			return nil
+		}
+		ms := MessageSet(header)
+		end := position + int64(ms.Size())
+		if end > int64(len(b)) || ms.Size() <= msgSetHeaderLen {
+			d.problem("entry at position %d with size %d runs past the end of the log at %d", position, ms.Size(), len(b))
+			return nil
+		}
+		ms = MessageSet(b[position:end])
+		if ms.Offset() <= lastOffset {
+			d.problem("offset %d at position %d isn't after the previous offset %d", ms.Offset(), position, lastOffset)
+		}
+		d.dumpEntry(position, ms)
+		d.entries[position] = ms.Offset()
+		lastOffset = ms.LastOffset()
+		position = end
+	}
+	if position != int64(len(b)) {
+		d.problem("%d bytes after the last entry at position %d", int64(len(b))-position, position)
+	}
+	return nil
+}
+
+func (d *dumper) dumpEntry(position int64, ms MessageSet) {
+	payload := ms.Payload()
+	m := Message(payload)
+	var valid bool
+	var timestamp int64
+	var codec protocol.CompressionCodec
+	if ms.isBatch() {
+		rb := RecordBatch(ms)
+		valid = rb.Valid()
+		timestamp = rb.MaxTimestamp()
+		codec = rb.Codec()
+	} else {
+		valid = m.Valid()
+		timestamp = m.Timestamp()
+		codec = m.Codec()
+	}
+	fmt.Fprintf(d.w, "offset: %d position: %d size: %d magic: %d compresscodec: %d timestamp: %d isvalid: %t\n",
+		ms.Offset(), position, ms.Size(), m.MagicByte(), int8(codec), timestamp, valid)
+	if !valid {
+		d.problem("entry at offset %d fails its CRC check", ms.Offset())
+		return
+	}
+	err := ms.Records(func(r Record) error {
+		d.offsets[r.Offset] = true
+		fmt.Fprintf(d.w, "| offset: %d timestamp: %d key: %s headers: %d\n", r.Offset, r.Timestamp, formatKey(r.Key), len(r.Headers))
+		return nil
+	})
+	if err == ErrCompressedEntry {
+		// the records can't be listed, but the entry's offset is known
+		d.offsets[ms.Offset()] = true
+	} else if err != nil {
+		d.problem("entry at offset %d: %v", ms.Offset(), err)
+	}
+}
+
+func formatKey(key []byte) string {
+	if key == nil {
+		return "null"
+	}
+	return strconv.Quote(string(key))
+}
+
+// checkIndex checks each of the offset index's entries points at the entry
+// with its offset in the log.
+func (d *dumper) checkIndex(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(d.w, "no index %s\n", path)
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read file failed")
+	}
+	fmt.Fprintf(d.w, "Checking %s\n", path)
+	last := Entry{Offset: -1, Position: -1}
+	for i := 0; i+entryWidth <= len(b); i += entryWidth {
+		rel := int64(Encoding.Uint32(b[i+offsetOffset:]))
+		// only the first entry has a relative offset of zero, the rest of
+		// the preallocated file is unused
+		if i > 0 && rel == 0 {
+			break
+		}
+		e := Entry{Offset: d.baseOffset + rel, Position: int64(Encoding.Uint32(b[i+positionOffset:]))}
+		if e.Offset <= last.Offset || e.Position <= last.Position {
+			d.problem("index entry %d for offset %d at position %d isn't after the previous entry", i/entryWidth, e.Offset, e.Position)
+		}
+		if offset, ok := d.entries[e.Position]; !ok || offset != e.Offset {
+			d.problem("index entry %d for offset %d at position %d doesn't match the log", i/entryWidth, e.Offset, e.Position)
+		}
+		last = e
+	}
+	return nil
+}
+
+// checkTimeIndex checks the time index's timestamps are increasing and its
+// offsets are in the log.
+func (d *dumper) checkTimeIndex(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Fprintf(d.w, "no time index %s\n", path)
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read file failed")
+	}
+	fmt.Fprintf(d.w, "Checking %s\n", path)
+	last := TimeEntry{Timestamp: -1, Offset: -1}
+	for i := 0; i+timeEntryWidth <= len(b); i += timeEntryWidth {
+		ts := int64(Encoding.Uint64(b[i+timestampOffset:]))
+		// timestamps are positive, the rest of the preallocated file is
+		// unused
+		if ts == 0 {
+			break
+		}
+		e := TimeEntry{Timestamp: ts, Offset: d.baseOffset + int64(int32(Encoding.Uint32(b[i+timeOffsetOffset:])))}
+		if e.Timestamp <= last.Timestamp || e.Offset <= last.Offset {
+			d.problem("time index entry %d for timestamp %d at offset %d isn't after the previous entry", i/timeEntryWidth, e.Timestamp, e.Offset)
+		}
+		if !d.offsets[e.Offset] {
+			d.problem("time index entry %d for timestamp %d is for offset %d which isn't in the log", i/timeEntryWidth, e.Timestamp, e.Offset)
+		}
+		last = e
+	}
+	return nil
+}
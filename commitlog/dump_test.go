@@ -0,0 +1,74 @@
+package commitlog_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestDumpSegment(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	l, err := commitlog.New(commitlog.Options{
+		Path:               path,
+		MaxLogBytes:        -1,
+		IndexIntervalBytes: 1,
+	})
+	require.NoError(t, err)
+	for i := int64(0); i < 3; i++ {
+		b, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: time.Unix(0, (i+1)*int64(time.Second)),
+			Key:       []byte(fmt.Sprintf("key-%d", i)),
+			Value:     []byte("value"),
+		})
+		require.NoError(t, err)
+		_, err = l.Append(commitlog.NewMessageSet(0, commitlog.NewMessage(b)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	logPath := filepath.Join(path, fmt.Sprintf("%020d.log", 0))
+	dump := func() (bool, string) {
+		var buf bytes.Buffer
+		valid, err := commitlog.DumpSegment(&buf, logPath)
+		require.NoError(t, err)
+		return valid, buf.String()
+	}
+	valid, out := dump()
+	require.True(t, valid, out)
+	require.Contains(t, out, "offset: 2 position: ")
+	require.Contains(t, out, `| offset: 1 timestamp: 2000 key: "key-1"`)
+
+	// a corrupt message fails its CRC check
+	b, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	corrupt := append([]byte(nil), b...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(logPath, corrupt, 0666))
+	valid, out = dump()
+	require.False(t, valid)
+	require.Contains(t, out, "CORRUPT: entry at offset 2 fails its CRC check")
+	require.NoError(t, ioutil.WriteFile(logPath, b, 0666))
+
+	// an index entry that points into the middle of an entry doesn't match
+	// the log
+	indexPath := filepath.Join(path, fmt.Sprintf("%020d.index", 0))
+	index, err := ioutil.ReadFile(indexPath)
+	require.NoError(t, err)
+	require.Equal(t, 3*8, len(index))
+	commitlog.Encoding.PutUint32(index[12:], 1)
+	require.NoError(t, ioutil.WriteFile(indexPath, index, 0666))
+	valid, out = dump()
+	require.False(t, valid)
+	require.Contains(t, out, "CORRUPT: index entry 1 for offset 1 at position 1 doesn't match the log")
+}
@@ -3,7 +3,9 @@ package commitlog
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -121,6 +123,37 @@ func (idx *index) ReadEntry(e *Entry, offset int64) error {
 	return nil
 }
 
+// Lookup fills e with the last entry at or before offset. If the index has no
+// such entry e is the start of the segment.
+func (idx *index) Lookup(e *Entry, offset int64) error {
+	idx.mu.RLock()
+	n := int(idx.position / entryWidth)
+	idx.mu.RUnlock()
+	var err error
+	i := sort.Search(n, func(i int) bool {
+		if rerr := idx.ReadEntry(e, int64(i*entryWidth)); rerr != nil {
+			err = rerr
+		}
+		return e.Offset > offset
+	})
+	if err != nil {
+		return err
+	}
+	if i == 0 {
+		e.Offset = idx.baseOffset
+		e.Position = 0
+		return nil
+	}
+	return idx.ReadEntry(e, int64((i-1)*entryWidth))
+}
+
+// IsFull returns whether there's no room for another entry.
+func (idx *index) IsFull() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.position+entryWidth > int64(len(idx.mmap))
+}
+
 func (idx *index) ReadAt(p []byte, offset int64) (n int) {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
@@ -159,6 +192,13 @@ func (idx *index) Close() (err error) {
 	return idx.file.Close()
 }
 
+// section returns a reader of the entries written to the index.
+func (idx *index) section() io.Reader {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return io.NewSectionReader(idx.file, 0, idx.position)
+}
+
 func (idx *index) Name() string {
 	return idx.file.Name()
 }
@@ -173,6 +213,40 @@ func (idx *index) TruncateEntries(number int) error {
 	return nil
 }
 
+// entriesBefore returns the number of entries with offsets before offset.
+func (idx *index) entriesBefore(offset int64) (int, error) {
+	idx.mu.RLock()
+	n := int(idx.position / entryWidth)
+	idx.mu.RUnlock()
+	var err error
+	e := &Entry{}
+	i := sort.Search(n, func(i int) bool {
+		if rerr := idx.ReadEntry(e, int64(i*entryWidth)); rerr != nil {
+			err = rerr
+		}
+		return e.Offset >= offset
+	})
+	return i, err
+}
+
+// validEntries returns the number of entries written to the index. The index
+// file is preallocated with zeros so its size can't be trusted after a crash,
+// instead entries are counted up to where their relative offsets stop
+// increasing.
+func (idx *index) validEntries() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	n := idx.position / entryWidth
+	if n == 0 {
+		return 0
+	}
+	// only the first entry can have a relative offset of zero
+	return 1 + int64(sort.Search(int(n-1), func(i int) bool {
+		pos := int64(i+1) * entryWidth
+		return Encoding.Uint32(idx.mmap[pos:pos+offsetWidth]) == 0
+	}))
+}
+
 func (idx *index) SanityCheck() error {
 	idx.mu.RLock()
 	defer idx.mu.RUnlock()
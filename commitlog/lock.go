@@ -0,0 +1,49 @@
+package commitlog
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// LockFileName is the name of the lock file a process holds in the dirs it
+// owns.
+const LockFileName = ".lock"
+
+// ErrLocked is the cause of the error returned when another process holds
+// the lock.
+var ErrLocked = errors.New("locked by another process")
+
+// FileLock is an exclusive lock on a file, held until it's unlocked or the
+// process exits.
+type FileLock struct {
+	file *os.File
+}
+
+// Lock takes an exclusive lock on the file at path, creating it if it doesn't
+// exist. It fails straight away with ErrLocked as the cause, rather than
+// waiting, if the lock's held, so two processes can't write to the same dir.
+func Lock(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file failed")
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "lock %s failed", path)
+	}
+	return &FileLock{file: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := unlockFile(l.file)
+	if cerr := l.file.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "close file failed")
+	}
+	l.file = nil
+	return err
+}
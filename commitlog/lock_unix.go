@@ -0,0 +1,28 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package commitlog
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	if err != nil {
+		return errors.Wrap(err, "flock failed")
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		return errors.Wrap(err, "flock failed")
+	}
+	return nil
+}
@@ -1,7 +1,108 @@
 package commitlog
 
+import "hash/crc32"
+
+// Message is a message in the Kafka format:
+//
+//   crc(4) magic(1) attributes(1) [timestamp(8) if magic > 0] key(bytes) value(bytes)
+//
+// where bytes is a 4 byte length followed by that many bytes, and a length of
+// -1 means null.
 type Message []byte
 
+const (
+	crcPos        = 0
+	magicPos      = 4
+	attributesPos = 5
+	timestampPos  = 6
+)
+
 func NewMessage(p []byte) Message {
 	return Message(p)
 }
+
+func (m Message) Crc() int32 {
+	if len(m) < crcPos+4 {
+		return 0
+	}
+	return int32(Encoding.Uint32(m[crcPos : crcPos+4]))
+}
+
+func (m Message) MagicByte() int8 {
+	if len(m) <= magicPos {
+		return 0
+	}
+	return int8(m[magicPos])
+}
+
+func (m Message) Attributes() int8 {
+	if len(m) <= attributesPos {
+		return 0
+	}
+	return int8(m[attributesPos])
+}
+
+// Timestamp returns the message's timestamp in milliseconds, or -1 if the
+// message's version doesn't have one.
+func (m Message) Timestamp() int64 {
+	if m.MagicByte() == 0 || len(m) < timestampPos+8 {
+		return -1
+	}
+	return int64(Encoding.Uint64(m[timestampPos : timestampPos+8]))
+}
+
+// Valid returns whether the message is long enough to hold its fields and its
+// CRC matches its contents.
+func (m Message) Valid() bool {
+	if _, _, ok := m.fields(); !ok {
+		return false
+	}
+	return crc32.ChecksumIEEE(m[magicPos:]) == uint32(m.Crc())
+}
+
+// Key returns the message's key, nil if the key is null or the message is
+// malformed.
+func (m Message) Key() []byte {
+	key, _, _ := m.fields()
+	return key
+}
+
+// Value returns the message's value, nil if the value is null or the message
+// is malformed.
+func (m Message) Value() []byte {
+	_, value, _ := m.fields()
+	return value
+}
+
+// fields parses the message's key and value. ok is false if the message is
+// too short to hold them.
+func (m Message) fields() (key, value []byte, ok bool) {
+	pos := timestampPos
+	if m.MagicByte() > 0 {
+		pos += 8
+	}
+	key, pos, ok = m.bytesAt(pos)
+	if !ok {
+		return nil, nil, false
+	}
+	value, _, ok = m.bytesAt(pos)
+	if !ok {
+		return nil, nil, false
+	}
+	return key, value, true
+}
+
+func (m Message) bytesAt(pos int) ([]byte, int, bool) {
+	if len(m) < pos+4 {
+		return nil, pos, false
+	}
+	n := int(int32(Encoding.Uint32(m[pos : pos+4])))
+	pos += 4
+	if n < 0 {
+		return nil, pos, true
+	}
+	if len(m) < pos+n {
+		return nil, pos, false
+	}
+	return m[pos : pos+n], pos + n, true
+}
@@ -4,6 +4,9 @@ const (
 	offsetPos       = 0
 	sizePos         = 8
 	msgSetHeaderLen = 12
+	// entryHeaderLen is how much of an entry's start is read to find its
+	// offsets, up to a record batch's last offset delta.
+	entryHeaderLen = batchLastOffsetDeltaPos + 4
 )
 
 type MessageSet []byte
@@ -35,3 +38,52 @@ func (ms MessageSet) Size() int32 {
 func (ms MessageSet) Payload() []byte {
 	return ms[msgSetHeaderLen:]
 }
+
+// LastOffset returns the offset of the entry's last message. It's the entry's
+// offset unless the entry's a record batch, which has an offset for each of
+// its records. Only the entry's first entryHeaderLen bytes are needed.
+func (ms MessageSet) LastOffset() int64 {
+	if len(ms) >= entryHeaderLen && ms.isBatch() {
+		return ms.Offset() + int64(int32(Encoding.Uint32(ms[batchLastOffsetDeltaPos:])))
+	}
+	return ms.Offset()
+}
+
+// Entries splits b, entries one after another as in a produce request's or
+// fetch response's record set, into its entries. A partial entry at the end
+// of b is left out.
+func Entries(b []byte) []MessageSet {
+	var entries []MessageSet
+	for len(b) >= msgSetHeaderLen {
+		size := int64(Encoding.Uint32(b[sizePos:sizePos+4])) + msgSetHeaderLen
+		if size > int64(len(b)) {
+			break
+		}
+		entries = append(entries, MessageSet(b[:size]))
+		b = b[size:]
+	}
+	return entries
+}
+
+// isBatch returns whether the entry's a record batch rather than a legacy
+// message, by its magic byte which is at the same position in both.
+func (ms MessageSet) isBatch() bool {
+	return len(ms) > batchMagicPos && ms[batchMagicPos] == batchMagic
+}
+
+// valid returns whether the entry's CRC matches its contents.
+func (ms MessageSet) valid() bool {
+	if ms.isBatch() {
+		return RecordBatch(ms).Valid()
+	}
+	return Message(ms.Payload()).Valid()
+}
+
+// timestamp returns the newest timestamp of the entry's messages in
+// milliseconds, -1 if they don't have timestamps.
+func (ms MessageSet) timestamp() int64 {
+	if ms.isBatch() {
+		return RecordBatch(ms).MaxTimestamp()
+	}
+	return Message(ms.Payload()).Timestamp()
+}
@@ -3,47 +3,153 @@ package commitlog
 import (
 	"io"
 	"sync"
+
+	"github.com/travisjeffery/jocko/protocol"
 )
 
+// Reader reads the log's entries from an offset. It returns at most
+// maxBytes and only whole entries, unless the first entry is bigger than
+// maxBytes in which case it's returned by itself so the caller can make
+// progress.
 type Reader struct {
-	cl  *CommitLog
-	idx int
-	mu  sync.Mutex
-	pos int64
+	cl *CommitLog
+	// segment is the segment being read, it's kept rather than its index in
+	// the log so the reader isn't moved when older segments are deleted.
+	segment *Segment
+	mu      sync.Mutex
+	pos     int64
+	// maxBytes is the most the reader returns, read is how much it's
+	// allowed through so far.
+	maxBytes int32
+	read     int32
+	// entryEnd is the position in the segment the entry being read ends at,
+	// entryOffset is the offset of its last message.
+	entryEnd    int64
+	entryOffset int64
+	lastOffset  int64
 }
 
 func (r *Reader) Read(p []byte) (n int, err error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	segments := r.cl.Segments()
-	segment := segments[r.idx]
-
-	var readSize int
-	for {
-		readSize, err = segment.ReadAt(p[n:], r.pos)
+	for n < len(p) {
+		if r.pos == r.entryEnd {
+			if err = r.nextEntry(); err != nil {
+				return n, err
+			}
+		}
+		end := len(p)
+		if rem := r.entryEnd - r.pos; int64(end-n) > rem {
+			end = n + int(rem)
+		}
+		readSize, err := r.segment.ReadAt(p[n:end], r.pos)
 		n += readSize
 		r.pos += int64(readSize)
-		if readSize != 0 && err == nil {
-			continue
+		if r.pos == r.entryEnd {
+			r.lastOffset = r.entryOffset
 		}
-		if n == len(p) || err != io.EOF {
-			break
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if readSize == 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+
+	return n, nil
+}
+
+// FileRegions reads the rest of the entries the reader's allowed to return
+// as regions of their segment files, rather than copying them, so they can be
+// sent from the files.
+func (r *Reader) FileRegions() ([]protocol.FileRegion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var regions []protocol.FileRegion
+	add := func() {
+		// entries next to each other in a segment share a region
+		log := r.segment.log
+		if n := len(regions); n > 0 && regions[n-1].File == log && regions[n-1].Offset+regions[n-1].Length == r.pos {
+			regions[n-1].Length += r.entryEnd - r.pos
+		} else {
+			regions = append(regions, protocol.FileRegion{File: log, Offset: r.pos, Length: r.entryEnd - r.pos})
 		}
-		if len(segments) <= r.idx+1 {
-			err = io.EOF
+		r.pos = r.entryEnd
+		r.lastOffset = r.entryOffset
+	}
+	// the rest of an entry that's been partly read
+	if r.pos < r.entryEnd {
+		add()
+	}
+	for {
+		err := r.nextEntry()
+		if err == io.EOF {
+			return regions, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		add()
+	}
+}
+
+// nextEntry moves the reader on to the next entry, onto the next segment if
+// it's at the end of this one. It returns io.EOF if there's no next entry
+// or it'd take the reader past maxBytes.
+func (r *Reader) nextEntry() error {
+	b := make([]byte, entryHeaderLen)
+	var ms MessageSet
+	for {
+		// the segment's log can run past its entries if it's preallocated
+		if r.pos < r.segment.position() {
+			var err error
+			if ms, err = r.segment.readEntryHeader(b, r.pos); err != nil {
+				return err
+			}
 			break
 		}
-		r.idx++
-		segment = segments[r.idx]
+		// the end of the segment, carry on from the next one
+		next, err := r.cl.nextSegment(r.segment)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return io.EOF
+		}
+		r.segment = next
 		r.pos = 0
+		r.entryEnd = 0
+	}
+	size := ms.Size()
+	if r.read > 0 && r.read+size > r.maxBytes {
+		return io.EOF
 	}
+	r.read += size
+	r.entryOffset = ms.LastOffset()
+	r.entryEnd = r.pos + int64(size)
+	return nil
+}
 
-	return n, err
+// LastOffset returns the offset of the last entry that's been read in full,
+// -1 if there isn't one.
+func (r *Reader) LastOffset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastOffset
 }
 
+// NewReader returns a reader of the log's entries from the first at or after
+// offset, returning at most maxBytes.
 func (l *CommitLog) NewReader(offset int64, maxBytes int32) (io.Reader, error) {
-	s, idx := findSegment(l.Segments(), offset)
+	if offset > l.NewestOffset() {
+		return nil, ErrSegmentNotFound
+	}
+	s, err := l.segmentFor(offset)
+	if err != nil {
+		return nil, err
+	}
 	if s == nil {
 		return nil, ErrSegmentNotFound
 	}
@@ -52,8 +158,11 @@ func (l *CommitLog) NewReader(offset int64, maxBytes int32) (io.Reader, error) {
 		return nil, err
 	}
 	return &Reader{
-		cl:  l,
-		idx: idx,
-		pos: e.Position,
+		cl:         l,
+		segment:    s,
+		pos:        e.Position,
+		entryEnd:   e.Position,
+		maxBytes:   maxBytes,
+		lastOffset: -1,
 	}, nil
 }
@@ -0,0 +1,167 @@
+package commitlog
+
+import (
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+var (
+	// ErrStopScan is returned by a Scan func to stop scanning, Scan returns
+	// nil rather than it.
+	ErrStopScan        = errors.New("stop scan")
+	ErrMalformedEntry  = errors.New("malformed entry")
+	ErrCompressedEntry = errors.New("entries compressed with an unknown codec aren't supported")
+)
+
+// Record is a message read from the log, from a message in the legacy format
+// or a record in a v2 record batch.
+type Record struct {
+	Offset int64
+	// Timestamp is in milliseconds, -1 if the message doesn't have one.
+	Timestamp int64
+	Key       []byte
+	Value     []byte
+	// Headers are only in v2 records.
+	Headers []Header
+}
+
+// Header is a key and value attached to a record.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Records calls fn with each of the entry's records, stopping at the first
+// error. A legacy entry has one message or a compressed message wrapping
+// several, a v2 entry is a record batch.
+func (ms MessageSet) Records(fn func(Record) error) error {
+	payload := ms.Payload()
+	if len(payload) <= magicPos {
+		return ErrMalformedEntry
+	}
+	if ms.isBatch() {
+		return RecordBatch(ms).Records(fn)
+	}
+	m := Message(payload)
+	key, value, ok := m.fields()
+	if !ok {
+		return ErrMalformedEntry
+	}
+	if m.Codec() != protocol.CompressionNone {
+		return ms.wrappedRecords(fn)
+	}
+	return fn(Record{
+		Offset:    ms.Offset(),
+		Timestamp: m.Timestamp(),
+		Key:       key,
+		Value:     value,
+	})
+}
+
+// DownConvert converts the record batches among the entries in b to legacy
+// magic 1 messages, for fetchers too old to read batches. Each record becomes
+// an entry of its own and its headers are dropped. b is returned as it is if
+// it doesn't have any batches, otherwise a partial entry at its end is left
+// out.
+func DownConvert(b []byte) ([]byte, error) {
+	entries := Entries(b)
+	var batches bool
+	for _, ms := range entries {
+		if ms.isBatch() {
+			batches = true
+			break
+		}
+	}
+	if !batches {
+		return b, nil
+	}
+	var converted []byte
+	for _, ms := range entries {
+		if !ms.isBatch() {
+			converted = append(converted, ms...)
+			continue
+		}
+		err := RecordBatch(ms).Records(func(r Record) error {
+			converted = appendMessage(converted, 1, 0, r)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return converted, nil
+}
+
+// appendMessage appends an entry holding the record as a message with the
+// magic and attributes to b. Its timestamp's left out of magic 0 messages.
+func appendMessage(b []byte, magic, attributes int8, r Record) []byte {
+	pos := timestampPos
+	if magic > 0 {
+		pos += 8
+	}
+	size := pos + 4 + len(r.Key) + 4 + len(r.Value)
+	start := len(b)
+	b = append(b, make([]byte, msgSetHeaderLen+size)...)
+	ms := MessageSet(b[start:])
+	ms.PutOffset(r.Offset)
+	Encoding.PutUint32(ms[sizePos:], uint32(size))
+	m := ms.Payload()
+	m[magicPos] = byte(magic)
+	m[attributesPos] = byte(attributes)
+	if magic > 0 {
+		Encoding.PutUint64(m[timestampPos:], uint64(r.Timestamp))
+	}
+	pos = putBytes(m, pos, r.Key)
+	putBytes(m, pos, r.Value)
+	Encoding.PutUint32(m[crcPos:], crc32.ChecksumIEEE(m[magicPos:]))
+	return b
+}
+
+// putBytes puts p at pos in b as a 4 byte length followed by p, a length of
+// -1 if p is nil, and returns the position after it.
+func putBytes(b []byte, pos int, p []byte) int {
+	if p == nil {
+		Encoding.PutUint32(b[pos:], 0xffffffff)
+		return pos + 4
+	}
+	Encoding.PutUint32(b[pos:], uint32(len(p)))
+	return pos + 4 + copy(b[pos+4:], p)
+}
+
+// Scan calls fn with each of the log's records from the first at or after
+// from, in order, so callers needn't parse the entries NewReader returns. It
+// stops at the first error fn returns, returning nil if it's ErrStopScan.
+func (l *CommitLog) Scan(from int64, fn func(Record) error) error {
+	s, err := l.segmentFor(from)
+	if err != nil || s == nil {
+		return err
+	}
+	e, err := s.findEntry(from)
+	if err != nil {
+		return err
+	}
+	position := e.Position
+	for s != nil {
+		err := s.forEachEntryFrom(position, func(_ int64, ms MessageSet) error {
+			return ms.Records(func(r Record) error {
+				if r.Offset < from {
+					return nil
+				}
+				return fn(r)
+			})
+		})
+		if err == ErrStopScan {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		position = 0
+		if s, err = l.nextSegment(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
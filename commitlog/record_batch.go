@@ -0,0 +1,236 @@
+package commitlog
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+// RecordBatch is a batch of records in the v2 Kafka format, magic 2:
+//
+//   baseOffset(8) batchLength(4) partitionLeaderEpoch(4) magic(1) crc(4)
+//   attributes(2) lastOffsetDelta(4) firstTimestamp(8) maxTimestamp(8)
+//   producerId(8) producerEpoch(2) baseSequence(4) records(array)
+//
+// where each record is:
+//
+//   length(varint) attributes(1) timestampDelta(varint) offsetDelta(varint)
+//   key(varbytes) value(varbytes) headers(array of key(varbytes) value(varbytes))
+//
+// varbytes is a varint length followed by that many bytes, and a length of -1
+// means null. The batch starts with the same offset and size header as a
+// message set, so it's stored as a log entry as is.
+type RecordBatch []byte
+
+const (
+	batchMagicPos           = 16
+	batchCrcPos             = 17
+	batchAttributesPos      = 21
+	batchLastOffsetDeltaPos = 23
+	batchFirstTimestampPos  = 27
+	batchMaxTimestampPos    = 35
+	batchProducerIDPos      = 43
+	batchProducerEpochPos   = 51
+	batchBaseSequencePos    = 53
+	batchRecordsPos         = 57
+	recordBatchHeaderLen    = 61
+
+	// batchMagic is the magic byte of record batches.
+	batchMagic = 2
+
+	// compressionCodecMask masks the codec from a message's or batch's
+	// attributes.
+	compressionCodecMask = 0x07
+	// timestampTypeMask is set in a batch's attributes if its records'
+	// timestamp is the batch's max timestamp, the time it was appended.
+	timestampTypeMask = 0x08
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (b RecordBatch) BaseOffset() int64 {
+	return MessageSet(b).Offset()
+}
+
+func (b RecordBatch) MagicByte() int8 {
+	if len(b) <= batchMagicPos {
+		return 0
+	}
+	return int8(b[batchMagicPos])
+}
+
+func (b RecordBatch) Attributes() int16 {
+	if len(b) < recordBatchHeaderLen {
+		return 0
+	}
+	return int16(Encoding.Uint16(b[batchAttributesPos:]))
+}
+
+// LastOffsetDelta returns the offset of the batch's last record relative to
+// its base offset.
+func (b RecordBatch) LastOffsetDelta() int32 {
+	if len(b) < recordBatchHeaderLen {
+		return 0
+	}
+	return int32(Encoding.Uint32(b[batchLastOffsetDeltaPos:]))
+}
+
+// FirstTimestamp and MaxTimestamp return the timestamps of the batch's first
+// record and newest record in milliseconds.
+func (b RecordBatch) FirstTimestamp() int64 {
+	if len(b) < recordBatchHeaderLen {
+		return -1
+	}
+	return int64(Encoding.Uint64(b[batchFirstTimestampPos:]))
+}
+
+func (b RecordBatch) MaxTimestamp() int64 {
+	if len(b) < recordBatchHeaderLen {
+		return -1
+	}
+	return int64(Encoding.Uint64(b[batchMaxTimestampPos:]))
+}
+
+func (b RecordBatch) ProducerID() int64 {
+	if len(b) < recordBatchHeaderLen {
+		return -1
+	}
+	return int64(Encoding.Uint64(b[batchProducerIDPos:]))
+}
+
+func (b RecordBatch) ProducerEpoch() int16 {
+	if len(b) < recordBatchHeaderLen {
+		return -1
+	}
+	return int16(Encoding.Uint16(b[batchProducerEpochPos:]))
+}
+
+func (b RecordBatch) BaseSequence() int32 {
+	if len(b) < recordBatchHeaderLen {
+		return -1
+	}
+	return int32(Encoding.Uint32(b[batchBaseSequencePos:]))
+}
+
+// NumRecords returns how many records the batch says it has.
+func (b RecordBatch) NumRecords() int32 {
+	if len(b) < recordBatchHeaderLen {
+		return 0
+	}
+	return int32(Encoding.Uint32(b[batchRecordsPos:]))
+}
+
+// Valid returns whether the batch is long enough to hold its header and its
+// CRC matches its contents.
+func (b RecordBatch) Valid() bool {
+	if len(b) < recordBatchHeaderLen || int(MessageSet(b).Size()) != len(b) {
+		return false
+	}
+	return crc32.Checksum(b[batchAttributesPos:], castagnoli) == Encoding.Uint32(b[batchCrcPos:])
+}
+
+// Records calls fn with each of the batch's records, stopping at the first
+// error.
+func (b RecordBatch) Records(fn func(Record) error) error {
+	if len(b) < recordBatchHeaderLen {
+		return ErrMalformedEntry
+	}
+	// the records count isn't compressed, the records are
+	records := []byte(b[recordBatchHeaderLen:])
+	if codec := b.Codec(); codec != protocol.CompressionNone {
+		var err error
+		if records, err = decompress(codec, records); err != nil {
+			return err
+		}
+	}
+	baseOffset := b.BaseOffset()
+	firstTimestamp := b.FirstTimestamp()
+	logAppendTime := b.Attributes()&timestampTypeMask != 0
+	var pos int
+	for i := int32(0); i < b.NumRecords(); i++ {
+		length, next, ok := varintAt(records, pos)
+		if !ok || length < 0 || int64(len(records)-next) < length {
+			return ErrMalformedEntry
+		}
+		r, ok := parseRecord(records[next : next+int(length)])
+		if !ok {
+			return ErrMalformedEntry
+		}
+		r.Offset += baseOffset
+		if logAppendTime {
+			r.Timestamp = b.MaxTimestamp()
+		} else {
+			r.Timestamp += firstTimestamp
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+		pos = next + int(length)
+	}
+	return nil
+}
+
+// parseRecord parses a record from a batch, its offset and timestamp are
+// relative to the batch's.
+func parseRecord(b []byte) (r Record, ok bool) {
+	// attributes are unused
+	pos := 1
+	if len(b) < pos {
+		return r, false
+	}
+	if r.Timestamp, pos, ok = varintAt(b, pos); !ok {
+		return r, false
+	}
+	if r.Offset, pos, ok = varintAt(b, pos); !ok {
+		return r, false
+	}
+	if r.Key, pos, ok = varbytesAt(b, pos); !ok {
+		return r, false
+	}
+	if r.Value, pos, ok = varbytesAt(b, pos); !ok {
+		return r, false
+	}
+	n, pos, ok := varintAt(b, pos)
+	if !ok || n < 0 || n > int64(len(b)) {
+		return r, false
+	}
+	for i := int64(0); i < n; i++ {
+		var h Header
+		var key []byte
+		if key, pos, ok = varbytesAt(b, pos); !ok {
+			return r, false
+		}
+		if h.Value, pos, ok = varbytesAt(b, pos); !ok {
+			return r, false
+		}
+		h.Key = string(key)
+		r.Headers = append(r.Headers, h)
+	}
+	return r, true
+}
+
+func varintAt(b []byte, pos int) (int64, int, bool) {
+	if pos > len(b) {
+		return 0, pos, false
+	}
+	v, n := binary.Varint(b[pos:])
+	if n <= 0 {
+		return 0, pos, false
+	}
+	return v, pos + n, true
+}
+
+func varbytesAt(b []byte, pos int) ([]byte, int, bool) {
+	n, pos, ok := varintAt(b, pos)
+	if !ok {
+		return nil, pos, false
+	}
+	if n < 0 {
+		return nil, pos, true
+	}
+	if int64(len(b)-pos) < n {
+		return nil, pos, false
+	}
+	return b[pos : pos+int(n)], pos + int(n), true
+}
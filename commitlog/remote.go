@@ -0,0 +1,111 @@
+package commitlog
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RemoteStorage stores the files of a log's closed segments off the broker's
+// disks, in an object store for example. Names are slash separated, a log's
+// files are stored under a dir named after the log.
+type RemoteStorage interface {
+	// Put stores what's read from r under name, replacing anything stored
+	// there. Nothing's stored under name if it fails.
+	Put(name string, r io.Reader) error
+	// Get returns a reader of what's stored under name.
+	Get(name string) (io.ReadCloser, error)
+	// List returns the names of what's stored in the dir, relative to it.
+	List(dir string) ([]string, error)
+	// Stat returns the size of what's stored under name and when it was
+	// stored.
+	Stat(name string) (size int64, modTime time.Time, err error)
+	// Delete removes what's stored under name.
+	Delete(name string) error
+}
+
+// DirStorage is a RemoteStorage that stores files in a local dir, like an
+// object store's bucket. It's useful for tests and for offloading segments to
+// a mounted network filesystem.
+type DirStorage struct {
+	Dir string
+}
+
+func NewDirStorage(dir string) *DirStorage {
+	return &DirStorage{Dir: dir}
+}
+
+func (s *DirStorage) path(name string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(name))
+}
+
+// Put writes to a temporary file that's renamed to name once it's complete.
+func (s *DirStorage) Put(name string, r io.Reader) error {
+	path := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrap(err, "mkdir failed")
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open file failed")
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "write file failed")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrap(err, "rename file failed")
+	}
+	return nil
+}
+
+func (s *DirStorage) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "open file failed")
+	}
+	return f, nil
+}
+
+func (s *DirStorage) List(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(s.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "read dir failed")
+	}
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) != ".tmp" {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *DirStorage) Stat(name string) (int64, time.Time, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return 0, time.Time{}, errors.Wrap(err, "stat file failed")
+	}
+	return fi.Size(), fi.ModTime(), nil
+}
+
+func (s *DirStorage) Delete(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove file failed")
+	}
+	return nil
+}
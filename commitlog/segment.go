@@ -1,145 +1,335 @@
 package commitlog
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"sort"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 const (
-	logNameFormat   = "%020d.log"
-	indexNameFormat = "%020d.index"
+	logNameFormat       = "%020d.log"
+	indexNameFormat     = "%020d.index"
+	timeIndexNameFormat = "%020d.timeindex"
+	cleanedSuffix       = ".cleaned"
+	// swapSuffix is added to the names of a cleaned segment's files while
+	// it's swapped in for the segment it was cleaned from.
+	swapSuffix = ".swap"
 )
 
 type Segment struct {
-	writer     io.Writer
 	reader     io.Reader
 	log        *os.File
 	Index      *index
+	TimeIndex  *timeIndex
 	BaseOffset int64
 	NextOffset int64
 	Position   int64
-	maxBytes   int64
+	segmentOptions
+	// bytesSinceLastIndexEntry is how many bytes have been appended since the
+	// last offset index entry was written.
+	bytesSinceLastIndexEntry int64
+	// discarded is the number of bytes truncated from the log's tail when
+	// the segment was opened because they weren't valid entries.
+	discarded int64
+	// maxTimestamp is the newest timestamp of the segment's messages, -1 if
+	// none of them have timestamps.
+	maxTimestamp int64
+	// deleted is whether the segment's files have been renamed with the
+	// deleted suffix, waiting to be removed.
+	deleted bool
+	// firstAppend is when the segment's first entry was appended, or when its
+	// log was last modified if it was reopened with entries. The segment's
+	// age is measured from it.
+	firstAppend time.Time
 
 	sync.Mutex
 }
 
+type segmentOptions struct {
+	path     string
+	maxBytes int64
+	// maxIndexBytes is the size the segment's indexes are preallocated to,
+	// zero uses the index's default.
+	maxIndexBytes int64
+	// indexIntervalBytes is how many bytes are appended between offset index
+	// entries, zero indexes every entry.
+	indexIntervalBytes int64
+	// suffix follows the usual extensions in the segment's file names, used
+	// for segments that are being rewritten.
+	suffix string
+	// deleter removes the segment's files when it's deleted from the log.
+	deleter *deleter
+	// preallocate is whether a new segment's log is preallocated to maxBytes,
+	// the unused tail is trimmed when the segment's closed.
+	preallocate bool
+}
+
 func NewSegment(path string, baseOffset int64, maxBytes int64) (*Segment, error) {
-	logPath := filepath.Join(path, fmt.Sprintf(logNameFormat, baseOffset))
-	log, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	return newSegment(baseOffset, segmentOptions{path: path, maxBytes: maxBytes}, true)
+}
+
+// newSegment opens the segment at baseOffset. If recover is false the
+// segment's existing index is trusted rather than rebuilt from the log.
+func newSegment(baseOffset int64, opts segmentOptions, recover bool) (*Segment, error) {
+	logPath := filepath.Join(opts.path, fmt.Sprintf(logNameFormat, baseOffset)+opts.suffix)
+	log, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, errors.Wrap(err, "open file failed")
 	}
 
 	s := &Segment{
-		log:        log,
-		writer:     log,
-		reader:     log,
-		maxBytes:   maxBytes,
-		BaseOffset: baseOffset,
-		NextOffset: baseOffset,
+		log:            log,
+		reader:         log,
+		segmentOptions: opts,
+		BaseOffset:     baseOffset,
+		NextOffset:     baseOffset,
+		maxTimestamp:   -1,
 	}
-	err = s.SetupIndex(path)
-	if err == io.EOF {
-		return s, nil
+	if recover {
+		err = s.SetupIndex(opts.path)
+	} else {
+		err = s.loadIndex(opts.path)
 	}
-
-	return s, err
+	if err != nil {
+		return nil, err
+	}
+	if s.Position > 0 {
+		fi, err := log.Stat()
+		if err != nil {
+			return nil, errors.Wrap(err, "stat file failed")
+		}
+		s.firstAppend = fi.ModTime()
+	} else if opts.preallocate && opts.maxBytes > 0 {
+		if err := log.Truncate(opts.maxBytes); err != nil {
+			return nil, errors.Wrap(err, "truncate file failed")
+		}
+	}
+	return s, nil
 }
 
 // SetupIndex creates and initializes an index.
 // Initialization is:
 // - Sanity check of the loaded index
 // - Truncates the index (clears it)
-// - Reads the log file from the beginning and re-initializes the index
+// - Reads the log file from the beginning, validating each entry's size and
+//   CRC, and re-initializes the index
+// - Truncates the log after the last valid entry, so a torn write or garbage
+//   left by a crash isn't followed by new appends
 func (s *Segment) SetupIndex(path string) (err error) {
-	indexPath := filepath.Join(path, fmt.Sprintf(indexNameFormat, s.BaseOffset))
+	if err = s.openIndex(path); err != nil {
+		return err
+	}
+	if err = s.Index.SanityCheck(); err != nil {
+		return err
+	}
+	return s.recover()
+}
+
+func (s *Segment) openIndex(path string) (err error) {
+	indexPath := filepath.Join(path, fmt.Sprintf(indexNameFormat, s.BaseOffset)+s.suffix)
 	s.Index, err = newIndex(options{
 		path:       indexPath,
+		bytes:      s.maxIndexBytes,
 		baseOffset: s.BaseOffset,
 	})
 	if err != nil {
 		return err
 	}
-	if err = s.Index.SanityCheck(); err != nil {
+	timeIndexPath := filepath.Join(path, fmt.Sprintf(timeIndexNameFormat, s.BaseOffset)+s.suffix)
+	s.TimeIndex, err = newTimeIndex(options{
+		path:       timeIndexPath,
+		bytes:      s.maxIndexBytes,
+		baseOffset: s.BaseOffset,
+	})
+	return err
+}
+
+// loadIndex opens the segment's index and trusts its entries instead of
+// rebuilding it, finding the segment's position and next offset by walking
+// the log forward from the last indexed entry. It falls back to recovering
+// the segment if the index doesn't line up with the log.
+func (s *Segment) loadIndex(path string) error {
+	if err := s.openIndex(path); err != nil {
 		return err
 	}
-	if err := s.Index.TruncateEntries(0); err != nil {
-		return err
+	if err := s.Index.SanityCheck(); err != nil {
+		return s.recover()
 	}
-
-	_, err = s.log.Seek(0, 0)
+	fi, err := s.log.Stat()
 	if err != nil {
-		return err
+		return errors.Wrap(err, "stat file failed")
 	}
-
-	b := new(bytes.Buffer)
-	for {
-		// get offset and size
-		_, err := io.CopyN(b, s.log, 8)
-		if err != nil {
+	size := fi.Size()
+	if size == 0 {
+		if err := s.TimeIndex.TruncateEntries(0); err != nil {
 			return err
 		}
-		s.NextOffset = int64(Encoding.Uint64(b.Bytes()[0:8]))
+		return s.Index.TruncateEntries(0)
+	}
+	n := s.Index.validEntries()
+	if n == 0 {
+		return s.recover()
+	}
+	if err := s.Index.TruncateEntries(int(n)); err != nil {
+		return err
+	}
 
-		_, err = io.CopyN(b, s.log, 4)
+	e := &Entry{}
+	if err := s.Index.ReadEntry(e, (n-1)*entryWidth); err != nil {
+		return err
+	}
+	position := e.Position
+	s.bytesSinceLastIndexEntry = size - position
+	b := make([]byte, entryHeaderLen)
+	for position+msgSetHeaderLen <= size {
+		// an entry header that can't be read or can't be right means the
+		// log doesn't match its index, so it's recovered
+		header, err := s.readEntryHeader(b, position)
 		if err != nil {
-			return err
+			return s.recover()
 		}
-		size := int64(Encoding.Uint32(b.Bytes()[8:12]))
+		// the preallocated tail of a segment that wasn't closed
+		if isZero(header[:msgSetHeaderLen]) {
+			break
+		}
+		if header.Size() <= msgSetHeaderLen || header.LastOffset() < s.NextOffset {
+			return s.recover()
+		}
+		s.NextOffset = header.LastOffset() + 1
+		position += int64(header.Size())
+	}
+	if position != size {
+		return s.recover()
+	}
+	s.Position = size
 
-		_, err = io.CopyN(b, s.log, size)
-		if err != nil {
-			return err
+	if err := s.TimeIndex.TruncateEntries(int(s.TimeIndex.validEntries())); err != nil {
+		return err
+	}
+	if te, ok := s.TimeIndex.LastEntry(); ok {
+		if te.Offset >= s.NextOffset {
+			return s.recover()
 		}
+		s.maxTimestamp = te.Timestamp
+	}
+	return nil
+}
+
+// recover rebuilds the index by reading and validating each of the log's
+// entries, truncating the log after the last valid one.
+func (s *Segment) recover() error {
+	if err := s.Index.TruncateEntries(0); err != nil {
+		return err
+	}
+	if err := s.TimeIndex.TruncateEntries(0); err != nil {
+		return err
+	}
+	s.Position = 0
+	s.NextOffset = s.BaseOffset
+	s.maxTimestamp = -1
+	s.bytesSinceLastIndexEntry = 0
 
-		// Reset the buffer to not get an overflow
-		b.Truncate(0)
+	fi, err := s.log.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat file failed")
+	}
+	size := fi.Size()
 
-		err = s.Index.WriteEntry(Entry{
-			Offset:   s.NextOffset,
-			Position: s.Position,
-		})
-		if err != nil {
+	header := make([]byte, msgSetHeaderLen)
+	var preallocated bool
+	for s.Position+msgSetHeaderLen <= size {
+		if _, err = s.log.ReadAt(header, s.Position); err != nil {
+			return errors.Wrap(err, "read entry header failed")
+		}
+		// the preallocated tail of a segment that wasn't closed, it's
+		// trimmed but isn't invalid
+		if preallocated = isZero(header); preallocated {
+			break
+		}
+		ms := MessageSet(header)
+		if ms.Size() <= msgSetHeaderLen || s.Position+int64(ms.Size()) > size {
+			break
+		}
+		ms = make(MessageSet, ms.Size())
+		if _, err = s.log.ReadAt(ms, s.Position); err != nil {
+			return errors.Wrap(err, "read entry failed")
+		}
+		if !ms.valid() {
+			break
+		}
+
+		if err = s.indexEntry(ms, s.Position); err != nil {
 			return err
 		}
 
-		s.Position += size + msgSetHeaderLen
-		s.NextOffset++
+		s.NextOffset = ms.LastOffset() + 1
+		s.Position += int64(len(ms))
+	}
 
-		_, err = s.log.Seek(size, 1)
-		if err != nil {
-			return err
+	if s.Position < size {
+		if !preallocated {
+			s.discarded = size - s.Position
+		}
+		if err = s.log.Truncate(s.Position); err != nil {
+			return errors.Wrap(err, "truncate file failed")
 		}
 	}
+	return nil
 }
 
+// IsFull returns whether the segment's log or either of its indexes is full.
 func (s *Segment) IsFull() bool {
 	s.Lock()
 	defer s.Unlock()
-	return s.Position >= s.maxBytes
+	return s.Position >= s.maxBytes || s.Index.IsFull() || s.TimeIndex.IsFull()
 }
 
 // Write writes a byte slice to the log at the current position.
-// It increments the offset as well as sets the position to the new tail.
+// It moves the next offset past its entries' offsets as well as sets the
+// position to the new tail.
 func (s *Segment) Write(p []byte) (n int, err error) {
 	s.Lock()
 	defer s.Unlock()
-	n, err = s.writer.Write(p)
+	// written at the position rather than appended, the log could be
+	// preallocated
+	n, err = s.log.WriteAt(p, s.Position)
 	if err != nil {
 		return n, errors.Wrap(err, "log write failed")
 	}
-	s.NextOffset++
+	if s.Position == 0 {
+		s.firstAppend = time.Now()
+	}
+	if entries := Entries(p); len(entries) > 0 {
+		s.NextOffset = entries[len(entries)-1].LastOffset() + 1
+	}
 	s.Position += int64(n)
 	return n, nil
 }
 
+// Age returns how long ago the segment's first entry was appended, zero if
+// it's empty.
+func (s *Segment) Age() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	if s.Position == 0 {
+		return 0
+	}
+	return time.Since(s.firstAppend)
+}
+
+// position returns the end of the segment's entries, which is before the
+// end of its log if it's preallocated.
+func (s *Segment) position() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.Position
+}
+
 func (s *Segment) Read(p []byte) (n int, err error) {
 	s.Lock()
 	defer s.Unlock()
@@ -152,41 +342,295 @@ func (s *Segment) ReadAt(p []byte, off int64) (n int, err error) {
 	return s.log.ReadAt(p, off)
 }
 
+// indexEntry adds the entry written at position to the segment's indexes.
+// The offset index is sparse, the segment's first entry is always indexed and
+// then another is only indexed once indexIntervalBytes have been appended
+// since the last. The time index gets the entry if its message is newer than
+// any before it in the segment, messages without timestamps aren't indexed.
+func (s *Segment) indexEntry(ms MessageSet, position int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if position == 0 || s.bytesSinceLastIndexEntry >= s.indexIntervalBytes {
+		err := s.Index.WriteEntry(Entry{
+			Offset:   ms.Offset(),
+			Position: position,
+		})
+		if err != nil {
+			return err
+		}
+		s.bytesSinceLastIndexEntry = 0
+	}
+	s.bytesSinceLastIndexEntry += int64(len(ms))
+
+	ts := ms.timestamp()
+	if ts <= s.maxTimestamp || ts <= 0 {
+		return nil
+	}
+	s.maxTimestamp = ts
+	return s.TimeIndex.WriteEntry(TimeEntry{
+		Timestamp: ts,
+		Offset:    ms.Offset(),
+	})
+}
+
+// MaxTimestamp returns the newest timestamp of the segment's messages in
+// milliseconds, -1 if none of them have timestamps.
+func (s *Segment) MaxTimestamp() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.maxTimestamp
+}
+
+// ModTime returns the time the segment's log was last written to, which is
+// the time its newest message was appended.
+func (s *Segment) ModTime() (time.Time, error) {
+	s.Lock()
+	defer s.Unlock()
+	fi, err := s.log.Stat()
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "stat file failed")
+	}
+	return fi.ModTime(), nil
+}
+
+// newestTime returns the timestamp of the segment's newest message, or the
+// time it was appended if none of its messages have timestamps.
+func (s *Segment) newestTime() (time.Time, error) {
+	if ts := s.MaxTimestamp(); ts >= 0 {
+		return time.Unix(0, ts*int64(time.Millisecond)), nil
+	}
+	return s.ModTime()
+}
+
+// forEachEntry calls fn with the position and contents of each entry in the
+// segment, in order, stopping at the first error.
+func (s *Segment) forEachEntry(fn func(position int64, ms MessageSet) error) error {
+	return s.forEachEntryFrom(0, fn)
+}
+
+// forEachEntryFrom is forEachEntry starting from the entry at position.
+func (s *Segment) forEachEntryFrom(position int64, fn func(position int64, ms MessageSet) error) error {
+	end := s.position()
+	header := make([]byte, msgSetHeaderLen)
+	for position < end {
+		if _, err := s.ReadAt(header, position); err != nil {
+			return errors.Wrap(err, "read entry header failed")
+		}
+		size := int64(Encoding.Uint32(header[sizePos : sizePos+4]))
+		ms := make(MessageSet, msgSetHeaderLen+size)
+		if _, err := s.ReadAt(ms, position); err != nil {
+			return errors.Wrap(err, "read entry failed")
+		}
+		if err := fn(position, ms); err != nil {
+			return err
+		}
+		position += int64(len(ms))
+	}
+	return nil
+}
+
+// readEntryHeader reads the start of the entry at position into b, which
+// holds entryHeaderLen bytes, enough to find the entry's offsets. Less is
+// read if the log ends first.
+func (s *Segment) readEntryHeader(b []byte, position int64) (MessageSet, error) {
+	n, err := s.ReadAt(b, position)
+	if n < msgSetHeaderLen {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "read entry header failed")
+	}
+	return MessageSet(b[:n]), nil
+}
+
+// sections returns readers of the segment's log and indexes up to where
+// they've been written, leaving out their preallocated tails.
+func (s *Segment) sections() (log, index, timeIndex io.Reader) {
+	return io.NewSectionReader(s.log, 0, s.position()), s.Index.section(), s.TimeIndex.section()
+}
+
+// Sync flushes the segment's log and indexes to disk.
+func (s *Segment) Sync() error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.log.Sync(); err != nil {
+		return errors.Wrap(err, "file sync failed")
+	}
+	if err := s.TimeIndex.Sync(); err != nil {
+		return err
+	}
+	return s.Index.Sync()
+}
+
+// trim truncates the unused tail of the segment's preallocated log.
+func (s *Segment) trim() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.preallocate {
+		return nil
+	}
+	if err := s.log.Truncate(s.Position); err != nil {
+		return errors.Wrap(err, "truncate file failed")
+	}
+	return nil
+}
+
 func (s *Segment) Close() error {
+	if err := s.trim(); err != nil {
+		return err
+	}
 	s.Lock()
 	defer s.Unlock()
+	if err := s.log.Sync(); err != nil {
+		return errors.Wrap(err, "file sync failed")
+	}
 	if err := s.log.Close(); err != nil {
 		return err
 	}
+	if err := s.TimeIndex.Close(); err != nil {
+		return err
+	}
 	return s.Index.Close()
 }
 
+// findEntry returns the entry containing offset, the record batch it's in or
+// the first entry after it, or the end of the segment if there isn't one. It
+// looks up the closest index entry before offset and scans the log forward
+// from there.
 func (s *Segment) findEntry(offset int64) (e *Entry, err error) {
 	s.Lock()
-	defer s.Unlock()
+	end := s.Position
+	s.Unlock()
 	e = &Entry{}
-	n := int(s.Index.bytes / entryWidth)
-	idx := sort.Search(n, func(i int) bool {
-		_ = s.Index.ReadEntry(e, int64(i*entryWidth))
-		return e.Offset >= offset || e.Offset == 0
-	})
-	if idx == n {
-		return nil, errors.New("entry not found")
+	if err = s.Index.Lookup(e, offset); err != nil {
+		return nil, err
+	}
+	b := make([]byte, entryHeaderLen)
+	for e.Position < end {
+		ms, err := s.readEntryHeader(b, e.Position)
+		if err != nil {
+			return nil, err
+		}
+		if ms.LastOffset() >= offset {
+			e.Offset = ms.Offset()
+			return e, nil
+		}
+		e.Position += int64(ms.Size())
 	}
+	e.Offset = offset
 	return e, nil
 }
 
-func (s *Segment) Delete() error {
-	if err := s.Close(); err != nil {
+// firstOffset returns the offset of the first message of the entry findEntry
+// returned.
+func (s *Segment) firstOffset(e *Entry) (int64, error) {
+	if e.Position >= s.position() {
+		return e.Offset, nil
+	}
+	ms, err := s.readEntryHeader(make([]byte, entryHeaderLen), e.Position)
+	if err != nil {
+		return 0, err
+	}
+	// only a compressed message needs reading whole
+	if ms.isBatch() || Message(ms.Payload()).Attributes()&compressionCodecMask == 0 {
+		return ms.Offset(), nil
+	}
+	ms = make(MessageSet, ms.Size())
+	if _, err := s.ReadAt(ms, e.Position); err != nil {
+		return 0, errors.Wrap(err, "read entry failed")
+	}
+	return ms.firstOffset()
+}
+
+// truncateTo removes the segment's entries at or after offset along with
+// their index entries, so the segment's next entry is appended at offset. The
+// record batch or compressed message offset's in is removed whole.
+func (s *Segment) truncateTo(offset int64) error {
+	e, err := s.findEntry(offset)
+	if err != nil {
+		return err
+	}
+	if offset, err = s.firstOffset(e); err != nil {
+		return err
+	}
+	n, err := s.Index.entriesBefore(offset)
+	if err != nil {
 		return err
 	}
 	s.Lock()
 	defer s.Unlock()
-	if err := os.Remove(s.log.Name()); err != nil {
+	if e.Position >= s.Position {
+		return nil
+	}
+	if err := s.log.Truncate(e.Position); err != nil {
+		return errors.Wrap(err, "truncate file failed")
+	}
+	s.Position = e.Position
+	s.NextOffset = offset
+
+	if err := s.Index.TruncateEntries(n); err != nil {
+		return err
+	}
+	s.bytesSinceLastIndexEntry = 0
+	if n > 0 {
+		last := &Entry{}
+		if err := s.Index.ReadEntry(last, int64(n-1)*entryWidth); err != nil {
+			return err
+		}
+		s.bytesSinceLastIndexEntry = s.Position - last.Position
+	}
+
+	if err := s.TimeIndex.TruncateEntries(s.TimeIndex.entriesBefore(offset)); err != nil {
 		return err
 	}
-	if err := os.Remove(s.Index.Name()); err != nil {
+	s.maxTimestamp = -1
+	if te, ok := s.TimeIndex.LastEntry(); ok {
+		s.maxTimestamp = te.Timestamp
+	}
+	return nil
+}
+
+// markDeleted renames the segment's files with the deleted suffix, so they're
+// no longer part of the log though the segment can still be read until
+// they're removed.
+func (s *Segment) markDeleted() error {
+	s.Lock()
+	defer s.Unlock()
+	for _, name := range s.fileNames() {
+		if err := os.Rename(name, name+deletedSuffix); err != nil {
+			return errors.Wrap(err, "rename file failed")
+		}
+	}
+	s.deleted = true
+	return nil
+}
+
+// fileNames returns the names the segment's files were opened with.
+func (s *Segment) fileNames() []string {
+	return []string{s.log.Name(), s.Index.Name(), s.TimeIndex.Name()}
+}
+
+// delete removes the segment from the log. Its files are removed by the log's
+// deleter, after a delay for readers that have it open.
+func (s *Segment) delete() error {
+	return s.deleter.delete(s)
+}
+
+func (s *Segment) Delete() error {
+	if err := s.Close(); err != nil {
 		return err
 	}
+	s.Lock()
+	defer s.Unlock()
+	for _, name := range s.fileNames() {
+		if s.deleted {
+			name += deletedSuffix
+		}
+		// a segment deleted later with the same base offset could have
+		// replaced and removed the files already
+		if err := os.Remove(name); err != nil && !(s.deleted && os.IsNotExist(err)) {
+			return err
+		}
+	}
 	return nil
 }
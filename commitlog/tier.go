@@ -0,0 +1,357 @@
+package commitlog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// remoteCacheDir is the dir in the log's dir that segments fetched from
+	// the remote storage are downloaded to for reading.
+	remoteCacheDir = ".remote"
+	// maxFetchedSegments is how many fetched segments are kept in the cache,
+	// the oldest fetched is deleted when another's fetched.
+	maxFetchedSegments = 4
+)
+
+// openRemote lists the log's segments in the remote storage, and clears the
+// segments fetched when the log was last open.
+func (l *CommitLog) openRemote() error {
+	if l.RemoteStorage == nil {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(l.Path, remoteCacheDir)); err != nil {
+		return errors.Wrap(err, "remove dir failed")
+	}
+	names, err := l.RemoteStorage.List(l.name)
+	if err != nil {
+		return errors.Wrap(err, "list remote segments failed")
+	}
+	for _, name := range names {
+		// a segment's log is uploaded after its indexes, so it's complete
+		// if its log is there
+		if !strings.HasSuffix(name, LogFileSuffix) {
+			continue
+		}
+		baseOffset, err := strconv.ParseInt(strings.TrimSuffix(name, LogFileSuffix), 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "parse base offset failed")
+		}
+		l.remote = append(l.remote, baseOffset)
+	}
+	sort.Slice(l.remote, func(i, j int) bool { return l.remote[i] < l.remote[j] })
+	return nil
+}
+
+// remoteName returns the name of the log's file in the remote storage.
+func (l *CommitLog) remoteName(name string) string {
+	return path.Join(l.name, name)
+}
+
+// isRemote returns whether the segment at baseOffset has been uploaded. l.mu
+// must be held.
+func (l *CommitLog) isRemote(baseOffset int64) bool {
+	i := sort.Search(len(l.remote), func(i int) bool { return l.remote[i] >= baseOffset })
+	return i < len(l.remote) && l.remote[i] == baseOffset
+}
+
+// Tier uploads the log's closed segments that aren't in the remote storage
+// yet, oldest first, then deletes the oldest uploaded segments from local disk
+// until they take up at most LocalRetentionBytes. The log's cleanup loop runs
+// it after the cleaner if RemoteStorage is set.
+func (l *CommitLog) Tier() error {
+	if l.RemoteStorage == nil {
+		return nil
+	}
+	l.tierMu.Lock()
+	defer l.tierMu.Unlock()
+	segments := l.Segments()
+	for _, s := range segments[:len(segments)-1] {
+		l.mu.RLock()
+		uploaded := l.isRemote(s.BaseOffset)
+		l.mu.RUnlock()
+		if uploaded {
+			continue
+		}
+		if err := l.upload(s); err != nil {
+			return err
+		}
+		l.mu.Lock()
+		i := sort.Search(len(l.remote), func(i int) bool { return l.remote[i] > s.BaseOffset })
+		l.remote = append(l.remote, 0)
+		copy(l.remote[i+1:], l.remote[i:])
+		l.remote[i] = s.BaseOffset
+		l.mu.Unlock()
+	}
+	return l.deleteLocal()
+}
+
+// upload copies the segment's files to the remote storage, its log last so
+// the segment's only listed once its indexes are there too.
+func (l *CommitLog) upload(s *Segment) error {
+	log, index, timeIndex := s.sections()
+	files := []struct {
+		format string
+		r      io.Reader
+	}{
+		{timeIndexNameFormat, timeIndex},
+		{indexNameFormat, index},
+		{logNameFormat, log},
+	}
+	for _, f := range files {
+		if err := l.RemoteStorage.Put(l.remoteName(fmt.Sprintf(f.format, s.BaseOffset)), f.r); err != nil {
+			return errors.Wrap(err, "upload segment failed")
+		}
+	}
+	return nil
+}
+
+// deleteLocal deletes the oldest uploaded segments from local disk until the
+// uploaded segments left take up at most LocalRetentionBytes.
+func (l *CommitLog) deleteLocal() error {
+	if l.LocalRetentionBytes < 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var n int
+	var uploaded int64
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if !l.isRemote(s.BaseOffset) {
+			break
+		}
+		uploaded += s.position()
+		n++
+	}
+	for ; n > 0 && uploaded > l.LocalRetentionBytes; n-- {
+		s := l.segments[0]
+		uploaded -= s.position()
+		if err := s.delete(); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// cleanRemote applies MaxLogBytes and MaxLogAge to the segments that are only
+// in the remote storage, which are the log's oldest. They're deleted oldest
+// first while the whole log's over the byte retention or they were uploaded
+// longer ago than the age retention, so they go before the cleaner deletes any
+// local segments.
+func (l *CommitLog) cleanRemote() error {
+	if l.RemoteStorage == nil || (l.MaxLogBytes <= 0 && l.MaxLogAge == 0) {
+		return nil
+	}
+	l.tierMu.Lock()
+	defer l.tierMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var totalBytes int64
+	for _, s := range l.segments {
+		totalBytes += s.position()
+	}
+	var remoteOnly []int64
+	sizes := make(map[int64]int64)
+	modTimes := make(map[int64]time.Time)
+	for _, baseOffset := range l.remote {
+		if baseOffset >= l.segments[0].BaseOffset {
+			break
+		}
+		size, modTime, err := l.RemoteStorage.Stat(l.remoteName(fmt.Sprintf(logNameFormat, baseOffset)))
+		if err != nil {
+			return errors.Wrap(err, "stat remote segment failed")
+		}
+		remoteOnly = append(remoteOnly, baseOffset)
+		sizes[baseOffset] = size
+		modTimes[baseOffset] = modTime
+		totalBytes += size
+	}
+	var deadline time.Time
+	if l.MaxLogAge > 0 {
+		deadline = time.Now().Add(-l.MaxLogAge)
+	}
+	deleted := int64(-1)
+	for _, baseOffset := range remoteOnly {
+		overBytes := l.MaxLogBytes > 0 && totalBytes > l.MaxLogBytes
+		overAge := !deadline.IsZero() && modTimes[baseOffset].Before(deadline)
+		if !overBytes && !overAge {
+			break
+		}
+		totalBytes -= sizes[baseOffset]
+		deleted = baseOffset
+	}
+	if deleted < 0 {
+		return nil
+	}
+	return l.deleteRemote(func(baseOffset, _ int64) bool { return baseOffset <= deleted })
+}
+
+// deleteRemote deletes the remote segments that match, given each segment's
+// base offset and the offset it ends before. l.mu must be held.
+func (l *CommitLog) deleteRemote(match func(baseOffset, end int64) bool) error {
+	var kept []int64
+	for i, baseOffset := range l.remote {
+		end := l.NewestOffset()
+		if i+1 < len(l.remote) {
+			end = l.remote[i+1]
+		}
+		for _, s := range l.segments {
+			if s.BaseOffset > baseOffset {
+				if s.BaseOffset < end {
+					end = s.BaseOffset
+				}
+				break
+			}
+		}
+		if !match(baseOffset, end) {
+			kept = append(kept, baseOffset)
+			continue
+		}
+		// the log goes first, so the segment isn't listed if the rest fail
+		for _, format := range []string{logNameFormat, indexNameFormat, timeIndexNameFormat} {
+			if err := l.RemoteStorage.Delete(l.remoteName(fmt.Sprintf(format, baseOffset))); err != nil {
+				l.remote = append(kept, l.remote[i+1:]...)
+				return errors.Wrap(err, "delete remote segment failed")
+			}
+		}
+		if err := l.evict(baseOffset); err != nil {
+			l.remote = append(kept, l.remote[i+1:]...)
+			return err
+		}
+	}
+	l.remote = kept
+	return nil
+}
+
+// segmentFor returns the segment containing offset, or the first segment if
+// offset is before all of them. The segment's fetched from the remote storage
+// if it's no longer on local disk.
+func (l *CommitLog) segmentFor(offset int64) (*Segment, error) {
+	l.mu.RLock()
+	segments, remote := l.segments, l.remote
+	l.mu.RUnlock()
+	if len(remote) > 0 && remote[0] < segments[0].BaseOffset && offset < segments[0].BaseOffset {
+		i := sort.Search(len(remote), func(i int) bool { return remote[i] > offset }) - 1
+		if i < 0 {
+			i = 0
+		}
+		return l.fetch(remote[i])
+	}
+	s, _ := findSegment(segments, offset)
+	return s, nil
+}
+
+// fetch returns the remote segment at baseOffset, downloading it to the cache
+// if it isn't there already.
+func (l *CommitLog) fetch(baseOffset int64) (*Segment, error) {
+	l.fetchedMu.Lock()
+	defer l.fetchedMu.Unlock()
+	for _, s := range l.fetched {
+		if s.BaseOffset == baseOffset {
+			return s, nil
+		}
+	}
+	dir := filepath.Join(l.Path, remoteCacheDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "mkdir failed")
+	}
+	for _, format := range []string{logNameFormat, indexNameFormat, timeIndexNameFormat} {
+		name := fmt.Sprintf(format, baseOffset)
+		if err := l.download(l.remoteName(name), filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	opts := l.segmentOptions()
+	opts.path = dir
+	opts.preallocate = false
+	s, err := newSegment(baseOffset, opts, false)
+	if err != nil {
+		return nil, err
+	}
+	l.fetched = append(l.fetched, s)
+	// the oldest fetched is deleted after the delay, for readers that have
+	// it open
+	if len(l.fetched) > maxFetchedSegments {
+		if err := l.fetched[0].delete(); err != nil {
+			return nil, err
+		}
+		l.fetched = l.fetched[1:]
+	}
+	return s, nil
+}
+
+func (l *CommitLog) download(name, path string) error {
+	r, err := l.RemoteStorage.Get(name)
+	if err != nil {
+		return errors.Wrap(err, "download segment failed")
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Wrap(err, "open file failed")
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "download segment failed")
+	}
+	return nil
+}
+
+// evict deletes the fetched segment at baseOffset from the cache.
+func (l *CommitLog) evict(baseOffset int64) error {
+	l.fetchedMu.Lock()
+	defer l.fetchedMu.Unlock()
+	for i, s := range l.fetched {
+		if s.BaseOffset == baseOffset {
+			l.fetched = append(l.fetched[:i], l.fetched[i+1:]...)
+			return s.delete()
+		}
+	}
+	return nil
+}
+
+// closeRemote closes the fetched segments and removes the cache.
+func (l *CommitLog) closeRemote() error {
+	l.fetchedMu.Lock()
+	defer l.fetchedMu.Unlock()
+	for _, s := range l.fetched {
+		if err := s.Close(); err != nil {
+			return err
+		}
+	}
+	l.fetched = nil
+	if err := os.RemoveAll(filepath.Join(l.Path, remoteCacheDir)); err != nil {
+		return errors.Wrap(err, "remove dir failed")
+	}
+	return nil
+}
+
+// deleteAllRemote deletes all of the log's files from the remote storage.
+func (l *CommitLog) deleteAllRemote() error {
+	if l.RemoteStorage == nil {
+		return nil
+	}
+	names, err := l.RemoteStorage.List(l.name)
+	if err != nil {
+		return errors.Wrap(err, "list remote segments failed")
+	}
+	for _, name := range names {
+		if err := l.RemoteStorage.Delete(l.remoteName(name)); err != nil {
+			return errors.Wrap(err, "delete remote segment failed")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package commitlog_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/jocko/commitlog"
+	"github.com/travisjeffery/jocko/protocol"
+)
+
+func TestTier(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	bucket := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogbucket%d", rand.Int63()))
+	defer os.RemoveAll(bucket)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+		FileDeleteDelay: -1,
+		RemoteStorage:   commitlog.NewDirStorage(bucket),
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	require.Equal(t, 3, len(l.Segments()))
+
+	// the closed segments are uploaded and deleted from local disk
+	require.NoError(t, l.Tier())
+	remote := func() []string {
+		names, err := filepath.Glob(filepath.Join(bucket, filepath.Base(path), "*"))
+		require.NoError(t, err)
+		return names
+	}
+	require.Equal(t, 6, len(remote()))
+	require.Equal(t, 1, len(l.Segments()))
+	_, err = os.Stat(filepath.Join(path, fmt.Sprintf("%020d.log", 0)))
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, int64(0), l.OldestOffset())
+
+	// readers fetch them back from the remote storage
+	values := func(l *commitlog.CommitLog, from int64) []string {
+		var values []string
+		require.NoError(t, l.Scan(from, func(r commitlog.Record) error {
+			values = append(values, string(r.Value))
+			return nil
+		}))
+		return values
+	}
+	require.Equal(t, []string{"value-5", "value-6", "value-7", "value-8", "value-9"}, values(l, 5))
+	r, err := l.NewReader(0, 1024)
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	var got []int64
+	for len(b) > 0 {
+		ms := commitlog.MessageSet(b)
+		got = append(got, ms.Offset())
+		b = b[ms.Size():]
+	}
+	require.Equal(t, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, got)
+
+	// and the remote segments are found again when the log's reopened
+	require.NoError(t, l.Close())
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), l.OldestOffset())
+	require.Equal(t, 10, len(values(l, 0)))
+
+	require.NoError(t, l.DeleteBefore(4))
+	require.Equal(t, int64(4), l.OldestOffset())
+	require.Equal(t, 3, len(remote()))
+	require.Equal(t, "value-4", values(l, 0)[0])
+
+	require.NoError(t, l.Delete())
+	require.Equal(t, 0, len(remote()))
+}
+
+func TestTierLocalRetention(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	bucket := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogbucket%d", rand.Int63()))
+	defer os.RemoveAll(bucket)
+	l, err := commitlog.New(commitlog.Options{
+		Path:                path,
+		MaxSegmentBytes:     100,
+		MaxLogBytes:         -1,
+		FileDeleteDelay:     -1,
+		RemoteStorage:       commitlog.NewDirStorage(bucket),
+		LocalRetentionBytes: -1,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+
+	// the uploaded segments are kept on local disk and uploaded once
+	require.NoError(t, l.Tier())
+	require.NoError(t, l.Tier())
+	require.Equal(t, 3, len(l.Segments()))
+	names, err := filepath.Glob(filepath.Join(bucket, filepath.Base(path), "*"+commitlog.LogFileSuffix))
+	require.NoError(t, err)
+	require.Equal(t, 2, len(names))
+	_, err = os.Stat(filepath.Join(path, ".remote"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTierOffsetForTime(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	bucket := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogbucket%d", rand.Int63()))
+	defer os.RemoveAll(bucket)
+	opts := commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+		FileDeleteDelay: -1,
+		RemoteStorage:   commitlog.NewDirStorage(bucket),
+	}
+	l, err := commitlog.New(opts)
+	require.NoError(t, err)
+	for _, ts := range []int64{1000, 3000, 2000, 4000, 5000, 6000} {
+		b, err := protocol.Encode(&protocol.Message{
+			MagicByte: 1,
+			Timestamp: time.Unix(0, ts*int64(time.Millisecond)),
+			Value:     []byte("value"),
+		})
+		require.NoError(t, err)
+		_, err = l.Append(commitlog.NewMessageSet(0, commitlog.NewMessage(b)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Tier())
+	require.Equal(t, 1, len(l.Segments()))
+	require.True(t, l.Segments()[0].BaseOffset > 1)
+
+	check := func() {
+		// messages in segments only in the remote storage are found too
+		for ts, exp := range map[int64]struct{ offset, timestamp int64 }{
+			0:    {0, 1000},
+			1500: {1, 3000},
+			3500: {3, 4000},
+			6000: {5, 6000},
+			7000: {6, -1},
+		} {
+			offset, timestamp, err := l.OffsetForTime(ts)
+			require.NoError(t, err)
+			require.Equal(t, exp.offset, offset, "timestamp %d", ts)
+			require.Equal(t, exp.timestamp, timestamp, "timestamp %d", ts)
+		}
+	}
+	check()
+
+	require.NoError(t, l.Close())
+	l, err = commitlog.New(opts)
+	require.NoError(t, err)
+	defer l.Close()
+	check()
+}
+
+func TestTierCleanup(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogtest%d", rand.Int63()))
+	defer os.RemoveAll(path)
+	bucket := filepath.Join(os.TempDir(), fmt.Sprintf("commitlogbucket%d", rand.Int63()))
+	defer os.RemoveAll(bucket)
+	l, err := commitlog.New(commitlog.Options{
+		Path:            path,
+		MaxSegmentBytes: 100,
+		MaxLogBytes:     -1,
+		MaxLogAge:       time.Hour,
+		CleanupInterval: 10 * time.Millisecond,
+		FileDeleteDelay: -1,
+		RemoteStorage:   commitlog.NewDirStorage(bucket),
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 10; i++ {
+		appendMessage(t, l, nil, []byte(fmt.Sprintf("value-%d", i)))
+	}
+	remote := func() []string {
+		names, err := filepath.Glob(filepath.Join(bucket, filepath.Base(path), "*"+commitlog.LogFileSuffix))
+		require.NoError(t, err)
+		return names
+	}
+
+	// the closed segments are uploaded in the background
+	for i := 0; i < 100 && len(l.Segments()) > 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, 1, len(l.Segments()))
+	require.Equal(t, 2, len(remote()))
+	require.Equal(t, int64(0), l.OldestOffset())
+
+	// and deleted from the remote storage once they're past retention
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(remote()[0], old, old))
+	for i := 0; i < 100 && l.OldestOffset() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, int64(4), l.OldestOffset())
+	require.Equal(t, 1, len(remote()))
+}
@@ -0,0 +1,199 @@
+package commitlog
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/tysontate/gommap"
+)
+
+const (
+	timestampWidth  = 8
+	timestampOffset = 0
+
+	timeOffsetOffset = timestampWidth
+
+	timeEntryWidth = timestampWidth + offsetWidth
+)
+
+// timeIndex maps timestamps to offsets in a segment. An entry is only written
+// when a message has a newer timestamp than any before it in the segment, so
+// the entries' timestamps are increasing and the first entry at or after a
+// timestamp is the first message at or after it.
+type timeIndex struct {
+	options
+	mmap     gommap.MMap
+	file     *os.File
+	mu       sync.RWMutex
+	position int64
+}
+
+type TimeEntry struct {
+	Timestamp int64
+	Offset    int64
+}
+
+func newTimeIndex(opts options) (idx *timeIndex, err error) {
+	if opts.bytes == 0 {
+		opts.bytes = 10 * 1024 * 1024
+	}
+	if opts.path == "" {
+		return nil, errors.New("path is empty")
+	}
+	idx = &timeIndex{
+		options: opts,
+	}
+	idx.file, err = os.OpenFile(opts.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file failed")
+	}
+	fi, err := idx.file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat file failed")
+	} else if fi.Size() > 0 {
+		idx.position = roundDown(fi.Size(), timeEntryWidth)
+	}
+	if err := idx.file.Truncate(roundDown(opts.bytes, timeEntryWidth)); err != nil {
+		return nil, err
+	}
+
+	idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap file failed")
+	}
+	return idx, nil
+}
+
+func (idx *timeIndex) WriteEntry(entry TimeEntry) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.position+timeEntryWidth > int64(len(idx.mmap)) {
+		return errors.New("time index is full")
+	}
+	b := idx.mmap[idx.position : idx.position+timeEntryWidth]
+	Encoding.PutUint64(b[timestampOffset:], uint64(entry.Timestamp))
+	Encoding.PutUint32(b[timeOffsetOffset:], uint32(entry.Offset-idx.baseOffset))
+	idx.position += timeEntryWidth
+	return nil
+}
+
+// IsFull returns whether there's no room for another entry.
+func (idx *timeIndex) IsFull() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.position+timeEntryWidth > int64(len(idx.mmap))
+}
+
+func (idx *timeIndex) ReadEntry(e *TimeEntry, offset int64) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	idx.readEntry(e, offset)
+}
+
+func (idx *timeIndex) readEntry(e *TimeEntry, offset int64) {
+	b := idx.mmap[offset : offset+timeEntryWidth]
+	e.Timestamp = int64(Encoding.Uint64(b[timestampOffset:]))
+	e.Offset = idx.baseOffset + int64(int32(Encoding.Uint32(b[timeOffsetOffset:])))
+}
+
+// Find returns the first entry with a timestamp at or after ts, false if
+// there isn't one.
+func (idx *timeIndex) Find(ts int64) (TimeEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var e TimeEntry
+	n := int(idx.position / timeEntryWidth)
+	i := sort.Search(n, func(i int) bool {
+		idx.readEntry(&e, int64(i*timeEntryWidth))
+		return e.Timestamp >= ts
+	})
+	if i == n {
+		return e, false
+	}
+	idx.readEntry(&e, int64(i*timeEntryWidth))
+	return e, true
+}
+
+// LastEntry returns the entry with the newest timestamp, false if the index is
+// empty.
+func (idx *timeIndex) LastEntry() (TimeEntry, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var e TimeEntry
+	if idx.position == 0 {
+		return e, false
+	}
+	idx.readEntry(&e, idx.position-timeEntryWidth)
+	return e, true
+}
+
+func (idx *timeIndex) Sync() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.file.Sync(); err != nil {
+		return errors.Wrap(err, "file sync failed")
+	}
+	if err := idx.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return errors.Wrap(err, "mmap sync failed")
+	}
+	return nil
+}
+
+func (idx *timeIndex) Close() (err error) {
+	if err = idx.Sync(); err != nil {
+		return
+	}
+	if err = idx.file.Truncate(idx.position); err != nil {
+		return
+	}
+	return idx.file.Close()
+}
+
+// section returns a reader of the entries written to the index.
+func (idx *timeIndex) section() io.Reader {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return io.NewSectionReader(idx.file, 0, idx.position)
+}
+
+func (idx *timeIndex) Name() string {
+	return idx.file.Name()
+}
+
+func (idx *timeIndex) TruncateEntries(number int) error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if int64(number*timeEntryWidth) > idx.position {
+		return errors.New("bad truncate number")
+	}
+	idx.position = int64(number * timeEntryWidth)
+	return nil
+}
+
+// entriesBefore returns the number of entries with offsets before offset.
+func (idx *timeIndex) entriesBefore(offset int64) int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	var e TimeEntry
+	return sort.Search(int(idx.position/timeEntryWidth), func(i int) bool {
+		idx.readEntry(&e, int64(i*timeEntryWidth))
+		return e.Offset >= offset
+	})
+}
+
+// validEntries returns the number of entries written to the index. Like the
+// offset index its size can't be trusted after a crash, but timestamps are
+// always positive so entries are counted up to the first zero timestamp.
+func (idx *timeIndex) validEntries() int64 {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	n := idx.position / timeEntryWidth
+	return int64(sort.Search(int(n), func(i int) bool {
+		pos := int64(i) * timeEntryWidth
+		return Encoding.Uint64(idx.mmap[pos:pos+timestampWidth]) == 0
+	}))
+}
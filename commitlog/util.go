@@ -1,18 +1,56 @@
 package commitlog
 
-import "sort"
+import (
+	"os"
+	"sort"
 
+	"github.com/pkg/errors"
+)
+
+// findSegment returns the segment containing offset, or the first segment if
+// offset is before all of them.
 func findSegment(segments []*Segment, offset int64) (*Segment, int) {
 	n := len(segments)
+	if n == 0 {
+		return nil, 0
+	}
 	idx := sort.Search(n, func(i int) bool {
-		return segments[i].BaseOffset >= offset
-	})
-	if idx == n {
-		return nil, idx
+		return segments[i].BaseOffset > offset
+	}) - 1
+	if idx < 0 {
+		idx = 0
 	}
 	return segments[idx], idx
 }
 
+// isZero returns whether every byte of b is zero.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func roundDown(total, factor int64) int64 {
 	return factor * (total / factor)
 }
+
+// writeFileSync writes the data to the named file and syncs it to disk.
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, "open file failed")
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "write file failed")
+	}
+	return nil
+}
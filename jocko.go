@@ -9,11 +9,15 @@ import (
 )
 
 type CommitLog interface {
+	Close() error
 	Delete() error
 	NewReader(offset int64, maxBytes int32) (io.Reader, error)
-	Truncate(int64) error
+	TruncateTo(int64) error
+	DeleteBefore(int64) error
 	NewestOffset() int64
 	OldestOffset() int64
+	Appended(offset int64) <-chan struct{}
+	OffsetForTime(int64) (offset int64, timestamp int64, err error)
 	Append([]byte) (int64, error)
 }
 
@@ -28,9 +32,18 @@ type Client interface {
 // Alias prometheus' counter, probably only need to use Inc() though.
 type Counter = prometheus.Counter
 
+// Alias prometheus' histogram, probably only need to use Observe() though.
+type Histogram = prometheus.Histogram
+
 // Metrics is used for tracking metrics.
 type Metrics struct {
 	RequestsHandled Counter
+	// LogBytesDiscarded counts the bytes truncated from commit logs when
+	// recovering from a crash.
+	LogBytesDiscarded Counter
+	// LogFlushLatency observes how long flushing commit logs to disk takes,
+	// in seconds.
+	LogFlushLatency Histogram
 }
 
 // Request represents an API request.
@@ -8,12 +8,16 @@ import (
 )
 
 var (
-	lockCommitLogAppend       sync.RWMutex
-	lockCommitLogDelete       sync.RWMutex
-	lockCommitLogNewReader    sync.RWMutex
-	lockCommitLogNewestOffset sync.RWMutex
-	lockCommitLogOldestOffset sync.RWMutex
-	lockCommitLogTruncate     sync.RWMutex
+	lockCommitLogAppend        sync.RWMutex
+	lockCommitLogAppended      sync.RWMutex
+	lockCommitLogClose         sync.RWMutex
+	lockCommitLogDelete        sync.RWMutex
+	lockCommitLogDeleteBefore  sync.RWMutex
+	lockCommitLogNewReader     sync.RWMutex
+	lockCommitLogNewestOffset  sync.RWMutex
+	lockCommitLogOffsetForTime sync.RWMutex
+	lockCommitLogOldestOffset  sync.RWMutex
+	lockCommitLogTruncateTo    sync.RWMutex
 )
 
 // CommitLog is a mock implementation of CommitLog.
@@ -25,20 +29,32 @@ var (
 //             AppendFunc: func(in1 []byte) (int64, error) {
 // 	               panic("TODO: mock out the Append method")
 //             },
+//             AppendedFunc: func(offset int64) <-chan struct{} {
+// 	               panic("TODO: mock out the Appended method")
+//             },
+//             CloseFunc: func() error {
+// 	               panic("TODO: mock out the Close method")
+//             },
 //             DeleteFunc: func() error {
 // 	               panic("TODO: mock out the Delete method")
 //             },
+//             DeleteBeforeFunc: func(in1 int64) error {
+// 	               panic("TODO: mock out the DeleteBefore method")
+//             },
 //             NewReaderFunc: func(offset int64,maxBytes int32) (io.Reader, error) {
 // 	               panic("TODO: mock out the NewReader method")
 //             },
 //             NewestOffsetFunc: func() int64 {
 // 	               panic("TODO: mock out the NewestOffset method")
 //             },
+//             OffsetForTimeFunc: func(in1 int64) (int64, int64, error) {
+// 	               panic("TODO: mock out the OffsetForTime method")
+//             },
 //             OldestOffsetFunc: func() int64 {
 // 	               panic("TODO: mock out the OldestOffset method")
 //             },
-//             TruncateFunc: func(in1 int64) error {
-// 	               panic("TODO: mock out the Truncate method")
+//             TruncateToFunc: func(in1 int64) error {
+// 	               panic("TODO: mock out the TruncateTo method")
 //             },
 //         }
 //
@@ -50,20 +66,32 @@ type CommitLog struct {
 	// AppendFunc mocks the Append method.
 	AppendFunc func(in1 []byte) (int64, error)
 
+	// AppendedFunc mocks the Appended method.
+	AppendedFunc func(offset int64) <-chan struct{}
+
+	// CloseFunc mocks the Close method.
+	CloseFunc func() error
+
 	// DeleteFunc mocks the Delete method.
 	DeleteFunc func() error
 
+	// DeleteBeforeFunc mocks the DeleteBefore method.
+	DeleteBeforeFunc func(in1 int64) error
+
 	// NewReaderFunc mocks the NewReader method.
 	NewReaderFunc func(offset int64, maxBytes int32) (io.Reader, error)
 
 	// NewestOffsetFunc mocks the NewestOffset method.
 	NewestOffsetFunc func() int64
 
+	// OffsetForTimeFunc mocks the OffsetForTime method.
+	OffsetForTimeFunc func(in1 int64) (int64, int64, error)
+
 	// OldestOffsetFunc mocks the OldestOffset method.
 	OldestOffsetFunc func() int64
 
-	// TruncateFunc mocks the Truncate method.
-	TruncateFunc func(in1 int64) error
+	// TruncateToFunc mocks the TruncateTo method.
+	TruncateToFunc func(in1 int64) error
 
 	// calls tracks calls to the methods.
 	calls struct {
@@ -72,9 +100,22 @@ type CommitLog struct {
 			// In1 is the in1 argument value.
 			In1 []byte
 		}
+		// Appended holds details about calls to the Appended method.
+		Appended []struct {
+			// Offset is the offset argument value.
+			Offset int64
+		}
+		// Close holds details about calls to the Close method.
+		Close []struct {
+		}
 		// Delete holds details about calls to the Delete method.
 		Delete []struct {
 		}
+		// DeleteBefore holds details about calls to the DeleteBefore method.
+		DeleteBefore []struct {
+			// In1 is the in1 argument value.
+			In1 int64
+		}
 		// NewReader holds details about calls to the NewReader method.
 		NewReader []struct {
 			// Offset is the offset argument value.
@@ -85,11 +126,16 @@ type CommitLog struct {
 		// NewestOffset holds details about calls to the NewestOffset method.
 		NewestOffset []struct {
 		}
+		// OffsetForTime holds details about calls to the OffsetForTime method.
+		OffsetForTime []struct {
+			// In1 is the in1 argument value.
+			In1 int64
+		}
 		// OldestOffset holds details about calls to the OldestOffset method.
 		OldestOffset []struct {
 		}
-		// Truncate holds details about calls to the Truncate method.
-		Truncate []struct {
+		// TruncateTo holds details about calls to the TruncateTo method.
+		TruncateTo []struct {
 			// In1 is the in1 argument value.
 			In1 int64
 		}
@@ -101,21 +147,33 @@ func (mock *CommitLog) Reset() {
 	lockCommitLogAppend.Lock()
 	mock.calls.Append = nil
 	lockCommitLogAppend.Unlock()
+	lockCommitLogAppended.Lock()
+	mock.calls.Appended = nil
+	lockCommitLogAppended.Unlock()
+	lockCommitLogClose.Lock()
+	mock.calls.Close = nil
+	lockCommitLogClose.Unlock()
 	lockCommitLogDelete.Lock()
 	mock.calls.Delete = nil
 	lockCommitLogDelete.Unlock()
+	lockCommitLogDeleteBefore.Lock()
+	mock.calls.DeleteBefore = nil
+	lockCommitLogDeleteBefore.Unlock()
 	lockCommitLogNewReader.Lock()
 	mock.calls.NewReader = nil
 	lockCommitLogNewReader.Unlock()
 	lockCommitLogNewestOffset.Lock()
 	mock.calls.NewestOffset = nil
 	lockCommitLogNewestOffset.Unlock()
+	lockCommitLogOffsetForTime.Lock()
+	mock.calls.OffsetForTime = nil
+	lockCommitLogOffsetForTime.Unlock()
 	lockCommitLogOldestOffset.Lock()
 	mock.calls.OldestOffset = nil
 	lockCommitLogOldestOffset.Unlock()
-	lockCommitLogTruncate.Lock()
-	mock.calls.Truncate = nil
-	lockCommitLogTruncate.Unlock()
+	lockCommitLogTruncateTo.Lock()
+	mock.calls.TruncateTo = nil
+	lockCommitLogTruncateTo.Unlock()
 }
 
 // Append calls AppendFunc.
@@ -156,6 +214,77 @@ func (mock *CommitLog) AppendCalls() []struct {
 	return calls
 }
 
+// Appended calls AppendedFunc.
+func (mock *CommitLog) Appended(offset int64) <-chan struct{} {
+	if mock.AppendedFunc == nil {
+		panic("moq: CommitLog.AppendedFunc is nil but CommitLog.Appended was just called")
+	}
+	callInfo := struct {
+		Offset int64
+	}{
+		Offset: offset,
+	}
+	lockCommitLogAppended.Lock()
+	mock.calls.Appended = append(mock.calls.Appended, callInfo)
+	lockCommitLogAppended.Unlock()
+	return mock.AppendedFunc(offset)
+}
+
+// AppendedCalled returns true if at least one call was made to Appended.
+func (mock *CommitLog) AppendedCalled() bool {
+	lockCommitLogAppended.RLock()
+	defer lockCommitLogAppended.RUnlock()
+	return len(mock.calls.Appended) > 0
+}
+
+// AppendedCalls gets all the calls that were made to Appended.
+// Check the length with:
+//     len(mockedCommitLog.AppendedCalls())
+func (mock *CommitLog) AppendedCalls() []struct {
+	Offset int64
+} {
+	var calls []struct {
+		Offset int64
+	}
+	lockCommitLogAppended.RLock()
+	calls = mock.calls.Appended
+	lockCommitLogAppended.RUnlock()
+	return calls
+}
+
+// Close calls CloseFunc.
+func (mock *CommitLog) Close() error {
+	if mock.CloseFunc == nil {
+		panic("moq: CommitLog.CloseFunc is nil but CommitLog.Close was just called")
+	}
+	callInfo := struct {
+	}{}
+	lockCommitLogClose.Lock()
+	mock.calls.Close = append(mock.calls.Close, callInfo)
+	lockCommitLogClose.Unlock()
+	return mock.CloseFunc()
+}
+
+// CloseCalled returns true if at least one call was made to Close.
+func (mock *CommitLog) CloseCalled() bool {
+	lockCommitLogClose.RLock()
+	defer lockCommitLogClose.RUnlock()
+	return len(mock.calls.Close) > 0
+}
+
+// CloseCalls gets all the calls that were made to Close.
+// Check the length with:
+//     len(mockedCommitLog.CloseCalls())
+func (mock *CommitLog) CloseCalls() []struct {
+} {
+	var calls []struct {
+	}
+	lockCommitLogClose.RLock()
+	calls = mock.calls.Close
+	lockCommitLogClose.RUnlock()
+	return calls
+}
+
 // Delete calls DeleteFunc.
 func (mock *CommitLog) Delete() error {
 	if mock.DeleteFunc == nil {
@@ -189,6 +318,44 @@ func (mock *CommitLog) DeleteCalls() []struct {
 	return calls
 }
 
+// DeleteBefore calls DeleteBeforeFunc.
+func (mock *CommitLog) DeleteBefore(in1 int64) error {
+	if mock.DeleteBeforeFunc == nil {
+		panic("moq: CommitLog.DeleteBeforeFunc is nil but CommitLog.DeleteBefore was just called")
+	}
+	callInfo := struct {
+		In1 int64
+	}{
+		In1: in1,
+	}
+	lockCommitLogDeleteBefore.Lock()
+	mock.calls.DeleteBefore = append(mock.calls.DeleteBefore, callInfo)
+	lockCommitLogDeleteBefore.Unlock()
+	return mock.DeleteBeforeFunc(in1)
+}
+
+// DeleteBeforeCalled returns true if at least one call was made to DeleteBefore.
+func (mock *CommitLog) DeleteBeforeCalled() bool {
+	lockCommitLogDeleteBefore.RLock()
+	defer lockCommitLogDeleteBefore.RUnlock()
+	return len(mock.calls.DeleteBefore) > 0
+}
+
+// DeleteBeforeCalls gets all the calls that were made to DeleteBefore.
+// Check the length with:
+//     len(mockedCommitLog.DeleteBeforeCalls())
+func (mock *CommitLog) DeleteBeforeCalls() []struct {
+	In1 int64
+} {
+	var calls []struct {
+		In1 int64
+	}
+	lockCommitLogDeleteBefore.RLock()
+	calls = mock.calls.DeleteBefore
+	lockCommitLogDeleteBefore.RUnlock()
+	return calls
+}
+
 // NewReader calls NewReaderFunc.
 func (mock *CommitLog) NewReader(offset int64, maxBytes int32) (io.Reader, error) {
 	if mock.NewReaderFunc == nil {
@@ -264,6 +431,44 @@ func (mock *CommitLog) NewestOffsetCalls() []struct {
 	return calls
 }
 
+// OffsetForTime calls OffsetForTimeFunc.
+func (mock *CommitLog) OffsetForTime(in1 int64) (int64, int64, error) {
+	if mock.OffsetForTimeFunc == nil {
+		panic("moq: CommitLog.OffsetForTimeFunc is nil but CommitLog.OffsetForTime was just called")
+	}
+	callInfo := struct {
+		In1 int64
+	}{
+		In1: in1,
+	}
+	lockCommitLogOffsetForTime.Lock()
+	mock.calls.OffsetForTime = append(mock.calls.OffsetForTime, callInfo)
+	lockCommitLogOffsetForTime.Unlock()
+	return mock.OffsetForTimeFunc(in1)
+}
+
+// OffsetForTimeCalled returns true if at least one call was made to OffsetForTime.
+func (mock *CommitLog) OffsetForTimeCalled() bool {
+	lockCommitLogOffsetForTime.RLock()
+	defer lockCommitLogOffsetForTime.RUnlock()
+	return len(mock.calls.OffsetForTime) > 0
+}
+
+// OffsetForTimeCalls gets all the calls that were made to OffsetForTime.
+// Check the length with:
+//     len(mockedCommitLog.OffsetForTimeCalls())
+func (mock *CommitLog) OffsetForTimeCalls() []struct {
+	In1 int64
+} {
+	var calls []struct {
+		In1 int64
+	}
+	lockCommitLogOffsetForTime.RLock()
+	calls = mock.calls.OffsetForTime
+	lockCommitLogOffsetForTime.RUnlock()
+	return calls
+}
+
 // OldestOffset calls OldestOffsetFunc.
 func (mock *CommitLog) OldestOffset() int64 {
 	if mock.OldestOffsetFunc == nil {
@@ -297,40 +502,40 @@ func (mock *CommitLog) OldestOffsetCalls() []struct {
 	return calls
 }
 
-// Truncate calls TruncateFunc.
-func (mock *CommitLog) Truncate(in1 int64) error {
-	if mock.TruncateFunc == nil {
-		panic("moq: CommitLog.TruncateFunc is nil but CommitLog.Truncate was just called")
+// TruncateTo calls TruncateToFunc.
+func (mock *CommitLog) TruncateTo(in1 int64) error {
+	if mock.TruncateToFunc == nil {
+		panic("moq: CommitLog.TruncateToFunc is nil but CommitLog.TruncateTo was just called")
 	}
 	callInfo := struct {
 		In1 int64
 	}{
 		In1: in1,
 	}
-	lockCommitLogTruncate.Lock()
-	mock.calls.Truncate = append(mock.calls.Truncate, callInfo)
-	lockCommitLogTruncate.Unlock()
-	return mock.TruncateFunc(in1)
+	lockCommitLogTruncateTo.Lock()
+	mock.calls.TruncateTo = append(mock.calls.TruncateTo, callInfo)
+	lockCommitLogTruncateTo.Unlock()
+	return mock.TruncateToFunc(in1)
 }
 
-// TruncateCalled returns true if at least one call was made to Truncate.
-func (mock *CommitLog) TruncateCalled() bool {
-	lockCommitLogTruncate.RLock()
-	defer lockCommitLogTruncate.RUnlock()
-	return len(mock.calls.Truncate) > 0
+// TruncateToCalled returns true if at least one call was made to TruncateTo.
+func (mock *CommitLog) TruncateToCalled() bool {
+	lockCommitLogTruncateTo.RLock()
+	defer lockCommitLogTruncateTo.RUnlock()
+	return len(mock.calls.TruncateTo) > 0
 }
 
-// TruncateCalls gets all the calls that were made to Truncate.
+// TruncateToCalls gets all the calls that were made to TruncateTo.
 // Check the length with:
-//     len(mockedCommitLog.TruncateCalls())
-func (mock *CommitLog) TruncateCalls() []struct {
+//     len(mockedCommitLog.TruncateToCalls())
+func (mock *CommitLog) TruncateToCalls() []struct {
 	In1 int64
 } {
 	var calls []struct {
 		In1 int64
 	}
-	lockCommitLogTruncate.RLock()
-	calls = mock.calls.Truncate
-	lockCommitLogTruncate.RUnlock()
+	lockCommitLogTruncateTo.RLock()
+	calls = mock.calls.TruncateTo
+	lockCommitLogTruncateTo.RUnlock()
 	return calls
 }
@@ -11,5 +11,13 @@ func NewMetrics() *jocko.Metrics {
 			Name: "requests_handled",
 			Help: "Number of requests handled by the server.",
 		}),
+		LogBytesDiscarded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "log_bytes_discarded",
+			Help: "Number of corrupt bytes truncated from commit logs during recovery.",
+		}),
+		LogFlushLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "log_flush_latency_seconds",
+			Help: "Time taken to flush commit logs to disk.",
+		}),
 	}
 }
@@ -1,6 +1,11 @@
 package protocol
 
-type APIVersionsRequest struct{}
+type APIVersionsRequest struct {
+	// APIVersion is the version the request's encoded with. The request's
+	// empty in every version, its response has the throttle time from
+	// version 1.
+	APIVersion int16
+}
 
 func (c *APIVersionsRequest) Encode(_ PacketEncoder) error {
 	return nil
@@ -15,5 +20,13 @@ func (c *APIVersionsRequest) Key() int16 {
 }
 
 func (c *APIVersionsRequest) Version() int16 {
+	return c.APIVersion
+}
+
+func (c *APIVersionsRequest) MinVersion() int16 {
 	return 0
 }
+
+func (c *APIVersionsRequest) MaxVersion() int16 {
+	return 1
+}
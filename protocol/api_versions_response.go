@@ -1,8 +1,11 @@
 package protocol
 
 type APIVersionsResponse struct {
-	APIVersions []APIVersion
-	ErrorCode   int16
+	// APIVersion is the version of the request the response is for.
+	APIVersion     int16
+	ErrorCode      int16
+	APIVersions    []APIVersion
+	ThrottleTimeMs int32
 }
 
 type APIVersion struct {
@@ -22,10 +25,17 @@ func (c *APIVersionsResponse) Encode(e PacketEncoder) error {
 		e.PutInt16(av.MinVersion)
 		e.PutInt16(av.MaxVersion)
 	}
+	if c.APIVersion >= 1 {
+		e.PutInt32(c.ThrottleTimeMs)
+	}
 	return nil
 }
 
 func (c *APIVersionsResponse) Decode(d PacketDecoder) error {
+	var err error
+	if c.ErrorCode, err = d.Int16(); err != nil {
+		return err
+	}
 	l, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -53,5 +63,10 @@ func (c *APIVersionsResponse) Decode(d PacketDecoder) error {
 			MaxVersion: maxVersion,
 		}
 	}
+	if c.APIVersion >= 1 {
+		if c.ThrottleTimeMs, err = d.Int32(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
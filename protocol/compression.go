@@ -0,0 +1,217 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	snappy "github.com/eapache/go-xerial-snappy"
+	snappyblock "github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// CompressionCodec is the codec a compressed message's value or a record
+// batch's records are compressed with, it's in the low bits of the message's
+// or batch's attributes.
+type CompressionCodec int8
+
+const (
+	CompressionNone CompressionCodec = iota
+	CompressionGZIP
+	CompressionSnappy
+	CompressionLZ4
+	CompressionZSTD
+)
+
+// compressionCodecMask masks the codec from a message's or batch's
+// attributes.
+const compressionCodecMask = 0x07
+
+// ErrUnknownCompressionCodec is returned compressing or decompressing with a
+// codec that isn't one of the above.
+var ErrUnknownCompressionCodec = errors.New("kafka: unknown compression codec")
+
+// ErrDecompressedTooLarge is returned decompressing data that decompresses to
+// more than maxDecompressedBytes.
+var ErrDecompressedTooLarge = errors.New("kafka: decompressed data is too large")
+
+// ErrNestedCompression is returned decoding a compressed message that wraps
+// another compressed message, which Kafka doesn't allow.
+var ErrNestedCompression = errors.New("kafka: compressed message wraps a compressed message")
+
+// maxDecompressedBytes caps the size data decompresses to, so a small
+// compressed message can't use up the broker's memory.
+const maxDecompressedBytes = 64 << 20
+
+var compressionCodecNames = map[CompressionCodec]string{
+	CompressionNone:   "none",
+	CompressionGZIP:   "gzip",
+	CompressionSnappy: "snappy",
+	CompressionLZ4:    "lz4",
+	CompressionZSTD:   "zstd",
+}
+
+func (c CompressionCodec) String() string {
+	if name, ok := compressionCodecNames[c]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseCompressionCodec returns the codec with the name, as in a topic's
+// compression.type config. Uncompressed is the same as none.
+func ParseCompressionCodec(name string) (CompressionCodec, error) {
+	if name == "uncompressed" {
+		return CompressionNone, nil
+	}
+	for c, n := range compressionCodecNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return CompressionNone, ErrUnknownCompressionCodec
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the zstd encoder and decoder, which are safe to share.
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedBytes))
+	})
+	return zstdErr
+}
+
+// Compress returns b compressed with the codec.
+func Compress(codec CompressionCodec, b []byte) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		return b, nil
+	case CompressionGZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(b), nil
+	case CompressionLZ4:
+		var buf bytes.Buffer
+		w := lz4.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, ErrUnknownCompressionCodec
+}
+
+// Decompress returns b decompressed with the codec, or
+// ErrDecompressedTooLarge if it decompresses to more than
+// maxDecompressedBytes. Snappy accepts both plain and xerial framed data, as
+// the Java client frames it.
+func Decompress(codec CompressionCodec, b []byte) ([]byte, error) {
+	switch codec {
+	case CompressionNone:
+		return b, nil
+	case CompressionGZIP:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return readLimited(r)
+	case CompressionSnappy:
+		// snappy allocates the length its blocks' headers claim, so they're
+		// checked before it decodes them
+		if err := checkSnappyLen(b); err != nil {
+			return nil, err
+		}
+		return snappy.Decode(b)
+	case CompressionLZ4:
+		return readLimited(lz4.NewReader(bytes.NewReader(b)))
+	case CompressionZSTD:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		raw, err := zstdDecoder.DecodeAll(b, nil)
+		if err == zstd.ErrDecoderSizeExceeded {
+			return nil, ErrDecompressedTooLarge
+		}
+		return raw, err
+	}
+	return nil, ErrUnknownCompressionCodec
+}
+
+// xerialHeader starts snappy data in the xerial framing, which is followed
+// by its version info and then its blocks, each prefixed with its length.
+var xerialHeader = []byte{130, 83, 78, 65, 80, 80, 89, 0}
+
+const xerialBlocksOffset = 16
+
+// checkSnappyLen returns ErrDecompressedTooLarge if b's blocks claim to
+// decode to more than maxDecompressedBytes. Malformed data is left for
+// snappy to reject.
+func checkSnappyLen(b []byte) error {
+	if len(b) < xerialBlocksOffset || !bytes.Equal(b[:len(xerialHeader)], xerialHeader) {
+		n, err := snappyblock.DecodedLen(b)
+		if err == nil && n > maxDecompressedBytes {
+			return ErrDecompressedTooLarge
+		}
+		return nil
+	}
+	var total int
+	for pos := xerialBlocksOffset; pos+4 <= len(b); {
+		size := int(binary.BigEndian.Uint32(b[pos:]))
+		pos += 4
+		if size < 0 || size > len(b)-pos {
+			return nil
+		}
+		n, err := snappyblock.DecodedLen(b[pos : pos+size])
+		if err != nil {
+			return nil
+		}
+		if total += n; total > maxDecompressedBytes {
+			return ErrDecompressedTooLarge
+		}
+		pos += size
+	}
+	return nil
+}
+
+// readLimited reads r to the end, or until it's read more than
+// maxDecompressedBytes.
+func readLimited(r io.Reader) ([]byte, error) {
+	raw, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxDecompressedBytes {
+		return nil, ErrDecompressedTooLarge
+	}
+	return raw, nil
+}
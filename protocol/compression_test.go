@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	snappy "github.com/eapache/go-xerial-snappy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	req := require.New(t)
+	b := bytes.Repeat([]byte("compress me "), 100)
+	for codec := CompressionNone; codec <= CompressionZSTD; codec++ {
+		c, err := Compress(codec, b)
+		req.NoError(err)
+		act, err := Decompress(codec, c)
+		req.NoError(err, codec.String())
+		req.Equal(b, act, codec.String())
+
+		parsed, err := ParseCompressionCodec(codec.String())
+		req.NoError(err)
+		req.Equal(codec, parsed)
+	}
+	_, err := Compress(CompressionCodec(5), b)
+	req.Equal(ErrUnknownCompressionCodec, err)
+	_, err = ParseCompressionCodec("brotli")
+	req.Equal(ErrUnknownCompressionCodec, err)
+}
+
+func TestCompressedMessage(t *testing.T) {
+	req := require.New(t)
+	set := []*MessageSet{
+		{Offset: 0, Messages: []*Message{{MagicByte: 1, Timestamp: time.Unix(1000, 0), Value: []byte("one")}}},
+		{Offset: 1, Messages: []*Message{{MagicByte: 1, Timestamp: time.Unix(1001, 0), Key: []byte("key"), Value: []byte("two")}}},
+	}
+	for codec := CompressionGZIP; codec <= CompressionZSTD; codec++ {
+		exp := &MessageSet{Offset: 1, Messages: []*Message{{
+			MagicByte: 1,
+			Timestamp: time.Unix(1001, 0),
+			Codec:     codec,
+			Set:       set,
+		}}}
+		b, err := Encode(exp)
+		req.NoError(err)
+		// the codec's in the wrapper's attributes
+		req.Equal(byte(codec), b[17])
+
+		var act MessageSet
+		req.NoError(Decode(b, &act))
+		m := act.Messages[0]
+		req.Equal(codec, m.Codec)
+		req.Equal(2, len(m.Set))
+		for i, ms := range m.Set {
+			req.Equal(set[i].Offset, ms.Offset)
+			req.Equal(set[i].Messages[0].Key, ms.Messages[0].Key)
+			req.Equal(set[i].Messages[0].Value, ms.Messages[0].Value)
+			req.Equal(set[i].Messages[0].Timestamp, ms.Messages[0].Timestamp)
+		}
+
+		// and it's encoded again as it was decoded
+		b2, err := Encode(&act)
+		req.NoError(err)
+		req.Equal(b, b2)
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	req := require.New(t)
+	b := make([]byte, maxDecompressedBytes+1)
+	for codec := CompressionGZIP; codec <= CompressionZSTD; codec++ {
+		c, err := Compress(codec, b)
+		req.NoError(err)
+		_, err = Decompress(codec, c)
+		req.Equal(ErrDecompressedTooLarge, err, codec.String())
+	}
+}
+
+func TestDecompressSnappyLengthHeader(t *testing.T) {
+	req := require.New(t)
+	// a block whose header claims it decodes to 4GB
+	block := []byte{0xff, 0xff, 0xff, 0xff, 0x0f, 0x00}
+	_, err := Decompress(CompressionSnappy, block)
+	req.Equal(ErrDecompressedTooLarge, err)
+
+	framed := append([]byte{}, xerialHeader...)
+	framed = append(framed, 0, 0, 0, 1, 0, 0, 0, 1)
+	framed = append(framed, 0, 0, 0, byte(len(block)))
+	framed = append(framed, block...)
+	_, err = Decompress(CompressionSnappy, framed)
+	req.Equal(ErrDecompressedTooLarge, err)
+
+	// framed data within the limit still decodes
+	b := bytes.Repeat([]byte("compress me "), 10000)
+	act, err := Decompress(CompressionSnappy, snappy.EncodeStream(nil, b))
+	req.NoError(err)
+	req.Equal(b, act)
+}
+
+func TestNestedCompressedMessage(t *testing.T) {
+	req := require.New(t)
+	inner := &MessageSet{Offset: 0, Messages: []*Message{{
+		Codec: CompressionGZIP,
+		Set:   []*MessageSet{{Offset: 0, Messages: []*Message{{Value: []byte("one")}}}},
+	}}}
+	b, err := Encode(&MessageSet{Offset: 0, Messages: []*Message{{
+		Codec: CompressionGZIP,
+		Set:   []*MessageSet{inner},
+	}}})
+	req.NoError(err)
+	var act MessageSet
+	req.Equal(ErrNestedCompression, Decode(b, &act))
+}
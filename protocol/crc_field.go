@@ -7,6 +7,18 @@ import (
 
 type CRCField struct {
 	StartOffset int
+	// Castagnoli is whether the CRC uses the Castagnoli polynomial, as record
+	// batches' do, rather than IEEE.
+	Castagnoli bool
+}
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (f *CRCField) checksum(b []byte) uint32 {
+	if f.Castagnoli {
+		return crc32.Checksum(b, castagnoliTable)
+	}
+	return crc32.ChecksumIEEE(b)
 }
 
 func (f *CRCField) SaveOffset(in int) {
@@ -18,13 +30,13 @@ func (f *CRCField) ReserveSize() int {
 }
 
 func (f *CRCField) Fill(curOffset int, buf []byte) error {
-	crc := crc32.ChecksumIEEE(buf[f.StartOffset+4 : curOffset])
+	crc := f.checksum(buf[f.StartOffset+4 : curOffset])
 	Encoding.PutUint32(buf[f.StartOffset:], crc)
 	return nil
 }
 
 func (f *CRCField) Check(curOffset int, buf []byte) error {
-	crc := crc32.ChecksumIEEE(buf[f.StartOffset+4 : curOffset])
+	crc := f.checksum(buf[f.StartOffset+4 : curOffset])
 	if crc != Encoding.Uint32(buf[f.StartOffset:]) {
 		return errors.New("crc didn't match")
 	}
@@ -9,8 +9,13 @@ type CreateTopicRequest struct {
 }
 
 type CreateTopicRequests struct {
-	Requests []*CreateTopicRequest
-	Timeout  int32
+	// APIVersion is the version the request's encoded with. ValidateOnly
+	// is from version 1, as are the error messages in the response, and the
+	// response has the throttle time from version 2.
+	APIVersion   int16
+	Requests     []*CreateTopicRequest
+	Timeout      int32
+	ValidateOnly bool
 }
 
 func (c *CreateTopicRequests) Encode(e PacketEncoder) error {
@@ -31,6 +36,9 @@ func (c *CreateTopicRequests) Encode(e PacketEncoder) error {
 		}
 	}
 	e.PutInt32(c.Timeout)
+	if c.APIVersion >= 1 {
+		e.PutBool(c.ValidateOnly)
+	}
 	return nil
 }
 
@@ -101,7 +109,12 @@ func (c *CreateTopicRequests) Decode(d PacketDecoder) error {
 		req.Configs = c
 	}
 	c.Timeout, err = d.Int32()
-
+	if err != nil {
+		return err
+	}
+	if c.APIVersion >= 1 {
+		c.ValidateOnly, err = d.Bool()
+	}
 	return err
 }
 
@@ -110,5 +123,13 @@ func (c *CreateTopicRequests) Key() int16 {
 }
 
 func (c *CreateTopicRequests) Version() int16 {
+	return c.APIVersion
+}
+
+func (c *CreateTopicRequests) MinVersion() int16 {
 	return 0
 }
+
+func (c *CreateTopicRequests) MaxVersion() int16 {
+	return 2
+}
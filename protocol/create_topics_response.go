@@ -3,22 +3,39 @@ package protocol
 type TopicErrorCode struct {
 	Topic     string
 	ErrorCode int16
+	// ErrorMessage is from version 1 of create topics responses.
+	ErrorMessage *string
 }
 
 type CreateTopicsResponse struct {
+	// APIVersion is the version of the request the response is for.
+	APIVersion      int16
+	ThrottleTimeMs  int32
 	TopicErrorCodes []*TopicErrorCode
 }
 
 func (c *CreateTopicsResponse) Encode(e PacketEncoder) error {
+	if c.APIVersion >= 2 {
+		e.PutInt32(c.ThrottleTimeMs)
+	}
 	e.PutArrayLength(len(c.TopicErrorCodes))
 	for _, t := range c.TopicErrorCodes {
 		e.PutString(t.Topic)
 		e.PutInt16(t.ErrorCode)
+		if c.APIVersion >= 1 {
+			e.PutNullableString(t.ErrorMessage)
+		}
 	}
 	return nil
 }
 
 func (c *CreateTopicsResponse) Decode(d PacketDecoder) error {
+	var err error
+	if c.APIVersion >= 2 {
+		if c.ThrottleTimeMs, err = d.Int32(); err != nil {
+			return err
+		}
+	}
 	l, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -33,10 +50,17 @@ func (c *CreateTopicsResponse) Decode(d PacketDecoder) error {
 		if err != nil {
 			return err
 		}
+		var errorMessage *string
+		if c.APIVersion >= 1 {
+			if errorMessage, err = d.NullableString(); err != nil {
+				return err
+			}
+		}
 
 		c.TopicErrorCodes[i] = &TopicErrorCode{
-			Topic:     topic,
-			ErrorCode: errorCode,
+			Topic:        topic,
+			ErrorCode:    errorCode,
+			ErrorMessage: errorMessage,
 		}
 	}
 	return nil
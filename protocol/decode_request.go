@@ -0,0 +1,74 @@
+package protocol
+
+// requestBody is a request's body that can be decoded.
+type requestBody interface {
+	Body
+	Decoder
+}
+
+// newRequestBody returns an empty body for a request with the API key and
+// version, or nil if the key's unknown.
+func newRequestBody(key, version int16) requestBody {
+	switch key {
+	case APIVersionsKey:
+		return &APIVersionsRequest{APIVersion: version}
+	case ProduceKey:
+		return &ProduceRequest{APIVersion: version}
+	case FetchKey:
+		return &FetchRequest{APIVersion: version}
+	case OffsetsKey:
+		return &OffsetsRequest{APIVersion: version}
+	case MetadataKey:
+		return &MetadataRequest{APIVersion: version}
+	case CreateTopicsKey:
+		return &CreateTopicRequests{APIVersion: version}
+	case DeleteTopicsKey:
+		return &DeleteTopicsRequest{APIVersion: version}
+	case OffsetCommitKey:
+		return &OffsetCommitRequest{APIVersion: version}
+	case OffsetFetchKey:
+		return &OffsetFetchRequest{APIVersion: version}
+	case LeaderAndISRKey:
+		return &LeaderAndISRRequest{}
+	case StopReplicaKey:
+		return &StopReplicaRequest{}
+	case GroupCoordinatorKey:
+		return &GroupCoordinatorRequest{}
+	case JoinGroupKey:
+		return &JoinGroupRequest{}
+	case HeartbeatKey:
+		return &HeartbeatRequest{}
+	case LeaveGroupKey:
+		return &LeaveGroupRequest{}
+	case SyncGroupKey:
+		return &SyncGroupRequest{}
+	case DescribeGroupsKey:
+		return &DescribeGroupsRequest{}
+	case ListGroupsKey:
+		return &ListGroupsRequest{}
+	}
+	return nil
+}
+
+// DecodeRequest decodes a request, its size, header, and body, as read from
+// a connection. The body's nil if the request's API key is unknown, and it's
+// left empty if the request's version isn't supported as it can't be decoded.
+// An error's returned if the header or body are malformed.
+func DecodeRequest(b []byte) (*RequestHeader, Body, error) {
+	d := NewDecoder(b)
+	header := new(RequestHeader)
+	if err := header.Decode(d); err != nil {
+		return nil, nil, err
+	}
+	body := newRequestBody(header.APIKey, header.APIVersion)
+	if body == nil {
+		return header, nil, nil
+	}
+	if !SupportsVersion(body, header.APIVersion) {
+		return header, body, nil
+	}
+	if err := body.Decode(d); err != nil {
+		return header, nil, err
+	}
+	return header, body, nil
+}
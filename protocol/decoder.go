@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"encoding/binary"
 	"errors"
 	"math"
 )
@@ -9,6 +10,7 @@ var ErrInsufficientData = errors.New("kafka: insufficient data to decode packet,
 var ErrInvalidStringLength = errors.New("kafka: invalid string length")
 var ErrInvalidArrayLength = errors.New("kafka: invalid array length")
 var ErrInvalidByteSliceLength = errors.New("invalid byteslice length")
+var ErrVarintOverflow = errors.New("kafka: varint overflow")
 
 type PacketDecoder interface {
 	Bool() (bool, error)
@@ -18,7 +20,11 @@ type PacketDecoder interface {
 	Int64() (int64, error)
 	ArrayLength() (int, error)
 	Bytes() ([]byte, error)
+	RawBytes(length int) ([]byte, error)
 	String() (string, error)
+	NullableString() (*string, error)
+	Varint() (int64, error)
+	VarintBytes() ([]byte, error)
 	Int32Array() ([]int32, error)
 	Int64Array() ([]int64, error)
 	StringArray() ([]string, error)
@@ -67,12 +73,20 @@ func (d *ByteDecoder) Bool() (bool, error) {
 }
 
 func (d *ByteDecoder) Int8() (int8, error) {
+	if d.remaining() < 1 {
+		d.off = len(d.b)
+		return -1, ErrInsufficientData
+	}
 	tmp := int8(d.b[d.off])
 	d.off++
 	return tmp, nil
 }
 
 func (d *ByteDecoder) Int16() (int16, error) {
+	if d.remaining() < 2 {
+		d.off = len(d.b)
+		return -1, ErrInsufficientData
+	}
 	tmp := int16(Encoding.Uint16(d.b[d.off:]))
 	d.off += 2
 	return tmp, nil
@@ -116,6 +130,19 @@ func (d *ByteDecoder) ArrayLength() (int, error) {
 
 // collections
 
+func (d *ByteDecoder) RawBytes(length int) ([]byte, error) {
+	if length < 0 {
+		return nil, ErrInvalidByteSliceLength
+	}
+	if length > d.remaining() {
+		d.off = len(d.b)
+		return nil, ErrInsufficientData
+	}
+	tmp := d.b[d.off : d.off+length]
+	d.off += length
+	return tmp, nil
+}
+
 func (d *ByteDecoder) Bytes() ([]byte, error) {
 	tmp, err := d.Int32()
 
@@ -168,6 +195,57 @@ func (d *ByteDecoder) String() (string, error) {
 	return tmpStr, nil
 }
 
+// NullableString is String, except a null string's returned as nil rather
+// than empty.
+func (d *ByteDecoder) NullableString() (*string, error) {
+	if d.remaining() >= 2 && int16(Encoding.Uint16(d.b[d.off:])) == -1 {
+		d.off += 2
+		return nil, nil
+	}
+	str, err := d.String()
+	if err != nil {
+		return nil, err
+	}
+	return &str, nil
+}
+
+// Varint decodes a zig-zag encoded varint, as used by record batches.
+func (d *ByteDecoder) Varint() (int64, error) {
+	tmp, n := binary.Varint(d.b[d.off:])
+	if n == 0 {
+		d.off = len(d.b)
+		return -1, ErrInsufficientData
+	}
+	if n < 0 {
+		d.off -= n
+		return -1, ErrVarintOverflow
+	}
+	d.off += n
+	return tmp, nil
+}
+
+// VarintBytes decodes a varint length followed by that many bytes, nil if
+// the length's -1.
+func (d *ByteDecoder) VarintBytes() ([]byte, error) {
+	tmp, err := d.Varint()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tmp < -1:
+		return nil, ErrInvalidByteSliceLength
+	case tmp == -1:
+		return nil, nil
+	case tmp > int64(d.remaining()):
+		d.off = len(d.b)
+		return nil, ErrInsufficientData
+	}
+	n := int(tmp)
+	tmpBytes := d.b[d.off : d.off+n]
+	d.off += n
+	return tmpBytes, nil
+}
+
 func (d *ByteDecoder) Int32Array() ([]int32, error) {
 	if d.remaining() < 4 {
 		d.off = len(d.b)
@@ -242,6 +320,12 @@ func (d *ByteDecoder) StringArray() ([]string, error) {
 		return nil, ErrInvalidArrayLength
 	}
 
+	// a string's at least its length
+	if d.remaining() < 2*n {
+		d.off = len(d.b)
+		return nil, ErrInsufficientData
+	}
+
 	ret := make([]string, n)
 	for i := range ret {
 		if str, err := d.String(); err != nil {
@@ -1,8 +1,12 @@
 package protocol
 
 type DeleteTopicsRequest struct {
-	Topics  []string
-	Timeout int32
+	// APIVersion is the version the request's encoded with. The request's
+	// the same in every version, its response has the throttle time from
+	// version 1.
+	APIVersion int16
+	Topics     []string
+	Timeout    int32
 }
 
 func (c *DeleteTopicsRequest) Encode(e PacketEncoder) (err error) {
@@ -27,5 +31,13 @@ func (c *DeleteTopicsRequest) Key() int16 {
 }
 
 func (c *DeleteTopicsRequest) Version() int16 {
+	return c.APIVersion
+}
+
+func (c *DeleteTopicsRequest) MinVersion() int16 {
 	return 0
 }
+
+func (c *DeleteTopicsRequest) MaxVersion() int16 {
+	return 1
+}
@@ -1,10 +1,16 @@
 package protocol
 
 type DeleteTopicsResponse struct {
+	// APIVersion is the version of the request the response is for.
+	APIVersion      int16
+	ThrottleTimeMs  int32
 	TopicErrorCodes []*TopicErrorCode
 }
 
 func (c *DeleteTopicsResponse) Encode(e PacketEncoder) error {
+	if c.APIVersion >= 1 {
+		e.PutInt32(c.ThrottleTimeMs)
+	}
 	e.PutArrayLength(len(c.TopicErrorCodes))
 	for _, t := range c.TopicErrorCodes {
 		e.PutString(t.Topic)
@@ -14,6 +20,12 @@ func (c *DeleteTopicsResponse) Encode(e PacketEncoder) error {
 }
 
 func (c *DeleteTopicsResponse) Decode(d PacketDecoder) error {
+	var err error
+	if c.APIVersion >= 1 {
+		if c.ThrottleTimeMs, err = d.Int32(); err != nil {
+			return err
+		}
+	}
 	l, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -20,3 +20,11 @@ func (r *DescribeGroupsRequest) Key() int16 {
 func (r *DescribeGroupsRequest) Version() int16 {
 	return 0
 }
+
+func (r *DescribeGroupsRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *DescribeGroupsRequest) MaxVersion() int16 {
+	return 0
+}
@@ -18,6 +18,9 @@ func (r *DescribeGroupsResponse) Encode(e PacketEncoder) error {
 
 func (r *DescribeGroupsResponse) Decode(d PacketDecoder) (err error) {
 	groupCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
 	r.Groups = make([]*Group, groupCount)
 	for i := 0; i < groupCount; i++ {
 		r.Groups[i] = new(Group)
@@ -1,6 +1,11 @@
 package protocol
 
-import "math"
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+)
 
 type PacketEncoder interface {
 	PutBool(in bool)
@@ -12,9 +17,13 @@ type PacketEncoder interface {
 	PutRawBytes(in []byte) error
 	PutBytes(in []byte) error
 	PutString(in string) error
+	PutNullableString(in *string) error
+	PutVarint(in int64)
+	PutVarintBytes(in []byte) error
 	PutStringArray(in []string) error
 	PutInt32Array(in []int32) error
 	PutInt64Array(in []int64) error
+	PutFileRegions(in []FileRegion) error
 	Push(pe PushEncoder)
 	Pop()
 }
@@ -46,9 +55,54 @@ func Encode(e Encoder) ([]byte, error) {
 	return b, nil
 }
 
+// EncodeTo encodes e and writes it to w. Unlike Encode, e's file regions
+// aren't read into the encoded bytes, they're written to w from their files
+// so a fetch's record sets are sent without being copied onto the heap. If it
+// returns an error part of e may have been written, so w has to be closed.
+func EncodeTo(w io.Writer, e Encoder) error {
+	lenEnc := new(LenEncoder)
+	err := e.Encode(lenEnc)
+	if err != nil {
+		return err
+	}
+
+	regionEnc := &regionEncoder{
+		ByteEncoder: NewByteEncoder(make([]byte, lenEnc.Length-lenEnc.regionsLength)),
+	}
+	err = e.Encode(regionEnc)
+	if err != nil {
+		return err
+	}
+
+	// the bytes in between the regions are buffered and flushed before
+	// each run of regions is written from their files
+	bw := bufio.NewWriter(w)
+	var off int
+	for _, r := range regionEnc.regions {
+		if _, err = bw.Write(regionEnc.b[off:r.off]); err != nil {
+			return err
+		}
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+		off = r.off
+		for _, region := range r.regions {
+			if _, err = region.WriteTo(w); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err = bw.Write(regionEnc.b[off:]); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
 type LenEncoder struct {
 	Length int
 	stack  []int
+	// regionsLength is how much of Length is file regions.
+	regionsLength int
 }
 
 func (e *LenEncoder) PutBool(in bool) {
@@ -110,6 +164,32 @@ func (e *LenEncoder) PutString(in string) error {
 	return nil
 }
 
+func (e *LenEncoder) PutNullableString(in *string) error {
+	if in == nil {
+		e.Length += 2
+		return nil
+	}
+	return e.PutString(*in)
+}
+
+func (e *LenEncoder) PutVarint(in int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.Length += binary.PutVarint(buf[:], in)
+}
+
+func (e *LenEncoder) PutVarintBytes(in []byte) error {
+	if in == nil {
+		e.PutVarint(-1)
+		return nil
+	}
+	if len(in) > math.MaxInt32 {
+		return ErrInvalidByteSliceLength
+	}
+	e.PutVarint(int64(len(in)))
+	e.Length += len(in)
+	return nil
+}
+
 func (e *LenEncoder) PutStringArray(in []string) error {
 	err := e.PutArrayLength(len(in))
 	if err != nil {
@@ -143,6 +223,16 @@ func (e *LenEncoder) PutInt64Array(in []int64) error {
 	return nil
 }
 
+func (e *LenEncoder) PutFileRegions(in []FileRegion) error {
+	n := fileRegionsLength(in)
+	if n > math.MaxInt32 {
+		return ErrInvalidByteSliceLength
+	}
+	e.Length += 4 + int(n)
+	e.regionsLength += int(n)
+	return nil
+}
+
 func (e *LenEncoder) Push(pe PushEncoder) {
 	e.Length += pe.ReserveSize()
 }
@@ -219,6 +309,32 @@ func (e *ByteEncoder) PutString(in string) error {
 	return nil
 }
 
+func (e *ByteEncoder) PutNullableString(in *string) error {
+	if in == nil {
+		e.PutInt16(-1)
+		return nil
+	}
+	return e.PutString(*in)
+}
+
+// PutVarint puts in as a zig-zag encoded varint, as used by record batches.
+func (e *ByteEncoder) PutVarint(in int64) {
+	e.off += binary.PutVarint(e.b[e.off:], in)
+}
+
+// PutVarintBytes puts in as a varint length followed by its bytes, a length
+// of -1 if in is nil.
+func (e *ByteEncoder) PutVarintBytes(in []byte) error {
+	if in == nil {
+		e.PutVarint(-1)
+		return nil
+	}
+	e.PutVarint(int64(len(in)))
+	copy(e.b[e.off:], in)
+	e.off += len(in)
+	return nil
+}
+
 func (e *ByteEncoder) PutStringArray(in []string) error {
 	err := e.PutArrayLength(len(in))
 	if err != nil {
@@ -256,6 +372,18 @@ func (e *ByteEncoder) PutInt64Array(in []int64) error {
 	return nil
 }
 
+// PutFileRegions puts the regions as bytes, reading them from their files.
+func (e *ByteEncoder) PutFileRegions(in []FileRegion) error {
+	e.PutInt32(int32(fileRegionsLength(in)))
+	for _, r := range in {
+		if _, err := r.File.ReadAt(e.b[e.off:e.off+int(r.Length)], r.Offset); err != nil {
+			return err
+		}
+		e.off += int(r.Length)
+	}
+	return nil
+}
+
 func (e *ByteEncoder) Push(pe PushEncoder) {
 	pe.SaveOffset(e.off)
 	e.off += pe.ReserveSize()
@@ -268,3 +396,42 @@ func (e *ByteEncoder) Pop() {
 	e.stack = e.stack[:len(e.stack)-1]
 	pe.Fill(e.off, e.b)
 }
+
+// regionEncoder encodes like ByteEncoder except file regions are left out of
+// the buffer, their offsets are recorded so EncodeTo can write them in
+// between. Since the buffer is missing the regions' bytes they can't be in a
+// field that needs them, like a CRC, only in a size field.
+type regionEncoder struct {
+	*ByteEncoder
+	regions []regionsAt
+	// skipped is how many bytes of regions have been left out so far,
+	// skippedStack is what it was when each push encoder was pushed.
+	skipped      int
+	skippedStack []int
+}
+
+type regionsAt struct {
+	off     int
+	regions []FileRegion
+}
+
+func (e *regionEncoder) PutFileRegions(in []FileRegion) error {
+	e.PutInt32(int32(fileRegionsLength(in)))
+	e.regions = append(e.regions, regionsAt{off: e.off, regions: in})
+	e.skipped += int(fileRegionsLength(in))
+	return nil
+}
+
+func (e *regionEncoder) Push(pe PushEncoder) {
+	e.ByteEncoder.Push(pe)
+	e.skippedStack = append(e.skippedStack, e.skipped)
+}
+
+func (e *regionEncoder) Pop() {
+	pe := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	skipped := e.skippedStack[len(e.skippedStack)-1]
+	e.skippedStack = e.skippedStack[:len(e.skippedStack)-1]
+	// the field covers the regions left out since it was pushed
+	pe.Fill(e.off+e.skipped-skipped, e.b)
+}
@@ -60,6 +60,7 @@ var (
 	ErrTransactionalIdAuthorizationFailed = Error{code: 53, msg: "transactional id authorization failed"}
 	ErrSecurityDisabled                   = Error{code: 54, msg: "security disabled"}
 	ErrOperationNotAttempted              = Error{code: 55, msg: "operation not attempted"}
+	ErrKafkaStorageError                  = Error{code: 56, msg: "kafka storage error"}
 
 	// Errs maps err codes to their errs.
 	Errs = map[int16]Error{
@@ -120,6 +121,7 @@ var (
 		53: ErrTransactionalIdAuthorizationFailed,
 		54: ErrSecurityDisabled,
 		55: ErrOperationNotAttempted,
+		56: ErrKafkaStorageError,
 	}
 )
 
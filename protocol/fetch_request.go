@@ -12,11 +12,16 @@ type FetchTopic struct {
 }
 
 type FetchRequest struct {
-	ReplicaID   int32
-	MaxWaitTime int32
-	MinBytes    int32
-	// MaxBytes    int32
-	Topics []*FetchTopic
+	// APIVersion is the version the request's encoded with. MaxBytes is
+	// from version 3 and IsolationLevel from 4, as are record batches in
+	// the response. The response has the throttle time from version 1.
+	APIVersion     int16
+	ReplicaID      int32
+	MaxWaitTime    int32
+	MinBytes       int32
+	MaxBytes       int32
+	IsolationLevel int8
+	Topics         []*FetchTopic
 }
 
 func (r *FetchRequest) Encode(e PacketEncoder) error {
@@ -27,7 +32,12 @@ func (r *FetchRequest) Encode(e PacketEncoder) error {
 	}
 	e.PutInt32(r.MaxWaitTime)
 	e.PutInt32(r.MinBytes)
-	// e.PutInt32(r.MaxBytes)
+	if r.APIVersion >= 3 {
+		e.PutInt32(r.MaxBytes)
+	}
+	if r.APIVersion >= 4 {
+		e.PutInt8(r.IsolationLevel)
+	}
 	e.PutArrayLength(len(r.Topics))
 	for _, t := range r.Topics {
 		e.PutString(t.Topic)
@@ -55,10 +65,18 @@ func (r *FetchRequest) Decode(d PacketDecoder) error {
 	if err != nil {
 		return err
 	}
-	// r.MaxBytes, err = d.Int32()
-	// if err != nil {
-	// 	return err
-	// }
+	if r.APIVersion >= 3 {
+		r.MaxBytes, err = d.Int32()
+		if err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 4 {
+		r.IsolationLevel, err = d.Int8()
+		if err != nil {
+			return err
+		}
+	}
 	topicCount, err := d.ArrayLength()
 	if err != nil {
 		return err
@@ -103,5 +121,13 @@ func (r *FetchRequest) Key() int16 {
 }
 
 func (r *FetchRequest) Version() int16 {
-	return 1
+	return r.APIVersion
+}
+
+func (r *FetchRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *FetchRequest) MaxVersion() int16 {
+	return 4
 }
@@ -4,7 +4,18 @@ type FetchPartitionResponse struct {
 	Partition     int32
 	ErrorCode     int16
 	HighWatermark int64
-	RecordSet     []byte
+	// LastStableOffset and AbortedTransactions are from version 4.
+	LastStableOffset    int64
+	AbortedTransactions []*AbortedTransaction
+	RecordSet           []byte
+	// RecordSetRegions is used in place of RecordSet to send the record set
+	// from the log's segment files without copying it.
+	RecordSetRegions []FileRegion
+}
+
+type AbortedTransaction struct {
+	ProducerID  int64
+	FirstOffset int64
 }
 
 type FetchResponse struct {
@@ -13,27 +24,46 @@ type FetchResponse struct {
 }
 
 type FetchResponses struct {
+	// APIVersion is the version of the request the response is for.
+	APIVersion     int16
 	ThrottleTimeMs int32
 	Responses      []*FetchResponse
 }
 
 func (r *FetchResponses) Encode(e PacketEncoder) (err error) {
-	e.PutInt32(r.ThrottleTimeMs)
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.ThrottleTimeMs)
+	}
 	if err = e.PutArrayLength(len(r.Responses)); err != nil {
 		return err
 	}
-	for _, r := range r.Responses {
-		if err = e.PutString(r.Topic); err != nil {
+	for _, resp := range r.Responses {
+		if err = e.PutString(resp.Topic); err != nil {
 			return err
 		}
-		if err = e.PutArrayLength(len(r.PartitionResponses)); err != nil {
+		if err = e.PutArrayLength(len(resp.PartitionResponses)); err != nil {
 			return err
 		}
-		for _, p := range r.PartitionResponses {
+		for _, p := range resp.PartitionResponses {
 			e.PutInt32(p.Partition)
 			e.PutInt16(p.ErrorCode)
 			e.PutInt64(p.HighWatermark)
-			if err = e.PutBytes(p.RecordSet); err != nil {
+			if r.APIVersion >= 4 {
+				e.PutInt64(p.LastStableOffset)
+				if err = e.PutArrayLength(len(p.AbortedTransactions)); err != nil {
+					return err
+				}
+				for _, t := range p.AbortedTransactions {
+					e.PutInt64(t.ProducerID)
+					e.PutInt64(t.FirstOffset)
+				}
+			}
+			if p.RecordSetRegions != nil {
+				err = e.PutFileRegions(p.RecordSetRegions)
+			} else {
+				err = e.PutBytes(p.RecordSet)
+			}
+			if err != nil {
 				return err
 			}
 		}
@@ -43,11 +73,16 @@ func (r *FetchResponses) Encode(e PacketEncoder) (err error) {
 
 func (r *FetchResponses) Decode(d PacketDecoder) error {
 	var err error
-	r.ThrottleTimeMs, err = d.Int32()
+	if r.APIVersion >= 1 {
+		r.ThrottleTimeMs, err = d.Int32()
+		if err != nil {
+			return err
+		}
+	}
+	responseCount, err := d.ArrayLength()
 	if err != nil {
 		return err
 	}
-	responseCount, err := d.ArrayLength()
 	r.Responses = make([]*FetchResponse, responseCount)
 
 	for i := range r.Responses {
@@ -57,6 +92,9 @@ func (r *FetchResponses) Decode(d PacketDecoder) error {
 			return err
 		}
 		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
 		ps := make([]*FetchPartitionResponse, partitionCount)
 		for j := range ps {
 			p := &FetchPartitionResponse{}
@@ -72,6 +110,26 @@ func (r *FetchResponses) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
+			if r.APIVersion >= 4 {
+				p.LastStableOffset, err = d.Int64()
+				if err != nil {
+					return err
+				}
+				n, err := d.ArrayLength()
+				if err != nil {
+					return err
+				}
+				for k := 0; k < n; k++ {
+					t := new(AbortedTransaction)
+					if t.ProducerID, err = d.Int64(); err != nil {
+						return err
+					}
+					if t.FirstOffset, err = d.Int64(); err != nil {
+						return err
+					}
+					p.AbortedTransactions = append(p.AbortedTransactions, t)
+				}
+			}
 			p.RecordSet, err = d.Bytes()
 			if err != nil {
 				return err
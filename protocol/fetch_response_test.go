@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchResponseFileRegions(t *testing.T) {
+	req := require.New(t)
+	f, err := ioutil.TempFile("", "fetchresponse")
+	req.NoError(err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	_, err = f.Write([]byte("xxonetwoxxthree"))
+	req.NoError(err)
+
+	exp := &Response{CorrelationID: 1, Body: &FetchResponses{Responses: []*FetchResponse{{
+		Topic: "test",
+		PartitionResponses: []*FetchPartitionResponse{{
+			Partition:     0,
+			HighWatermark: 3,
+			RecordSet:     []byte("onetwothree"),
+		}},
+	}}}}
+	b, err := Encode(exp)
+	req.NoError(err)
+
+	resp := &Response{CorrelationID: 1, Body: &FetchResponses{Responses: []*FetchResponse{{
+		Topic: "test",
+		PartitionResponses: []*FetchPartitionResponse{{
+			Partition:     0,
+			HighWatermark: 3,
+			RecordSetRegions: []FileRegion{
+				{File: f, Offset: 2, Length: 6},
+				{File: f, Offset: 10, Length: 5},
+			},
+		}},
+	}}}}
+
+	// the regions are read from the file when encoding to bytes
+	act, err := Encode(resp)
+	req.NoError(err)
+	req.Equal(b, act)
+
+	// and written from it when encoding to a writer
+	buf := new(bytes.Buffer)
+	req.NoError(EncodeTo(buf, resp))
+	req.Equal(b, buf.Bytes())
+
+	// including to a connection
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	defer ln.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		EncodeTo(conn, resp)
+	}()
+	conn, err := ln.Accept()
+	req.NoError(err)
+	defer conn.Close()
+	act, err = ioutil.ReadAll(conn)
+	req.NoError(err)
+	req.Equal(b, act)
+
+	// a region that's been truncated since it was read is an error rather
+	// than a short response
+	req.NoError(f.Truncate(12))
+	req.Equal(ErrShortFileRegion, EncodeTo(new(bytes.Buffer), resp))
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		errCh <- EncodeTo(conn, resp)
+	}()
+	conn, err = ln.Accept()
+	req.NoError(err)
+	defer conn.Close()
+	req.Equal(ErrShortFileRegion, <-errCh)
+}
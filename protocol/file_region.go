@@ -0,0 +1,38 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// ErrShortFileRegion is returned writing a file region whose file ends before
+// the region does, like when its segment's been truncated since the region
+// was read.
+var ErrShortFileRegion = errors.New("kafka: file region is past the end of its file")
+
+// FileRegion is a region of a file, like the entries of a log segment. A
+// response holding file regions has them written to the connection straight
+// from the file rather than copied into the encoded response.
+type FileRegion struct {
+	File   *os.File
+	Offset int64
+	Length int64
+}
+
+// copyTo copies the region to w with positional reads, so the file can be
+// shared with other readers.
+func (r FileRegion) copyTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, io.NewSectionReader(r.File, r.Offset, r.Length))
+	if err == nil && n < r.Length {
+		err = ErrShortFileRegion
+	}
+	return n, err
+}
+
+func fileRegionsLength(in []FileRegion) (n int64) {
+	for _, r := range in {
+		n += r.Length
+	}
+	return n
+}
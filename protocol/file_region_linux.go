@@ -0,0 +1,56 @@
+// +build linux
+
+package protocol
+
+import (
+	"io"
+	"syscall"
+)
+
+// maxSendfileSize is the most sendfile is asked to write in one call.
+const maxSendfileSize = 1 << 30
+
+// WriteTo writes the region to w. If w is a connection the region is written
+// with sendfile, which copies it from the page cache to the socket in the
+// kernel. It doesn't use the file's offset so the file can be shared with
+// other readers. It returns ErrShortFileRegion if the file ends before the
+// region does.
+func (r FileRegion) WriteTo(w io.Writer) (int64, error) {
+	sc, ok := w.(syscall.Conn)
+	if !ok {
+		return r.copyTo(w)
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return r.copyTo(w)
+	}
+	offset := r.Offset
+	end := r.Offset + r.Length
+	var serr error
+	err = rc.Write(func(fd uintptr) bool {
+		for offset < end {
+			size := end - offset
+			if size > maxSendfileSize {
+				size = maxSendfileSize
+			}
+			n, err := syscall.Sendfile(int(fd), int(r.File.Fd()), &offset, int(size))
+			if err == syscall.EAGAIN {
+				// wait for the socket to be writable
+				return false
+			}
+			if err != nil {
+				serr = err
+				return true
+			}
+			if n == 0 {
+				serr = ErrShortFileRegion
+				return true
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = serr
+	}
+	return offset - r.Offset, err
+}
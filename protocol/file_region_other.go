@@ -0,0 +1,11 @@
+// +build !linux
+
+package protocol
+
+import "io"
+
+// WriteTo writes the region to w. It returns ErrShortFileRegion if the file
+// ends before the region does.
+func (r FileRegion) WriteTo(w io.Writer) (int64, error) {
+	return r.copyTo(w)
+}
@@ -0,0 +1,28 @@
+// +build gofuzz
+
+package protocol
+
+// Fuzz is the entry point for go-fuzz, its corpus is in testdata/fuzz/corpus:
+//
+//	go-fuzz-build github.com/travisjeffery/jocko/protocol
+//	go-fuzz -bin protocol-fuzz.zip -workdir testdata/fuzz
+//
+// It decodes data as a request, and a produce request's record sets as the
+// message sets and record batches they hold.
+func Fuzz(data []byte) int {
+	// decoding fills in CRCs and sizes, data mustn't be changed
+	data = append([]byte(nil), data...)
+	_, body, err := DecodeRequest(data)
+	if err != nil || body == nil {
+		return 0
+	}
+	if req, ok := body.(*ProduceRequest); ok {
+		for _, td := range req.TopicData {
+			for _, d := range td.Data {
+				Decode(d.RecordSet, new(MessageSet))
+				Decode(d.RecordSet, new(RecordBatch))
+			}
+		}
+	}
+	return 1
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestFuzzCorpus decodes the fuzz corpus, and every truncation and single
+// byte change of it, as the broker does, checking decoding never panics.
+func TestFuzzCorpus(t *testing.T) {
+	paths, err := filepath.Glob("testdata/fuzz/corpus/*")
+	require.NoError(t, err)
+	require.NotEmpty(t, paths)
+
+	decode := func(b []byte) {
+		b = append([]byte(nil), b...)
+		_, body, err := DecodeRequest(b)
+		if err != nil {
+			return
+		}
+		if req, ok := body.(*ProduceRequest); ok {
+			for _, td := range req.TopicData {
+				for _, d := range td.Data {
+					Decode(d.RecordSet, new(MessageSet))
+					Decode(d.RecordSet, new(RecordBatch))
+				}
+			}
+		}
+	}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		for i := 0; i <= len(b); i++ {
+			require.NotPanics(t, func() { decode(b[:i]) }, "%s truncated to %d", path, i)
+		}
+		for i := range b {
+			for _, c := range []byte{0x00, 0x01, 0x7f, 0x80, 0xff} {
+				changed := append([]byte(nil), b...)
+				changed[i] = c
+				require.NotPanics(t, func() { decode(changed) }, "%s with %#x at %d", path, c, i)
+			}
+		}
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	req := require.New(t)
+	exp := &MetadataRequest{APIVersion: 1, Topics: []string{"a"}}
+	b, err := Encode(&Request{CorrelationID: 1, ClientID: "test", Body: exp})
+	req.NoError(err)
+	header, body, err := DecodeRequest(b)
+	req.NoError(err)
+	req.Equal(int16(MetadataKey), header.APIKey)
+	req.Equal(int16(1), header.APIVersion)
+	req.Equal(int32(1), header.CorrelationID)
+	req.Equal(exp, body)
+
+	// the body of an unsupported version isn't decoded
+	b, err = Encode(&Request{CorrelationID: 1, Body: &MetadataRequest{APIVersion: 9, Topics: []string{"a"}}})
+	req.NoError(err)
+	_, body, err = DecodeRequest(b)
+	req.NoError(err)
+	req.Equal(&MetadataRequest{APIVersion: 9}, body)
+
+	// nor is an unknown API key's
+	b[5] = 99
+	header, body, err = DecodeRequest(b)
+	req.NoError(err)
+	req.Equal(int16(99), header.APIKey)
+	req.Nil(body)
+
+	_, _, err = DecodeRequest(b[:6])
+	req.Equal(ErrInsufficientData, err)
+}
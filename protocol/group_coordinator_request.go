@@ -17,6 +17,14 @@ func (r *GroupCoordinatorRequest) Version() int16 {
 	return 0
 }
 
+func (r *GroupCoordinatorRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *GroupCoordinatorRequest) MaxVersion() int16 {
+	return 0
+}
+
 func (r *GroupCoordinatorRequest) Key() int16 {
 	return GroupCoordinatorKey
 }
@@ -6,7 +6,7 @@ type HeartbeatRequest struct {
 	MemberID          string
 }
 
-func (r *HeartbeatRequest) encode(e PacketEncoder) error {
+func (r *HeartbeatRequest) Encode(e PacketEncoder) error {
 	if err := e.PutString(r.GroupID); err != nil {
 		return err
 	}
@@ -37,3 +37,11 @@ func (r *HeartbeatRequest) Key() int16 {
 func (r *HeartbeatRequest) Version() int16 {
 	return 0
 }
+
+func (r *HeartbeatRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *HeartbeatRequest) MaxVersion() int16 {
+	return 0
+}
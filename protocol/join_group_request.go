@@ -74,3 +74,11 @@ func (r *JoinGroupRequest) Key() int16 {
 func (r *JoinGroupRequest) Version() int16 {
 	return 0
 }
+
+func (r *JoinGroupRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *JoinGroupRequest) MaxVersion() int16 {
+	return 0
+}
@@ -86,6 +86,9 @@ func (r *LeaderAndISRRequest) Decode(d PacketDecoder) error {
 		r.PartitionStates[i] = ps
 	}
 	leaderCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
 	r.LiveLeaders = make([]*LiveLeader, leaderCount)
 	for i := range r.LiveLeaders {
 		ll := new(LiveLeader)
@@ -110,3 +113,11 @@ func (r *LeaderAndISRRequest) Key() int16 {
 func (r *LeaderAndISRRequest) Version() int16 {
 	return 0
 }
+
+func (r *LeaderAndISRRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *LeaderAndISRRequest) MaxVersion() int16 {
+	return 0
+}
@@ -27,3 +27,11 @@ func (r *LeaveGroupRequest) Key() int16 {
 func (r *LeaveGroupRequest) Version() int16 {
 	return 0
 }
+
+func (r *LeaveGroupRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *LeaveGroupRequest) MaxVersion() int16 {
+	return 0
+}
@@ -18,3 +18,11 @@ func (r *ListGroupsRequest) Key() int16 {
 func (r *ListGroupsRequest) Version() int16 {
 	return 0
 }
+
+func (r *ListGroupsRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *ListGroupsRequest) MaxVersion() int16 {
+	return 0
+}
@@ -7,19 +7,40 @@ type Message struct {
 	Key       []byte
 	Value     []byte
 	MagicByte int8
+	// Codec is the codec the message's value is compressed with. A
+	// compressed message wraps the messages in Set, its value is their
+	// entries compressed.
+	Codec CompressionCodec
+	Set   []*MessageSet
+
+	// compressed caches the compressed value between encoding's passes.
+	compressed []byte
 }
 
 func (m *Message) Encode(e PacketEncoder) error {
 	e.Push(&CRCField{})
 	e.PutInt8(m.MagicByte)
-	e.PutInt8(0) // attributes
+	e.PutInt8(int8(m.Codec) & compressionCodecMask) // attributes
 	if m.MagicByte > 0 {
 		e.PutInt64(m.Timestamp.UnixNano() / int64(time.Millisecond))
 	}
 	if err := e.PutBytes(m.Key); err != nil {
 		return err
 	}
-	if err := e.PutBytes(m.Value); err != nil {
+	value := m.Value
+	if m.Codec != CompressionNone && m.Set != nil {
+		if m.compressed == nil {
+			raw, err := Encode(messageSets(m.Set))
+			if err != nil {
+				return err
+			}
+			if m.compressed, err = Compress(m.Codec, raw); err != nil {
+				return err
+			}
+		}
+		value = m.compressed
+	}
+	if err := e.PutBytes(value); err != nil {
 		return err
 	}
 	e.Pop()
@@ -27,6 +48,27 @@ func (m *Message) Encode(e PacketEncoder) error {
 }
 
 func (m *Message) Decode(d PacketDecoder) error {
+	if err := m.decodeFields(d); err != nil {
+		return err
+	}
+	if m.Codec == CompressionNone {
+		return nil
+	}
+	raw, err := Decompress(m.Codec, m.Value)
+	if err != nil {
+		return err
+	}
+	var set messageSets
+	if err = Decode(raw, &set); err != nil {
+		return err
+	}
+	m.Set = set
+	m.compressed = m.Value
+	return nil
+}
+
+// decodeFields decodes the message's fields, without decompressing its value.
+func (m *Message) decodeFields(d PacketDecoder) error {
 	var err error
 	if err = d.Push(&CRCField{}); err != nil {
 		return err
@@ -34,9 +76,11 @@ func (m *Message) Decode(d PacketDecoder) error {
 	if m.MagicByte, err = d.Int8(); err != nil {
 		return err
 	}
-	if _, err := d.Int8(); err != nil {
+	attributes, err := d.Int8()
+	if err != nil {
 		return err
 	}
+	m.Codec = CompressionCodec(attributes & compressionCodecMask)
 	if m.MagicByte > 0 {
 		t, err := d.Int64()
 		if err != nil {
@@ -52,3 +96,55 @@ func (m *Message) Decode(d PacketDecoder) error {
 	}
 	return d.Pop()
 }
+
+// messageSets are the entries wrapped by a compressed message, each with one
+// message.
+type messageSets []*MessageSet
+
+func (s messageSets) Encode(e PacketEncoder) error {
+	for _, ms := range s {
+		if err := ms.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *messageSets) Decode(d PacketDecoder) error {
+	for d.remaining() > 0 {
+		offset, err := d.Int64()
+		if err != nil {
+			return err
+		}
+		size, err := d.Int32()
+		if err != nil {
+			return err
+		}
+		b, err := d.RawBytes(int(size))
+		if err != nil {
+			return err
+		}
+		m := new(Message)
+		if err = Decode(b, wrappedMessage{m}); err != nil {
+			return err
+		}
+		*s = append(*s, &MessageSet{Offset: offset, Size: size, Messages: []*Message{m}})
+	}
+	return nil
+}
+
+// wrappedMessage decodes a message wrapped by a compressed message, which
+// can't be compressed itself.
+type wrappedMessage struct {
+	*Message
+}
+
+func (m wrappedMessage) Decode(d PacketDecoder) error {
+	if err := m.decodeFields(d); err != nil {
+		return err
+	}
+	if m.Codec != CompressionNone {
+		return ErrNestedCompression
+	}
+	return nil
+}
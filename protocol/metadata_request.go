@@ -1,15 +1,53 @@
 package protocol
 
 type MetadataRequest struct {
-	Topics []string
+	// APIVersion is the version the request's encoded with. From version 1
+	// nil topics means all topics and empty topics none, in version 0 empty
+	// topics means all of them. Version 1's response has the brokers' racks,
+	// the controller, and whether topics are internal.
+	APIVersion int16
+	Topics     []string
+}
+
+// AllTopics returns whether the request's for the metadata of all topics.
+func (r *MetadataRequest) AllTopics() bool {
+	if r.APIVersion == 0 {
+		return len(r.Topics) == 0
+	}
+	return r.Topics == nil
 }
 
 func (r *MetadataRequest) Encode(e PacketEncoder) error {
-	e.PutStringArray(r.Topics)
-	return nil
+	if r.APIVersion >= 1 && r.Topics == nil {
+		e.PutInt32(-1)
+		return nil
+	}
+	return e.PutStringArray(r.Topics)
 }
 
 func (r *MetadataRequest) Decode(d PacketDecoder) (err error) {
+	if r.APIVersion >= 1 {
+		n, err := d.Int32()
+		if err != nil {
+			return err
+		}
+		if n == -1 {
+			r.Topics = nil
+			return nil
+		}
+		if n < 0 || int(n) > d.remaining() {
+			return ErrInvalidArrayLength
+		}
+		r.Topics = make([]string, 0, n)
+		for i := int32(0); i < n; i++ {
+			topic, err := d.String()
+			if err != nil {
+				return err
+			}
+			r.Topics = append(r.Topics, topic)
+		}
+		return nil
+	}
 	r.Topics, err = d.StringArray()
 	return err
 }
@@ -19,5 +57,13 @@ func (r *MetadataRequest) Key() int16 {
 }
 
 func (r *MetadataRequest) Version() int16 {
+	return r.APIVersion
+}
+
+func (r *MetadataRequest) MinVersion() int16 {
 	return 0
 }
+
+func (r *MetadataRequest) MaxVersion() int16 {
+	return 1
+}
@@ -4,7 +4,8 @@ type Broker struct {
 	NodeID int32
 	Host   string
 	Port   int32
-	// unsupported: Rack *string
+	// Rack is from version 1.
+	Rack *string
 }
 
 type PartitionMetadata struct {
@@ -16,15 +17,20 @@ type PartitionMetadata struct {
 }
 
 type TopicMetadata struct {
-	TopicErrorCode    int16
-	Topic             string
+	TopicErrorCode int16
+	Topic          string
+	// IsInternal is from version 1.
+	IsInternal        bool
 	PartitionMetadata []*PartitionMetadata
 }
 
 type MetadataResponse struct {
-	Brokers []*Broker
+	// APIVersion is the version of the request the response is for.
+	APIVersion int16
+	Brokers    []*Broker
 	// unsupported: ClusterID *string
-	// unsupported: ControllerID string
+	// ControllerID is from version 1, it's -1 if there's no controller.
+	ControllerID  int32
 	TopicMetadata []*TopicMetadata
 }
 
@@ -38,6 +44,14 @@ func (r *MetadataResponse) Encode(e PacketEncoder) (err error) {
 			return err
 		}
 		e.PutInt32(b.Port)
+		if r.APIVersion >= 1 {
+			if err = e.PutNullableString(b.Rack); err != nil {
+				return err
+			}
+		}
+	}
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.ControllerID)
 	}
 	if err = e.PutArrayLength(len(r.TopicMetadata)); err != nil {
 		return err
@@ -47,6 +61,9 @@ func (r *MetadataResponse) Encode(e PacketEncoder) (err error) {
 		if err = e.PutString(t.Topic); err != nil {
 			return err
 		}
+		if r.APIVersion >= 1 {
+			e.PutBool(t.IsInternal)
+		}
 		if err = e.PutArrayLength(len(t.PartitionMetadata)); err != nil {
 			return err
 		}
@@ -67,6 +84,9 @@ func (r *MetadataResponse) Encode(e PacketEncoder) (err error) {
 
 func (r *MetadataResponse) Decode(d PacketDecoder) error {
 	brokerCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
 	r.Brokers = make([]*Broker, brokerCount)
 	for i := range r.Brokers {
 		nodeID, err := d.Int32()
@@ -81,13 +101,28 @@ func (r *MetadataResponse) Decode(d PacketDecoder) error {
 		if err != nil {
 			return err
 		}
+		var rack *string
+		if r.APIVersion >= 1 {
+			if rack, err = d.NullableString(); err != nil {
+				return err
+			}
+		}
 		r.Brokers[i] = &Broker{
 			NodeID: nodeID,
 			Host:   host,
 			Port:   port,
+			Rack:   rack,
+		}
+	}
+	if r.APIVersion >= 1 {
+		if r.ControllerID, err = d.Int32(); err != nil {
+			return err
 		}
 	}
 	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
 	r.TopicMetadata = make([]*TopicMetadata, topicCount)
 	for i := range r.TopicMetadata {
 		m := &TopicMetadata{}
@@ -99,6 +134,12 @@ func (r *MetadataResponse) Decode(d PacketDecoder) error {
 		if err != nil {
 			return err
 		}
+		if r.APIVersion >= 1 {
+			m.IsInternal, err = d.Bool()
+			if err != nil {
+				return err
+			}
+		}
 		partitionCount, err := d.ArrayLength()
 		if err != nil {
 			return err
@@ -123,6 +164,9 @@ func (r *MetadataResponse) Decode(d PacketDecoder) error {
 				return err
 			}
 			p.ISR, err = d.Int32Array()
+			if err != nil {
+				return err
+			}
 			partitions[i] = p
 		}
 		m.PartitionMetadata = partitions
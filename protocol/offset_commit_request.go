@@ -0,0 +1,138 @@
+package protocol
+
+type OffsetCommitPartition struct {
+	Partition int32
+	Offset    int64
+	// Timestamp is only in version 1, -1 means the time the commit's
+	// received.
+	Timestamp int64
+	Metadata  *string
+}
+
+type OffsetCommitTopic struct {
+	Topic      string
+	Partitions []*OffsetCommitPartition
+}
+
+type OffsetCommitRequest struct {
+	// APIVersion is the version the request's encoded with. Version 1 adds
+	// the generation, member, and partitions' timestamps, version 2 drops
+	// the timestamps for the retention time.
+	APIVersion   int16
+	GroupID      string
+	GenerationID int32
+	MemberID     string
+	// RetentionTime is in ms, -1 means the broker's default.
+	RetentionTime int64
+	Topics        []*OffsetCommitTopic
+}
+
+func (r *OffsetCommitRequest) Encode(e PacketEncoder) error {
+	if err := e.PutString(r.GroupID); err != nil {
+		return err
+	}
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.GenerationID)
+		if err := e.PutString(r.MemberID); err != nil {
+			return err
+		}
+	}
+	if r.APIVersion >= 2 {
+		e.PutInt64(r.RetentionTime)
+	}
+	if err := e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err := e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err := e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt64(p.Offset)
+			if r.APIVersion == 1 {
+				e.PutInt64(p.Timestamp)
+			}
+			if err := e.PutNullableString(p.Metadata); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *OffsetCommitRequest) Decode(d PacketDecoder) error {
+	var err error
+	if r.GroupID, err = d.String(); err != nil {
+		return err
+	}
+	if r.APIVersion >= 1 {
+		if r.GenerationID, err = d.Int32(); err != nil {
+			return err
+		}
+		if r.MemberID, err = d.String(); err != nil {
+			return err
+		}
+	}
+	r.RetentionTime = -1
+	if r.APIVersion >= 2 {
+		if r.RetentionTime, err = d.Int64(); err != nil {
+			return err
+		}
+	}
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Topics = make([]*OffsetCommitTopic, topicCount)
+	for i := range r.Topics {
+		t := new(OffsetCommitTopic)
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*OffsetCommitPartition, partitionCount)
+		for j := range t.Partitions {
+			p := &OffsetCommitPartition{Timestamp: -1}
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.Offset, err = d.Int64(); err != nil {
+				return err
+			}
+			if r.APIVersion == 1 {
+				if p.Timestamp, err = d.Int64(); err != nil {
+					return err
+				}
+			}
+			if p.Metadata, err = d.NullableString(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		r.Topics[i] = t
+	}
+	return nil
+}
+
+func (r *OffsetCommitRequest) Key() int16 {
+	return OffsetCommitKey
+}
+
+func (r *OffsetCommitRequest) Version() int16 {
+	return r.APIVersion
+}
+
+func (r *OffsetCommitRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *OffsetCommitRequest) MaxVersion() int16 {
+	return 2
+}
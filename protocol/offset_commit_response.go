@@ -0,0 +1,67 @@
+package protocol
+
+type OffsetCommitPartitionResponse struct {
+	Partition int32
+	ErrorCode int16
+}
+
+type OffsetCommitTopicResponse struct {
+	Topic      string
+	Partitions []*OffsetCommitPartitionResponse
+}
+
+type OffsetCommitResponse struct {
+	// APIVersion is the version of the request the response is for.
+	APIVersion int16
+	Responses  []*OffsetCommitTopicResponse
+}
+
+func (r *OffsetCommitResponse) Encode(e PacketEncoder) error {
+	if err := e.PutArrayLength(len(r.Responses)); err != nil {
+		return err
+	}
+	for _, t := range r.Responses {
+		if err := e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err := e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt16(p.ErrorCode)
+		}
+	}
+	return nil
+}
+
+func (r *OffsetCommitResponse) Decode(d PacketDecoder) error {
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Responses = make([]*OffsetCommitTopicResponse, topicCount)
+	for i := range r.Responses {
+		t := new(OffsetCommitTopicResponse)
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*OffsetCommitPartitionResponse, partitionCount)
+		for j := range t.Partitions {
+			p := new(OffsetCommitPartitionResponse)
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		r.Responses[i] = t
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package protocol
+
+type OffsetFetchTopic struct {
+	Topic      string
+	Partitions []int32
+}
+
+type OffsetFetchRequest struct {
+	// APIVersion is the version the request's encoded with. Versions 0 and
+	// 1 are the same, from version 2 nil topics means all the group's
+	// offsets and the response has an error code.
+	APIVersion int16
+	GroupID    string
+	Topics     []*OffsetFetchTopic
+}
+
+// AllTopics returns whether the request's for all the group's offsets.
+func (r *OffsetFetchRequest) AllTopics() bool {
+	return r.APIVersion >= 2 && r.Topics == nil
+}
+
+func (r *OffsetFetchRequest) Encode(e PacketEncoder) error {
+	if err := e.PutString(r.GroupID); err != nil {
+		return err
+	}
+	if r.AllTopics() {
+		e.PutInt32(-1)
+		return nil
+	}
+	if err := e.PutArrayLength(len(r.Topics)); err != nil {
+		return err
+	}
+	for _, t := range r.Topics {
+		if err := e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err := e.PutInt32Array(t.Partitions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *OffsetFetchRequest) Decode(d PacketDecoder) error {
+	var err error
+	if r.GroupID, err = d.String(); err != nil {
+		return err
+	}
+	n, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	if n == -1 && r.APIVersion >= 2 {
+		r.Topics = nil
+		return nil
+	}
+	if n < 0 || int(n) > d.remaining() {
+		return ErrInvalidArrayLength
+	}
+	r.Topics = make([]*OffsetFetchTopic, n)
+	for i := range r.Topics {
+		t := new(OffsetFetchTopic)
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		if t.Partitions, err = d.Int32Array(); err != nil {
+			return err
+		}
+		r.Topics[i] = t
+	}
+	return nil
+}
+
+func (r *OffsetFetchRequest) Key() int16 {
+	return OffsetFetchKey
+}
+
+func (r *OffsetFetchRequest) Version() int16 {
+	return r.APIVersion
+}
+
+func (r *OffsetFetchRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *OffsetFetchRequest) MaxVersion() int16 {
+	return 2
+}
@@ -0,0 +1,90 @@
+package protocol
+
+type OffsetFetchPartitionResponse struct {
+	Partition int32
+	// Offset is -1 if the group hasn't committed one for the partition.
+	Offset    int64
+	Metadata  *string
+	ErrorCode int16
+}
+
+type OffsetFetchTopicResponse struct {
+	Topic      string
+	Partitions []*OffsetFetchPartitionResponse
+}
+
+type OffsetFetchResponse struct {
+	// APIVersion is the version of the request the response is for.
+	APIVersion int16
+	Responses  []*OffsetFetchTopicResponse
+	// ErrorCode is from version 2.
+	ErrorCode int16
+}
+
+func (r *OffsetFetchResponse) Encode(e PacketEncoder) error {
+	if err := e.PutArrayLength(len(r.Responses)); err != nil {
+		return err
+	}
+	for _, t := range r.Responses {
+		if err := e.PutString(t.Topic); err != nil {
+			return err
+		}
+		if err := e.PutArrayLength(len(t.Partitions)); err != nil {
+			return err
+		}
+		for _, p := range t.Partitions {
+			e.PutInt32(p.Partition)
+			e.PutInt64(p.Offset)
+			if err := e.PutNullableString(p.Metadata); err != nil {
+				return err
+			}
+			e.PutInt16(p.ErrorCode)
+		}
+	}
+	if r.APIVersion >= 2 {
+		e.PutInt16(r.ErrorCode)
+	}
+	return nil
+}
+
+func (r *OffsetFetchResponse) Decode(d PacketDecoder) error {
+	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
+	r.Responses = make([]*OffsetFetchTopicResponse, topicCount)
+	for i := range r.Responses {
+		t := new(OffsetFetchTopicResponse)
+		if t.Topic, err = d.String(); err != nil {
+			return err
+		}
+		partitionCount, err := d.ArrayLength()
+		if err != nil {
+			return err
+		}
+		t.Partitions = make([]*OffsetFetchPartitionResponse, partitionCount)
+		for j := range t.Partitions {
+			p := new(OffsetFetchPartitionResponse)
+			if p.Partition, err = d.Int32(); err != nil {
+				return err
+			}
+			if p.Offset, err = d.Int64(); err != nil {
+				return err
+			}
+			if p.Metadata, err = d.NullableString(); err != nil {
+				return err
+			}
+			if p.ErrorCode, err = d.Int16(); err != nil {
+				return err
+			}
+			t.Partitions[j] = p
+		}
+		r.Responses[i] = t
+	}
+	if r.APIVersion >= 2 {
+		if r.ErrorCode, err = d.Int16(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,7 +2,9 @@ package protocol
 
 type OffsetsPartition struct {
 	Partition int32
-	Timestamp int64 // -1 to receive latest offset, -2 to receive earliest offset
+	Timestamp int64 // -1 to receive latest offset, -2 to receive earliest offset, otherwise the first offset at or after the timestamp in ms
+	// MaxNumOffsets is only in version 0.
+	MaxNumOffsets int32
 }
 
 type OffsetsTopic struct {
@@ -11,9 +13,12 @@ type OffsetsTopic struct {
 }
 
 type OffsetsRequest struct {
-	ReplicaID     int32
-	Topics        []*OffsetsTopic
-	MaxNumOffsets int32
+	// APIVersion is the version the request's encoded with. Version 1
+	// drops the max number of offsets, its response has a partition's
+	// timestamp and offset in place of its offsets.
+	APIVersion int16
+	ReplicaID  int32
+	Topics     []*OffsetsTopic
 }
 
 func (r *OffsetsRequest) Encode(e PacketEncoder) error {
@@ -35,9 +40,11 @@ func (r *OffsetsRequest) Encode(e PacketEncoder) error {
 		for _, p := range t.Partitions {
 			e.PutInt32(p.Partition)
 			e.PutInt64(p.Timestamp)
+			if r.APIVersion == 0 {
+				e.PutInt32(p.MaxNumOffsets)
+			}
 		}
 	}
-	e.PutInt32(r.MaxNumOffsets)
 	return nil
 }
 
@@ -73,12 +80,17 @@ func (r *OffsetsRequest) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
+			if r.APIVersion == 0 {
+				p.MaxNumOffsets, err = d.Int32()
+				if err != nil {
+					return err
+				}
+			}
 			ot.Partitions[j] = p
 		}
 		r.Topics[i] = ot
 	}
-	r.MaxNumOffsets, err = d.Int32()
-	return err
+	return nil
 }
 
 func (r *OffsetsRequest) Key() int16 {
@@ -86,5 +98,13 @@ func (r *OffsetsRequest) Key() int16 {
 }
 
 func (r *OffsetsRequest) Version() int16 {
+	return r.APIVersion
+}
+
+func (r *OffsetsRequest) MinVersion() int16 {
 	return 0
 }
+
+func (r *OffsetsRequest) MaxVersion() int16 {
+	return 1
+}
@@ -3,8 +3,11 @@ package protocol
 type PartitionResponse struct {
 	Partition int32
 	ErrorCode int16
-	// Timestamp int64
-	Offsets []int64
+	// Offsets is only in version 0, Timestamp and Offset replace it from
+	// version 1.
+	Offsets   []int64
+	Timestamp int64
+	Offset    int64
 }
 
 type OffsetResponse struct {
@@ -13,20 +16,25 @@ type OffsetResponse struct {
 }
 
 type OffsetsResponse struct {
-	Responses []*OffsetResponse
+	// APIVersion is the version of the request the response is for.
+	APIVersion int16
+	Responses  []*OffsetResponse
 }
 
 func (r *OffsetsResponse) Encode(e PacketEncoder) error {
 	e.PutArrayLength(len(r.Responses))
-	for _, r := range r.Responses {
-		e.PutString(r.Topic)
-		e.PutArrayLength(len(r.PartitionResponses))
-		for _, p := range r.PartitionResponses {
+	for _, resp := range r.Responses {
+		e.PutString(resp.Topic)
+		e.PutArrayLength(len(resp.PartitionResponses))
+		for _, p := range resp.PartitionResponses {
 			e.PutInt32(p.Partition)
 			e.PutInt16(p.ErrorCode)
-			// e.PutInt64(p.Timestamp)
-			e.PutInt64Array(p.Offsets)
-			// e.PutInt64(p.Offset)
+			if r.APIVersion == 0 {
+				e.PutInt64Array(p.Offsets)
+			} else {
+				e.PutInt64(p.Timestamp)
+				e.PutInt64(p.Offset)
+			}
 		}
 	}
 	return nil
@@ -61,23 +69,24 @@ func (r *OffsetsResponse) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
-			// v1:
-			// p.Timestamp, err = d.Int64()
-			// if err != nil {
-			// 	return err
-			// }
-			p.Offsets, err = d.Int64Array()
-			// v1:
-			// p.Offset, err = d.Int64()
-			if err != nil {
-				return err
+			if r.APIVersion == 0 {
+				p.Offsets, err = d.Int64Array()
+				if err != nil {
+					return err
+				}
+			} else {
+				p.Timestamp, err = d.Int64()
+				if err != nil {
+					return err
+				}
+				p.Offset, err = d.Int64()
+				if err != nil {
+					return err
+				}
 			}
 			ps[j] = p
 		}
 		resp.PartitionResponses = ps
 	}
-	if err != nil {
-		return err
-	}
 	return nil
 }
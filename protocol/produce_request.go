@@ -11,12 +11,23 @@ type TopicData struct {
 }
 
 type ProduceRequest struct {
-	Acks      int16
-	Timeout   int32
-	TopicData []*TopicData
+	// APIVersion is the version the request's encoded with. From version 3
+	// its record sets are record batches and it has a transactional ID, its
+	// response has the throttle time from version 1 and the log append
+	// time from 2.
+	APIVersion      int16
+	TransactionalID *string
+	Acks            int16
+	Timeout         int32
+	TopicData       []*TopicData
 }
 
 func (r *ProduceRequest) Encode(e PacketEncoder) (err error) {
+	if r.APIVersion >= 3 {
+		if err = e.PutNullableString(r.TransactionalID); err != nil {
+			return err
+		}
+	}
 	e.PutInt16(r.Acks)
 	e.PutInt32(r.Timeout)
 	if err = e.PutArrayLength(len(r.TopicData)); err != nil {
@@ -40,6 +51,12 @@ func (r *ProduceRequest) Encode(e PacketEncoder) (err error) {
 }
 
 func (r *ProduceRequest) Decode(d PacketDecoder) (err error) {
+	if r.APIVersion >= 3 {
+		r.TransactionalID, err = d.NullableString()
+		if err != nil {
+			return err
+		}
+	}
 	r.Acks, err = d.Int16()
 	if err != nil {
 		return err
@@ -49,6 +66,9 @@ func (r *ProduceRequest) Decode(d PacketDecoder) (err error) {
 		return err
 	}
 	topicCount, err := d.ArrayLength()
+	if err != nil {
+		return err
+	}
 	r.TopicData = make([]*TopicData, topicCount)
 	for i := range r.TopicData {
 		td := new(TopicData)
@@ -83,5 +103,13 @@ func (r *ProduceRequest) Key() int16 {
 }
 
 func (r *ProduceRequest) Version() int16 {
-	return 2
+	return r.APIVersion
+}
+
+func (r *ProduceRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *ProduceRequest) MaxVersion() int16 {
+	return 3
 }
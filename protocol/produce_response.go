@@ -4,7 +4,9 @@ type ProducePartitionResponse struct {
 	Partition  int32
 	ErrorCode  int16
 	BaseOffset int64
-	Timestamp  int64
+	// Timestamp is from version 2, it's the log append time in ms for
+	// topics with LogAppendTime timestamps, -1 for CreateTime.
+	Timestamp int64
 }
 
 type ProduceResponse struct {
@@ -13,23 +15,30 @@ type ProduceResponse struct {
 }
 
 type ProduceResponses struct {
-	Responses      []*ProduceResponse
+	// APIVersion is the version of the request the response is for.
+	APIVersion int16
+	Responses  []*ProduceResponse
+	// ThrottleTimeMs is from version 1.
 	ThrottleTimeMs int32
 }
 
 func (r *ProduceResponses) Encode(e PacketEncoder) error {
 	e.PutArrayLength(len(r.Responses))
-	for _, r := range r.Responses {
-		e.PutString(r.Topic)
-		e.PutArrayLength(len(r.PartitionResponses))
-		for _, p := range r.PartitionResponses {
+	for _, resp := range r.Responses {
+		e.PutString(resp.Topic)
+		e.PutArrayLength(len(resp.PartitionResponses))
+		for _, p := range resp.PartitionResponses {
 			e.PutInt32(p.Partition)
 			e.PutInt16(p.ErrorCode)
 			e.PutInt64(p.BaseOffset)
-			e.PutInt64(p.Timestamp)
+			if r.APIVersion >= 2 {
+				e.PutInt64(p.Timestamp)
+			}
 		}
 	}
-	e.PutInt32(r.ThrottleTimeMs)
+	if r.APIVersion >= 1 {
+		e.PutInt32(r.ThrottleTimeMs)
+	}
 	return nil
 }
 
@@ -68,20 +77,24 @@ func (r *ProduceResponses) Decode(d PacketDecoder) error {
 			if err != nil {
 				return err
 			}
-			p.Timestamp, err = d.Int64()
-			if err != nil {
-				return err
+			if r.APIVersion >= 2 {
+				p.Timestamp, err = d.Int64()
+				if err != nil {
+					return err
+				}
 			}
 		}
 		resp.PartitionResponses = ps
 	}
-	r.ThrottleTimeMs, err = d.Int32()
-	if err != nil {
-		return err
+	if r.APIVersion >= 1 {
+		r.ThrottleTimeMs, err = d.Int32()
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (r *ProduceResponses) Version() int16 {
-	return 2
+	return r.APIVersion
 }
@@ -0,0 +1,270 @@
+package protocol
+
+import "time"
+
+const (
+	// RecordBatchMagic is the magic byte of record batches, the v2 message
+	// format used from produce version 3 and fetch version 4.
+	RecordBatchMagic = 2
+
+	// recordBatchHeaderLen is the length of a batch after its length field
+	// up to its records count.
+	recordBatchHeaderLen = 45
+)
+
+// RecordBatch is a batch of records in the v2 message format. It replaces
+// the message set in record sets, a record set's entries can be a mix of
+// record batches and legacy message sets.
+type RecordBatch struct {
+	FirstOffset          int64
+	PartitionLeaderEpoch int32
+	// Attributes has the codec the records are compressed with in its low
+	// bits.
+	Attributes int16
+	// LastOffsetDelta is the offset of the batch's last record relative to
+	// FirstOffset.
+	LastOffsetDelta int32
+	FirstTimestamp  time.Time
+	MaxTimestamp    time.Time
+	ProducerID      int64
+	ProducerEpoch   int16
+	FirstSequence   int32
+	Records         []*Record
+
+	// compressed caches the compressed records between encoding's passes.
+	compressed []byte
+}
+
+// Codec returns the codec the batch's records are compressed with.
+func (b *RecordBatch) Codec() CompressionCodec {
+	return CompressionCodec(b.Attributes & compressionCodecMask)
+}
+
+// SetCodec sets the codec the batch's records are compressed with.
+func (b *RecordBatch) SetCodec(codec CompressionCodec) {
+	b.Attributes = b.Attributes&^compressionCodecMask | int16(codec)
+	b.compressed = nil
+}
+
+type Record struct {
+	Attributes int8
+	// TimestampDelta and OffsetDelta are relative to the batch's first
+	// timestamp and offset.
+	TimestampDelta time.Duration
+	OffsetDelta    int64
+	Key            []byte
+	Value          []byte
+	Headers        []*RecordHeader
+}
+
+type RecordHeader struct {
+	Key   string
+	Value []byte
+}
+
+func (b *RecordBatch) Encode(e PacketEncoder) error {
+	e.PutInt64(b.FirstOffset)
+	e.Push(&SizeField{})
+	e.PutInt32(b.PartitionLeaderEpoch)
+	e.PutInt8(RecordBatchMagic)
+	e.Push(&CRCField{Castagnoli: true})
+	e.PutInt16(b.Attributes)
+	e.PutInt32(b.LastOffsetDelta)
+	e.PutInt64(b.FirstTimestamp.UnixNano() / int64(time.Millisecond))
+	e.PutInt64(b.MaxTimestamp.UnixNano() / int64(time.Millisecond))
+	e.PutInt64(b.ProducerID)
+	e.PutInt16(b.ProducerEpoch)
+	e.PutInt32(b.FirstSequence)
+	if err := e.PutArrayLength(len(b.Records)); err != nil {
+		return err
+	}
+	if b.Codec() == CompressionNone {
+		if err := records(b.Records).Encode(e); err != nil {
+			return err
+		}
+	} else {
+		// the records count isn't compressed, the records are
+		if b.compressed == nil {
+			raw, err := Encode(records(b.Records))
+			if err != nil {
+				return err
+			}
+			if b.compressed, err = Compress(b.Codec(), raw); err != nil {
+				return err
+			}
+		}
+		if err := e.PutRawBytes(b.compressed); err != nil {
+			return err
+		}
+	}
+	e.Pop()
+	e.Pop()
+	return nil
+}
+
+func (b *RecordBatch) Decode(d PacketDecoder) error {
+	var err error
+	if b.FirstOffset, err = d.Int64(); err != nil {
+		return err
+	}
+	length, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	if b.PartitionLeaderEpoch, err = d.Int32(); err != nil {
+		return err
+	}
+	if _, err = d.Int8(); err != nil {
+		return err
+	}
+	if err = d.Push(&CRCField{Castagnoli: true}); err != nil {
+		return err
+	}
+	if b.Attributes, err = d.Int16(); err != nil {
+		return err
+	}
+	if b.LastOffsetDelta, err = d.Int32(); err != nil {
+		return err
+	}
+	t, err := d.Int64()
+	if err != nil {
+		return err
+	}
+	b.FirstTimestamp = time.Unix(t/1000, (t%1000)*int64(time.Millisecond))
+	if t, err = d.Int64(); err != nil {
+		return err
+	}
+	b.MaxTimestamp = time.Unix(t/1000, (t%1000)*int64(time.Millisecond))
+	if b.ProducerID, err = d.Int64(); err != nil {
+		return err
+	}
+	if b.ProducerEpoch, err = d.Int16(); err != nil {
+		return err
+	}
+	if b.FirstSequence, err = d.Int32(); err != nil {
+		return err
+	}
+	n, err := d.Int32()
+	if err != nil {
+		return err
+	}
+	rd := d
+	if b.Codec() != CompressionNone {
+		raw, err := d.RawBytes(int(length) - recordBatchHeaderLen - 4)
+		if err != nil {
+			return err
+		}
+		if raw, err = Decompress(b.Codec(), raw); err != nil {
+			return err
+		}
+		rd = NewDecoder(raw)
+	}
+	// a record's at least a byte, a compressed batch's count is checked
+	// against its records once they're decompressed
+	if n < 0 || int(n) > rd.remaining() {
+		return ErrInvalidArrayLength
+	}
+	rs := make(records, n)
+	if err = rs.Decode(rd); err != nil {
+		return err
+	}
+	b.Records = rs
+	return d.Pop()
+}
+
+// records are a batch's records, each prefixed with its length as a varint.
+type records []*Record
+
+func (rs records) Encode(e PacketEncoder) error {
+	for _, r := range rs {
+		// the length's measured first
+		lenEnc := new(LenEncoder)
+		if err := r.Encode(lenEnc); err != nil {
+			return err
+		}
+		e.PutVarint(int64(lenEnc.Length))
+		if err := r.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode decodes as many records as rs has room for.
+func (rs records) Decode(d PacketDecoder) error {
+	for i := range rs {
+		// the length's implied by the record's fields
+		if _, err := d.Varint(); err != nil {
+			return err
+		}
+		r := new(Record)
+		if err := r.Decode(d); err != nil {
+			return err
+		}
+		rs[i] = r
+	}
+	return nil
+}
+
+func (r *Record) Encode(e PacketEncoder) error {
+	e.PutInt8(r.Attributes)
+	e.PutVarint(int64(r.TimestampDelta / time.Millisecond))
+	e.PutVarint(r.OffsetDelta)
+	if err := e.PutVarintBytes(r.Key); err != nil {
+		return err
+	}
+	if err := e.PutVarintBytes(r.Value); err != nil {
+		return err
+	}
+	e.PutVarint(int64(len(r.Headers)))
+	for _, h := range r.Headers {
+		if err := e.PutVarintBytes([]byte(h.Key)); err != nil {
+			return err
+		}
+		if err := e.PutVarintBytes(h.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Record) Decode(d PacketDecoder) error {
+	var err error
+	if r.Attributes, err = d.Int8(); err != nil {
+		return err
+	}
+	t, err := d.Varint()
+	if err != nil {
+		return err
+	}
+	r.TimestampDelta = time.Duration(t) * time.Millisecond
+	if r.OffsetDelta, err = d.Varint(); err != nil {
+		return err
+	}
+	if r.Key, err = d.VarintBytes(); err != nil {
+		return err
+	}
+	if r.Value, err = d.VarintBytes(); err != nil {
+		return err
+	}
+	n, err := d.Varint()
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > int64(d.remaining()) {
+		return ErrInvalidArrayLength
+	}
+	for i := int64(0); i < n; i++ {
+		h := new(RecordHeader)
+		key, err := d.VarintBytes()
+		if err != nil {
+			return err
+		}
+		h.Key = string(key)
+		if h.Value, err = d.VarintBytes(); err != nil {
+			return err
+		}
+		r.Headers = append(r.Headers, h)
+	}
+	return nil
+}
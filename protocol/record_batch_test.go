@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordBatch(t *testing.T) {
+	req := require.New(t)
+	exp := &RecordBatch{
+		FirstOffset:     5,
+		LastOffsetDelta: 1,
+		FirstTimestamp:  time.Unix(1000, 0),
+		MaxTimestamp:    time.Unix(1001, 0),
+		ProducerID:      -1,
+		ProducerEpoch:   -1,
+		FirstSequence:   -1,
+		Records: []*Record{{
+			Value: []byte("one"),
+		}, {
+			TimestampDelta: time.Second,
+			OffsetDelta:    1,
+			Key:            []byte("key"),
+			Value:          []byte("two"),
+			Headers:        []*RecordHeader{{Key: "header", Value: []byte("value")}},
+		}},
+	}
+	b, err := Encode(exp)
+	req.NoError(err)
+	// the batch's entry header is the same as a message set's
+	req.Equal(int64(5), int64(Encoding.Uint64(b)))
+	req.Equal(len(b)-12, int(Encoding.Uint32(b[8:])))
+	req.Equal(byte(RecordBatchMagic), b[16])
+
+	var act RecordBatch
+	req.NoError(Decode(b, &act))
+	req.Equal(exp, &act)
+
+	// compressed records are decompressed, the count isn't compressed
+	for codec := CompressionGZIP; codec <= CompressionZSTD; codec++ {
+		exp.Attributes = int16(codec)
+		exp.compressed = nil
+		b, err = Encode(exp)
+		req.NoError(err)
+		req.Equal(uint32(len(exp.Records)), Encoding.Uint32(b[57:]))
+		act = RecordBatch{}
+		req.NoError(Decode(b, &act))
+		req.Equal(codec, act.Codec())
+		req.Equal(exp.Records, act.Records)
+	}
+}
+
+func TestProduceRequestVersions(t *testing.T) {
+	req := require.New(t)
+	id := "transactional-id"
+	for _, exp := range []*ProduceRequest{
+		{APIVersion: 2, Acks: 1, Timeout: 100, TopicData: []*TopicData{{Topic: "test", Data: []*Data{{Partition: 1, RecordSet: []byte("records")}}}}},
+		{APIVersion: 3, TransactionalID: &id, Acks: 1, Timeout: 100, TopicData: []*TopicData{{Topic: "test", Data: []*Data{{Partition: 1, RecordSet: []byte("records")}}}}},
+	} {
+		b, err := Encode(exp)
+		req.NoError(err)
+		act := &ProduceRequest{APIVersion: exp.APIVersion}
+		req.NoError(Decode(b, act))
+		req.Equal(exp, act)
+	}
+}
@@ -4,6 +4,7 @@ type Body interface {
 	Encoder
 	Key() int16
 	Version() int16
+	Versioned
 }
 
 type Request struct {
@@ -66,3 +66,11 @@ func (r *StopReplicaRequest) Key() int16 {
 func (r *StopReplicaRequest) Version() int16 {
 	return 0
 }
+
+func (r *StopReplicaRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *StopReplicaRequest) MaxVersion() int16 {
+	return 0
+}
@@ -65,3 +65,11 @@ func (r *SyncGroupRequest) Key() int16 {
 func (r *SyncGroupRequest) Version() int16 {
 	return 0
 }
+
+func (r *SyncGroupRequest) MinVersion() int16 {
+	return 0
+}
+
+func (r *SyncGroupRequest) MaxVersion() int16 {
+	return 0
+}
@@ -0,0 +1,46 @@
+package protocol
+
+// Versioned is implemented by requests to declare the oldest and newest
+// versions of them that can be encoded and decoded. A request's response is
+// encoded with the request's version.
+type Versioned interface {
+	MinVersion() int16
+	MaxVersion() int16
+}
+
+// SupportsVersion returns whether the version's one of the request's
+// supported versions.
+func SupportsVersion(req Versioned, version int16) bool {
+	return version >= req.MinVersion() && version <= req.MaxVersion()
+}
+
+// APIVersionsOf returns the supported versions of the requests' APIs, as
+// they're listed in an ApiVersions response.
+func APIVersionsOf(reqs ...Body) []APIVersion {
+	versions := make([]APIVersion, len(reqs))
+	for i, req := range reqs {
+		versions[i] = APIVersion{
+			APIKey:     req.Key(),
+			MinVersion: req.MinVersion(),
+			MaxVersion: req.MaxVersion(),
+		}
+	}
+	return versions
+}
+
+// ErrorResponse is the response to a request whose version isn't supported,
+// it has just the error code as the request's response can't be encoded
+// with the version.
+type ErrorResponse struct {
+	ErrorCode int16
+}
+
+func (r *ErrorResponse) Encode(e PacketEncoder) error {
+	e.PutInt16(r.ErrorCode)
+	return nil
+}
+
+func (r *ErrorResponse) Decode(d PacketDecoder) (err error) {
+	r.ErrorCode, err = d.Int16()
+	return err
+}
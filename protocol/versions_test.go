@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIVersionsOf(t *testing.T) {
+	req := require.New(t)
+	versions := APIVersionsOf(&ProduceRequest{}, &MetadataRequest{}, &LeaderAndISRRequest{})
+	req.Equal([]APIVersion{
+		{APIKey: ProduceKey, MinVersion: 0, MaxVersion: 3},
+		{APIKey: MetadataKey, MinVersion: 0, MaxVersion: 1},
+		{APIKey: LeaderAndISRKey, MinVersion: 0, MaxVersion: 0},
+	}, versions)
+	req.True(SupportsVersion(&FetchRequest{}, 4))
+	req.False(SupportsVersion(&FetchRequest{}, 5))
+	req.False(SupportsVersion(&FetchRequest{}, -1))
+}
+
+type versioned interface {
+	Encoder
+	Decoder
+}
+
+func TestVersions(t *testing.T) {
+	req := require.New(t)
+	rack := "rack"
+	message := "invalid config"
+	tests := []struct {
+		name string
+		exp  versioned
+		act  versioned
+	}{
+		{"api versions v0", &APIVersionsResponse{APIVersions: []APIVersion{{APIKey: FetchKey, MaxVersion: 4}}}, &APIVersionsResponse{}},
+		{"api versions v1", &APIVersionsResponse{APIVersion: 1, APIVersions: []APIVersion{{APIKey: FetchKey, MaxVersion: 4}}, ThrottleTimeMs: 10}, &APIVersionsResponse{APIVersion: 1}},
+		{"produce response v0", &ProduceResponses{Responses: []*ProduceResponse{{Topic: "t", PartitionResponses: []*ProducePartitionResponse{{BaseOffset: 1}}}}}, &ProduceResponses{}},
+		{"produce response v2", &ProduceResponses{APIVersion: 2, Responses: []*ProduceResponse{{Topic: "t", PartitionResponses: []*ProducePartitionResponse{{BaseOffset: 1, Timestamp: 2}}}}, ThrottleTimeMs: 10}, &ProduceResponses{APIVersion: 2}},
+		{"offsets v0", &OffsetsRequest{ReplicaID: -1, Topics: []*OffsetsTopic{{Topic: "t", Partitions: []*OffsetsPartition{{Timestamp: -1, MaxNumOffsets: 1}}}}}, &OffsetsRequest{}},
+		{"offsets v1", &OffsetsRequest{APIVersion: 1, ReplicaID: -1, Topics: []*OffsetsTopic{{Topic: "t", Partitions: []*OffsetsPartition{{Timestamp: -1}}}}}, &OffsetsRequest{APIVersion: 1}},
+		{"offsets response v0", &OffsetsResponse{Responses: []*OffsetResponse{{Topic: "t", PartitionResponses: []*PartitionResponse{{Offsets: []int64{3}}}}}}, &OffsetsResponse{}},
+		{"offsets response v1", &OffsetsResponse{APIVersion: 1, Responses: []*OffsetResponse{{Topic: "t", PartitionResponses: []*PartitionResponse{{Timestamp: -1, Offset: 3}}}}}, &OffsetsResponse{APIVersion: 1}},
+		{"metadata v1 all topics", &MetadataRequest{APIVersion: 1}, &MetadataRequest{APIVersion: 1}},
+		{"metadata v1 no topics", &MetadataRequest{APIVersion: 1, Topics: []string{}}, &MetadataRequest{APIVersion: 1}},
+		{"metadata response v1", &MetadataResponse{
+			APIVersion:    1,
+			Brokers:       []*Broker{{NodeID: 1, Host: "localhost", Port: 9092, Rack: &rack}},
+			ControllerID:  1,
+			TopicMetadata: []*TopicMetadata{{Topic: "__internal", IsInternal: true, PartitionMetadata: []*PartitionMetadata{{Leader: 1, Replicas: []int32{1}, ISR: []int32{1}}}}},
+		}, &MetadataResponse{APIVersion: 1}},
+		{"create topics v1", &CreateTopicRequests{APIVersion: 1, Requests: []*CreateTopicRequest{{Topic: "t", NumPartitions: 1, ReplicationFactor: 1, ReplicaAssignment: map[int32][]int32{}, Configs: map[string]string{}}}, Timeout: 10, ValidateOnly: true}, &CreateTopicRequests{APIVersion: 1}},
+		{"create topics response v2", &CreateTopicsResponse{APIVersion: 2, ThrottleTimeMs: 10, TopicErrorCodes: []*TopicErrorCode{{Topic: "t", ErrorCode: ErrInvalidConfig.Code(), ErrorMessage: &message}}}, &CreateTopicsResponse{APIVersion: 2}},
+		{"delete topics response v1", &DeleteTopicsResponse{APIVersion: 1, ThrottleTimeMs: 10, TopicErrorCodes: []*TopicErrorCode{{Topic: "t"}}}, &DeleteTopicsResponse{APIVersion: 1}},
+		{"offset commit v0", &OffsetCommitRequest{GroupID: "g", RetentionTime: -1, Topics: []*OffsetCommitTopic{{Topic: "t", Partitions: []*OffsetCommitPartition{{Offset: 3, Timestamp: -1, Metadata: &message}}}}}, &OffsetCommitRequest{}},
+		{"offset commit v1", &OffsetCommitRequest{APIVersion: 1, GroupID: "g", GenerationID: 1, MemberID: "m", RetentionTime: -1, Topics: []*OffsetCommitTopic{{Topic: "t", Partitions: []*OffsetCommitPartition{{Offset: 3, Timestamp: 10}}}}}, &OffsetCommitRequest{APIVersion: 1}},
+		{"offset commit v2", &OffsetCommitRequest{APIVersion: 2, GroupID: "g", GenerationID: 1, MemberID: "m", RetentionTime: 1000, Topics: []*OffsetCommitTopic{{Topic: "t", Partitions: []*OffsetCommitPartition{{Offset: 3, Timestamp: -1}}}}}, &OffsetCommitRequest{APIVersion: 2}},
+		{"offset commit response", &OffsetCommitResponse{Responses: []*OffsetCommitTopicResponse{{Topic: "t", Partitions: []*OffsetCommitPartitionResponse{{Partition: 1, ErrorCode: ErrOffsetMetadataTooLarge.Code()}}}}}, &OffsetCommitResponse{}},
+		{"offset fetch v1", &OffsetFetchRequest{APIVersion: 1, GroupID: "g", Topics: []*OffsetFetchTopic{{Topic: "t", Partitions: []int32{0, 1}}}}, &OffsetFetchRequest{APIVersion: 1}},
+		{"offset fetch v2 all topics", &OffsetFetchRequest{APIVersion: 2, GroupID: "g"}, &OffsetFetchRequest{APIVersion: 2}},
+		{"offset fetch response v2", &OffsetFetchResponse{APIVersion: 2, Responses: []*OffsetFetchTopicResponse{{Topic: "t", Partitions: []*OffsetFetchPartitionResponse{{Offset: 3, Metadata: &message}, {Partition: 1, Offset: -1}}}}, ErrorCode: ErrNotCoordinator.Code()}, &OffsetFetchResponse{APIVersion: 2}},
+	}
+	for _, test := range tests {
+		b, err := Encode(test.exp)
+		req.NoError(err, test.name)
+		req.NoError(Decode(b, test.act), test.name)
+		req.Equal(test.exp, test.act, test.name)
+	}
+
+	// metadata version 0 has no nulls, empty topics are all of them
+	req.True((&MetadataRequest{}).AllTopics())
+	req.True((&MetadataRequest{APIVersion: 1}).AllTopics())
+	req.False((&MetadataRequest{APIVersion: 1, Topics: []string{}}).AllTopics())
+
+	// offset fetch has no nulls before version 2
+	req.False((&OffsetFetchRequest{APIVersion: 1}).AllTopics())
+	req.True((&OffsetFetchRequest{APIVersion: 2}).AllTopics())
+}
@@ -56,7 +56,7 @@ func (p *Client) FetchMessages(clientID string, fetchRequest *protocol.FetchRequ
 		ClientID:      clientID,
 		Body:          fetchRequest,
 	}
-	fetchResponse := new(protocol.FetchResponses)
+	fetchResponse := &protocol.FetchResponses{APIVersion: fetchRequest.APIVersion}
 	if err := p.makeRequest(req, fetchResponse); err != nil {
 		return nil, err
 	}
@@ -70,7 +70,7 @@ func (p *Client) CreateTopics(clientID string, createRequests *protocol.CreateTo
 		ClientID:      clientID,
 		Body:          createRequests,
 	}
-	createResponse := new(protocol.CreateTopicsResponse)
+	createResponse := &protocol.CreateTopicsResponse{APIVersion: createRequests.APIVersion}
 	if err := p.makeRequest(req, createResponse); err != nil {
 		return nil, err
 	}
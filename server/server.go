@@ -133,11 +133,17 @@ func (s *Server) Close() {
 	s.protocolLn.Close()
 }
 
+// maxRequestSize is the size of the largest request that's read, a larger
+// one's treated as malformed rather than allocated for.
+const maxRequestSize = 100 * 1024 * 1024
+
+// handleRequest reads and decodes the connection's requests for the broker.
+// A request that can't be read or decoded closes the connection, as what
+// follows it can't be trusted.
 func (s *Server) handleRequest(conn net.Conn) {
 	s.metrics.RequestsHandled.Inc()
 	defer conn.Close()
 
-	header := new(protocol.RequestHeader)
 	p := make([]byte, 4)
 
 	for {
@@ -159,51 +165,34 @@ func (s *Server) handleRequest(conn net.Conn) {
 		if size == 0 {
 			break // TODO: should this even happen?
 		}
+		if size > maxRequestSize {
+			s.logger.Error("request too large", log.Uint32("size", size))
+			break
+		}
 
 		b := make([]byte, size+4) //+4 since we're going to copy the size into b
 		copy(b, p)
 
 		if _, err = io.ReadFull(conn, b[4:]); err != nil {
-			// TODO: handle request
 			s.logger.Error("failed to read from connection", log.Error("error", err))
-			panic(err)
+			break
 		}
 
-		d := protocol.NewDecoder(b)
-		if err := header.Decode(d); err != nil {
-			// TODO: handle err
+		header, req, err := protocol.DecodeRequest(b)
+		if header == nil {
 			s.logger.Error("failed to decode header", log.Error("error", err))
-			panic(err)
+			break
 		}
 
 		s.logger.Debug("request", log.Int32("correlation id", header.CorrelationID), log.String("client id", header.ClientID), log.Uint32("size", size), log.Int16("api key", header.APIKey))
 
-		var req protocol.Decoder
-		switch header.APIKey {
-		case protocol.APIVersionsKey:
-			req = &protocol.APIVersionsRequest{}
-		case protocol.ProduceKey:
-			req = &protocol.ProduceRequest{}
-		case protocol.FetchKey:
-			req = &protocol.FetchRequest{}
-		case protocol.OffsetsKey:
-			req = &protocol.OffsetsRequest{}
-		case protocol.MetadataKey:
-			req = &protocol.MetadataRequest{}
-		case protocol.CreateTopicsKey:
-			req = &protocol.CreateTopicRequests{}
-		case protocol.DeleteTopicsKey:
-			req = &protocol.DeleteTopicsRequest{}
-		case protocol.LeaderAndISRKey:
-			req = &protocol.LeaderAndISRRequest{}
-		}
-
-		if err := req.Decode(d); err != nil {
-			// TODO: handle err
+		if err != nil {
 			s.logger.Error("failed to decode request", log.Error("error", err))
-			panic(err)
+			break
 		}
 
+		// the broker responds to requests with unknown API keys or versions
+		// that aren't supported with an error
 		s.requestCh <- jocko.Request{
 			Header:  header,
 			Request: req,
@@ -214,11 +203,14 @@ func (s *Server) handleRequest(conn net.Conn) {
 
 func (s *Server) write(resp jocko.Response) error {
 	s.logger.Debug("response", log.Int32("correlation id", resp.Header.CorrelationID), log.Int16("api key", resp.Header.APIKey))
-	b, err := protocol.Encode(resp.Response.(protocol.Encoder))
+	err := protocol.EncodeTo(resp.Conn, resp.Response.(protocol.Encoder))
 	if err != nil {
-		return err
+		// the response can have been partly written, so the client can't
+		// find where the next one starts
+		if c, ok := resp.Conn.(io.Closer); ok {
+			c.Close()
+		}
 	}
-	_, err = resp.Conn.Write(b)
 	return err
 }
 